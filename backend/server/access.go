@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// accessQueueSize is how many reads may wait to be recorded before further ones are dropped
+const accessQueueSize = 1024
+
+// accessTracker records when memories were last read by /get-memory-by-id, for /recent.  The timestamps are written
+// by its own goroutine through the write queue, so reads never wait for them.
+type accessTracker struct {
+	writes  *writeQueue
+	timeout time.Duration
+	reads   chan memoryAccess
+	done    chan struct{} // Closed when the recording goroutine has finished
+
+	mu      sync.RWMutex // Held for reading while a read is queued, so Stop can't close reads under a sender
+	stopped bool
+}
+
+type memoryAccess struct {
+	namespace, memoryID string
+	at                  time.Time
+}
+
+// newAccessTracker starts the goroutine recording accesses, which runs until Stop is called
+func newAccessTracker(writes *writeQueue, timeout time.Duration) *accessTracker {
+	a := &accessTracker{writes: writes, timeout: timeout, reads: make(chan memoryAccess, accessQueueSize), done: make(chan struct{})}
+	go func() {
+		defer close(a.done)
+		for r := range a.reads {
+			a.write(r)
+		}
+	}()
+	return a
+}
+
+// Record queues a read of a memory to be recorded.  When the queue is full the read is dropped instead, as a
+// slightly stale last_accessed_at matters less than a slow read.
+func (a *accessTracker) Record(namespace, memoryID string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.stopped {
+		return
+	}
+	select {
+	case a.reads <- memoryAccess{namespace, memoryID, time.Now().UTC()}:
+	default:
+		slog.Debug("Access queue full, not recording the read", "namespace", namespace, "memory_id", memoryID)
+	}
+}
+
+// Stop waits for the queued reads to be recorded, then ends the recording goroutine.  It must be called before the
+// write queue is stopped, and is safe to call more than once.
+func (a *accessTracker) Stop() {
+	a.mu.Lock()
+	if !a.stopped {
+		a.stopped = true
+		close(a.reads)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *accessTracker) write(r memoryAccess) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	err := a.writes.Write(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO memory_access (namespace, memory_id, last_accessed_at) VALUES (?, ?, ?)
+			ON CONFLICT (namespace, memory_id) DO UPDATE SET last_accessed_at = excluded.last_accessed_at`, r.namespace, r.memoryID, r.at)
+		return err
+	})
+	if err != nil {
+		slog.Warn("Could not record a memory access", "namespace", r.namespace, "memory_id", r.memoryID, "error", err)
+	}
+}
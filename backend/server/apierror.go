@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-fuego/fuego"
+)
+
+// Error codes returned in the code field of error responses.  Clients should branch on these rather than the
+// message, which is meant for people and may change.
+const (
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeMemoryNotFound       = "memory_not_found"
+	CodeVersionNotFound      = "version_not_found"
+	CodeBlobNotFound         = "blob_not_found"
+	CodeVersionConflict      = "version_conflict"
+	CodeMemoryExists         = "memory_exists"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeUnsupportedMedia     = "unsupported_media_type"
+	CodeRateLimited          = "rate_limited"
+	CodeUnavailable          = "unavailable"
+	CodeInternalError        = "internal_error"
+)
+
+// statusCodes is the code used for each status when the handler didn't pick a more specific one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeValidationFailed,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusNotFound:              CodeMemoryNotFound,
+	http.StatusConflict:              CodeVersionConflict,
+	http.StatusPreconditionFailed:    CodePreconditionFailed,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMedia,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusInternalServerError:   CodeInternalError,
+}
+
+// APIError is the body of every error response
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code" example:"memory_not_found"`
+	Message   string `json:"message" example:"memory \"project-notes\" not found"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e APIError) Error() string   { return e.Message }
+func (e APIError) StatusCode() int { return e.Status }
+
+// codedError overrides the code an error would otherwise get from its status
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e codedError) Error() string { return e.err.Error() }
+func (e codedError) Unwrap() error { return e.err }
+
+// withCode tags err with a specific error code, for the cases where the status alone is ambiguous (eg a 404 for a
+// missing version rather than a missing memory)
+func withCode(code string, err error) error {
+	return codedError{code: code, err: err}
+}
+
+// toAPIError converts the errors returned by handlers (and by fuego itself, eg for unreadable bodies) into an
+// APIError.  It's registered as fuego's error handler, and sendError uses it for errors raised by middleware.
+func toAPIError(err error) error {
+	var apiErr APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	apiErr.Status = http.StatusInternalServerError
+	var withStatus fuego.ErrorWithStatus
+	if errors.As(err, &withStatus) && withStatus.StatusCode() != 0 {
+		apiErr.Status = withStatus.StatusCode()
+	}
+
+	var withDetail fuego.ErrorWithDetail
+	var httpErr fuego.HTTPError
+	switch {
+	case errors.As(err, &withDetail) && withDetail.DetailMsg() != "":
+		apiErr.Message = withDetail.DetailMsg()
+	case errors.As(err, &httpErr) && httpErr.Title != "":
+		apiErr.Message = httpErr.Title
+	default:
+		apiErr.Message = err.Error()
+	}
+
+	var coded codedError
+	if errors.As(err, &coded) {
+		apiErr.Code = coded.code
+	} else if code, ok := statusCodes[apiErr.Status]; ok {
+		apiErr.Code = code
+	} else {
+		apiErr.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(apiErr.Status)), " ", "_")
+	}
+	return apiErr
+}
+
+// sendError writes error responses, including the request ID so users can quote it in bug reports
+func sendError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := toAPIError(err).(APIError)
+	apiErr.RequestID = RequestID(r.Context())
+	if apiErr.Status >= 500 {
+		slog.ErrorContext(r.Context(), "request failed", "status", apiErr.Status, "code", apiErr.Code, "error", apiErr.Message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	if err := json.NewEncoder(w).Encode(apiErr); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write error response", "error", err)
+	}
+}
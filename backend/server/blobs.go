@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-fuego/fuego"
+)
+
+// blobFormField is the multipart field /memory/{memory_id}/blob reads the upload from
+const blobFormField = "file"
+
+// Blob describes a file attached to a memory, without its bytes
+type Blob struct {
+	ID          int64     `json:"id"`
+	Namespace   string    `json:"namespace"`
+	MemoryID    string    `json:"memory_id"`
+	Filename    string    `json:"filename,omitempty"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// uploadBlob reads the file part of a multipart upload and stores it against the latest active version's memory.
+// Only the file's part is read, and no more than MaxBlobBytes of it, so oversized uploads fail without being
+// buffered in full.
+func (srv *Server) uploadBlob(ctx context.Context, r *http.Request, namespace, memoryID string) (*Blob, error) {
+	if err := validateMemoryID("memory_id", memoryID); err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	parts, err := r.MultipartReader()
+	if err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "expected a multipart/form-data upload: " + err.Error()}
+	}
+	for {
+		part, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("the upload has no %q field", blobFormField)}
+		}
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "reading the upload: " + err.Error()}
+		}
+		if part.FormName() != blobFormField {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(part, int64(srv.cfg.MaxBlobBytes)+1))
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "reading the upload: " + err.Error()}
+		}
+		if len(data) > srv.cfg.MaxBlobBytes {
+			return nil, fuego.HTTPError{Status: http.StatusRequestEntityTooLarge, Title: "Request Entity Too Large", Detail: fmt.Sprintf("blobs can be at most %d bytes", srv.cfg.MaxBlobBytes)}
+		}
+		contentType := part.Header.Get("Content-Type")
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			contentType = "application/octet-stream"
+		}
+		return srv.storeBlob(ctx, Blob{Namespace: namespace, MemoryID: memoryID, Filename: part.FileName(), ContentType: contentType, Size: int64(len(data))}, data)
+	}
+}
+
+// storeBlob saves a blob for a memory which has an active version, returning it with its ID and creation time set
+func (srv *Server) storeBlob(ctx context.Context, b Blob, data []byte) (*Blob, error) {
+	b.CreatedAt = time.Now().UTC()
+	err := srv.writes.Write(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM memories WHERE namespace=? AND memory_id=? AND archived=0)", b.Namespace, b.MemoryID).Scan(&exists); err != nil {
+			return dbError(err)
+		}
+		if !exists {
+			return fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", b.MemoryID)}
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO blobs (namespace, memory_id, filename, content_type, size, data, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, b.Namespace, b.MemoryID, b.Filename, b.ContentType, b.Size, data, b.CreatedAt)
+		if err != nil {
+			return dbError(err)
+		}
+		if b.ID, err = res.LastInsertId(); err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// serveBlob writes a blob's bytes with the content type it was uploaded with.  Uploads can claim any type, so the
+// browser is told not to sniff it and to sandbox anything it renders, in case it's HTML with scripts in.
+func (srv *Server) serveBlob(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := srv.queryContext(r.Context())
+	defer cancel()
+	namespace, err := queryNamespace(r.URL.Query().Get)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("blob_id"), 10, 64)
+	if err != nil {
+		sendError(w, r, fuego.BadRequestError{Title: "Bad Request", Detail: "blob_id must be an integer"})
+		return
+	}
+	var b Blob
+	var data []byte
+	err = srv.db.QueryRowContext(ctx, `SELECT filename, content_type, data FROM blobs WHERE id=? AND namespace=?`, id, namespace).Scan(&b.Filename, &b.ContentType, &data)
+	if err == sql.ErrNoRows {
+		sendError(w, r, withCode(CodeBlobNotFound, fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("blob %d not found", id)}))
+		return
+	}
+	if err != nil {
+		sendError(w, r, dbError(err))
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", b.ContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "sandbox")
+	if b.Filename != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": b.Filename}))
+	}
+	if _, err := w.Write(data); err != nil {
+		slog.DebugContext(ctx, "Blob write failed", "error", err)
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server's settings.  LoadConfig fills it from the MEMORY_SERVER_* environment variables.
+type Config struct {
+	DSN              string          // SQLite database path, or :memory:
+	ListenAddr       string          // IP address to listen on, eg 127.0.0.1 to only accept local connections
+	Port             string          // Port to listen on
+	LogLevel         slog.Level      // Lowest level logged
+	LogBodies        bool            // Log request and response bodies at debug level, for troubleshooting clients
+	APIKey           string          // When set, required as a bearer token on every request which can change data
+	MaxContentBytes  int             // Largest memory content accepted by save and update
+	MaxBlobBytes     int             // Largest file accepted by /memory/{memory_id}/blob
+	MaxTags          int             // Most tags a memory may have
+	MaxTagLength     int             // Longest tag accepted, in characters
+	NormalizeTags    bool            // Trim whitespace from tags and lower case them before storing
+	NormalizeContent bool            // Trim surrounding whitespace from content and convert it to Unicode NFC before storing
+	QueryTimeout     time.Duration   // Longest a request's database work may take before it's cancelled
+	BusyTimeout      time.Duration   // How long a write waits for the SQLite lock before failing
+	ShutdownTimeout  time.Duration   // How long shutdown waits for in-flight requests before cutting them off
+	IdempotencyTTL   time.Duration   // How long /save-memory remembers an Idempotency-Key, answering retries with the first save
+	MaxOpenConns     int             // Maximum open database connections.  In-memory databases always use 1
+	IndexHTMLPath    string          // Served at / instead of the embedded index.html when set
+	CORSOrigins      []string        // Origins whose pages may call the API, "*" for any.  Empty means same-origin only
+	RateLimit        float64         // Writes per second allowed for each client.  0 means unlimited
+	EncryptionKey    []byte          // AES key (16, 24 or 32 bytes) for encrypting content at rest.  Empty stores plaintext
+	MetadataSchema   *MetadataSchema // When set, metadata must match it on save and update.  Nil accepts any object
+	Versioning       Versioning      // Whether updates write a new version or overwrite the latest one
+	MaxVersions      int             // Most versions kept per memory, pruning the oldest archived ones.  0 keeps them all
+	SeedFile         string          // NDJSON file of memories imported at startup when the database is empty
+	BackupDir        string          // Directory /backup writes to.  Empty lets requests give any path
+	TrackAccess      bool            // Record when /get-memory-by-id last read each memory, for /recent.  Adds a write per read
+	TLSCert          string          // PEM certificate file for serving HTTPS.  Set along with TLSKey, or neither
+	TLSKey           string          // PEM private key file matching TLSCert
+}
+
+// Versioning controls what /update-memory does to a memory's history
+type Versioning string
+
+const (
+	// VersioningVersioned archives the latest version and writes the update as a new one, keeping the full history
+	VersioningVersioned Versioning = "versioned"
+	// VersioningMutable overwrites the latest version in place, saving space but losing the previous content
+	VersioningMutable Versioning = "mutable"
+)
+
+// DefaultConfig returns the settings used for anything not set in the environment.  The DSN is left empty, as its
+// default depends on the user's home directory.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:      "0.0.0.0",
+		Port:            "38080",
+		LogLevel:        slog.LevelInfo,
+		MaxContentBytes: 1 << 20,
+		MaxBlobBytes:    10 << 20,
+		MaxTags:         50,
+		MaxTagLength:    64,
+		QueryTimeout:    30 * time.Second,
+		BusyTimeout:     5 * time.Second,
+		ShutdownTimeout: 5 * time.Second,
+		IdempotencyTTL:  24 * time.Hour,
+		MaxOpenConns:    4,
+		Versioning:      VersioningVersioned,
+	}
+}
+
+// LoadConfig reads the configuration from the environment, falling back to DefaultConfig.  On error the returned
+// Config is still usable for logging the problem.
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+	var err error
+	cfg.DSN = os.Getenv("MEMORY_SERVER_DSN")
+	if cfg.DSN == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return cfg, fmt.Errorf("could not determine user home directory: %w", err)
+		}
+		cfg.DSN = home + "/Databases/memory_server.sqlite"
+	}
+	if addr := os.Getenv("MEMORY_SERVER_LISTEN_ADDR"); addr != "" {
+		if net.ParseIP(addr) == nil {
+			return cfg, fmt.Errorf("MEMORY_SERVER_LISTEN_ADDR must be an IP address, eg 127.0.0.1, got %q", addr)
+		}
+		cfg.ListenAddr = addr
+	}
+	if port := os.Getenv("MEMORY_SERVER_PORT"); port != "" {
+		cfg.Port = port
+	}
+	if cfg.LogLevel, err = parseLogLevel(os.Getenv("MEMORY_SERVER_LOG_LEVEL")); err != nil {
+		return cfg, err
+	}
+	if cfg.LogBodies, err = envBool("MEMORY_SERVER_LOG_BODIES", cfg.LogBodies); err != nil {
+		return cfg, err
+	}
+	cfg.APIKey = os.Getenv("MEMORY_SERVER_API_KEY")
+	cfg.IndexHTMLPath = os.Getenv("MEMORY_SERVER_INDEX_HTML")
+	for _, origin := range strings.Split(os.Getenv("MEMORY_SERVER_CORS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, origin)
+		}
+	}
+	if cfg.MaxContentBytes, err = envInt("MEMORY_SERVER_MAX_CONTENT_BYTES", cfg.MaxContentBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBlobBytes, err = envInt("MEMORY_SERVER_MAX_BLOB_BYTES", cfg.MaxBlobBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTags, err = envInt("MEMORY_SERVER_MAX_TAGS", cfg.MaxTags); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTagLength, err = envInt("MEMORY_SERVER_MAX_TAG_LENGTH", cfg.MaxTagLength); err != nil {
+		return cfg, err
+	}
+	if cfg.NormalizeTags, err = envBool("MEMORY_SERVER_NORMALIZE_TAGS", cfg.NormalizeTags); err != nil {
+		return cfg, err
+	}
+	if cfg.NormalizeContent, err = envBool("MEMORY_SERVER_NORMALIZE_CONTENT", cfg.NormalizeContent); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxOpenConns, err = envInt("MEMORY_SERVER_MAX_OPEN_CONNS", cfg.MaxOpenConns); err != nil {
+		return cfg, err
+	}
+	if cfg.QueryTimeout, err = envMillis("MEMORY_SERVER_QUERY_TIMEOUT_MS", cfg.QueryTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.BusyTimeout, err = envMillis("MEMORY_SERVER_BUSY_TIMEOUT_MS", cfg.BusyTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownTimeout, err = envDuration("MEMORY_SERVER_SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyTTL, err = envDuration("MEMORY_SERVER_IDEMPOTENCY_TTL", cfg.IdempotencyTTL); err != nil {
+		return cfg, err
+	}
+	if key := os.Getenv("MEMORY_SERVER_ENCRYPTION_KEY"); key != "" {
+		cfg.EncryptionKey, err = base64.StdEncoding.DecodeString(key)
+		if err != nil || !slices.Contains([]int{16, 24, 32}, len(cfg.EncryptionKey)) {
+			return cfg, fmt.Errorf("MEMORY_SERVER_ENCRYPTION_KEY must be a base64 encoded 16, 24 or 32 byte key")
+		}
+	}
+	if path := os.Getenv("MEMORY_SERVER_METADATA_SCHEMA"); path != "" {
+		if cfg.MetadataSchema, err = LoadMetadataSchema(path); err != nil {
+			return cfg, fmt.Errorf("MEMORY_SERVER_METADATA_SCHEMA: %w", err)
+		}
+	}
+	if cfg.RateLimit, err = envFloat("MEMORY_SERVER_RATE_LIMIT", cfg.RateLimit); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxVersions, err = envInt("MEMORY_SERVER_MAX_VERSIONS", cfg.MaxVersions); err != nil {
+		return cfg, err
+	}
+	cfg.SeedFile = os.Getenv("MEMORY_SERVER_SEED_FILE")
+	cfg.BackupDir = os.Getenv("MEMORY_SERVER_BACKUP_DIR")
+	if cfg.TrackAccess, err = envBool("MEMORY_SERVER_TRACK_ACCESS", cfg.TrackAccess); err != nil {
+		return cfg, err
+	}
+	cfg.TLSCert, cfg.TLSKey = os.Getenv("MEMORY_SERVER_TLS_CERT"), os.Getenv("MEMORY_SERVER_TLS_KEY")
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, fmt.Errorf("MEMORY_SERVER_TLS_CERT and MEMORY_SERVER_TLS_KEY must be set together")
+	}
+	if cfg.TLSCert != "" {
+		// Loading the pair now catches unreadable or mismatched files at startup, rather than on the first connection
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+			return cfg, fmt.Errorf("MEMORY_SERVER_TLS_CERT and MEMORY_SERVER_TLS_KEY: %w", err)
+		}
+	}
+	if v := os.Getenv("MEMORY_SERVER_VERSIONING"); v != "" {
+		cfg.Versioning = Versioning(strings.ToLower(v))
+		if cfg.Versioning != VersioningVersioned && cfg.Versioning != VersioningMutable {
+			return cfg, fmt.Errorf("MEMORY_SERVER_VERSIONING must be versioned or mutable, got %q", v)
+		}
+	}
+	return cfg, nil
+}
+
+// TLS reports whether the server should serve HTTPS
+func (cfg Config) TLS() bool {
+	return cfg.TLSCert != ""
+}
+
+// Addr is the host:port the server listens on
+func (cfg Config) Addr() string {
+	return net.JoinHostPort(cfg.ListenAddr, cfg.Port)
+}
+
+// envInt reads a positive integer from an environment variable, returning def when the variable isn't set
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", name, v)
+	}
+	return n, nil
+}
+
+// envFloat reads a non-negative number from an environment variable, returning def when the variable isn't set
+func envFloat(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("%s must be a non-negative number, got %q", name, v)
+	}
+	return f, nil
+}
+
+// parseLogLevel converts a MEMORY_SERVER_LOG_LEVEL value into a slog level.  An empty value means info.
+func parseLogLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", value)
+}
+
+// envMillis reads a duration given in milliseconds from an environment variable, returning def when it isn't set
+func envMillis(name string, def time.Duration) (time.Duration, error) {
+	ms, err := envInt(name, int(def/time.Millisecond))
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+// envDuration reads a positive duration such as "30s" or "2m" from an environment variable, returning def when it
+// isn't set
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as 30s or 2m, got %q", name, v)
+	}
+	return d, nil
+}
+
+// envBool reads a boolean ("true", "false", "1", "0" etc) from an environment variable, returning def when it isn't set
+func envBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %q", name, v)
+	}
+	return b, nil
+}
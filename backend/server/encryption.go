@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// contentCipher encrypts memory content at rest with AES-GCM, each row sealed with its own random nonce.  A nil
+// *contentCipher leaves new content as plaintext.
+//
+// The work is done by SQL functions registered on every connection, so the key only lives with the database
+// handle.  Reads go through open_content in memoryColumns, and inserts through seal_content with a nonce from
+// content_nonce.  Rows without a nonce are plaintext, so databases written before a key was set keep working.
+type contentCipher struct {
+	aead cipher.AEAD
+}
+
+// newContentCipher returns the cipher for an AES-128, 192 or 256 key, or nil when no key is given
+func newContentCipher(key []byte) (*contentCipher, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &contentCipher{aead: aead}, nil
+}
+
+// register adds the content_nonce, seal_content and open_content SQL functions to a connection
+func (c *contentCipher) register(conn *sqlite3.SQLiteConn) error {
+	if err := conn.RegisterFunc("content_nonce", c.nonce, false); err != nil {
+		return err
+	}
+	if err := conn.RegisterFunc("seal_content", c.seal, true); err != nil {
+		return err
+	}
+	return conn.RegisterFunc("open_content", c.open, true)
+}
+
+// nonce returns a fresh random nonce for a new row, or NULL when content is stored as plaintext
+func (c *contentCipher) nonce() (any, error) {
+	if c == nil {
+		return nil, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// seal encrypts content with the row's nonce.  Without a nonce the content is returned as it is.
+func (c *contentCipher) seal(content string, nonce any) (any, error) {
+	n, _ := nonce.([]byte)
+	if len(n) == 0 {
+		return content, nil
+	}
+	if c == nil {
+		return nil, errors.New("a nonce was given but no encryption key is set")
+	}
+	return c.aead.Seal(nil, n, []byte(content), nil), nil
+}
+
+// open decrypts stored content with the row's nonce.  Without a nonce the content is plaintext and returned as it is.
+func (c *contentCipher) open(content any, nonce any) (any, error) {
+	n, _ := nonce.([]byte)
+	if len(n) == 0 {
+		return content, nil
+	}
+	if c == nil {
+		return nil, errors.New("memory content is encrypted, but MEMORY_SERVER_ENCRYPTION_KEY isn't set")
+	}
+	var sealed []byte
+	switch v := content.(type) {
+	case []byte:
+		sealed = v
+	case string:
+		sealed = []byte(v)
+	}
+	plain, err := c.aead.Open(nil, n, sealed, nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt memory content, check MEMORY_SERVER_ENCRYPTION_KEY")
+	}
+	return string(plain), nil
+}
+
+// sqliteConnector opens connections through a driver of our own, so each database handle can have its own
+// encryption key in its SQL functions
+type sqliteConnector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
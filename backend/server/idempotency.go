@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-fuego/fuego"
+)
+
+// idempotencyKeyHeader lets clients retry /save-memory without the retry saving another version
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted, which is plenty for a UUID or similar
+const maxIdempotencyKeyLength = 255
+
+// idempotentSave is the save an Idempotency-Key was first used for
+type idempotentSave struct {
+	rowID  int64
+	pruned int64
+}
+
+// saveFingerprint identifies a save request's body, so reusing a key for a different save can be told apart from a
+// retry.  It's taken before the server fills in anything, such as a generated memory_id.
+func saveFingerprint(body SaveMemoryInput) (string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// claimIdempotencyKey records that a save with key is starting, clearing out expired keys as it goes.  When the key
+// has already been used for a finished save of the same request, that save is returned for the retry to be answered
+// with instead.
+func (srv *Server) claimIdempotencyKey(ctx context.Context, key, fingerprint string) (*idempotentSave, error) {
+	if isPostgres(srv.db) {
+		return nil, fuego.HTTPError{Status: http.StatusNotImplemented, Title: "Not Implemented", Detail: idempotencyKeyHeader + " isn't supported with a Postgres database yet"}
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("%s can be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)}
+	}
+	now := time.Now().UTC()
+	var prior *idempotentSave
+	err := srv.writes.Write(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= ?", now); err != nil {
+			return dbError(err)
+		}
+		var storedFingerprint string
+		var rowID sql.NullInt64
+		var pruned int64
+		err := tx.QueryRowContext(ctx, "SELECT fingerprint, memory_row_id, pruned FROM idempotency_keys WHERE idempotency_key=?", key).Scan(&storedFingerprint, &rowID, &pruned)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err = tx.ExecContext(ctx, "INSERT INTO idempotency_keys (idempotency_key, fingerprint, created_at, expires_at) VALUES (?, ?, ?, ?)", key, fingerprint, now, now.Add(srv.cfg.IdempotencyTTL))
+			if err != nil {
+				return dbError(err)
+			}
+			return nil
+		case err != nil:
+			return dbError(err)
+		case storedFingerprint != fingerprint:
+			return withCode(CodeIdempotencyKeyReused, fuego.HTTPError{Status: http.StatusUnprocessableEntity, Title: "Unprocessable Entity", Detail: idempotencyKeyHeader + " was already used for a different request"})
+		case !rowID.Valid:
+			return fuego.ConflictError{Title: "Conflict", Detail: "a request with this " + idempotencyKeyHeader + " is still being processed, please retry"}
+		}
+		prior = &idempotentSave{rowID: rowID.Int64, pruned: pruned}
+		return nil
+	})
+	return prior, err
+}
+
+// finishIdempotencyKey records the save a claimed key produced, for retries to be answered with
+func (srv *Server) finishIdempotencyKey(ctx context.Context, key string, res WriteResult) error {
+	return srv.writes.Write(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE idempotency_keys SET memory_row_id=?, pruned=? WHERE idempotency_key=?", res.Memory.ID, res.Pruned, key); err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+}
+
+// releaseIdempotencyKey forgets a claimed key after its save failed, so the client can retry with it.  This runs even
+// when the request's context has been cancelled, as otherwise the key would be stuck until it expired.
+func (srv *Server) releaseIdempotencyKey(ctx context.Context, key string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), srv.cfg.QueryTimeout)
+	defer cancel()
+	err := srv.writes.Write(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE idempotency_key=? AND memory_row_id IS NULL", key)
+		return err
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Could not release an idempotency key", "error", err)
+	}
+}
+
+// replaySave answers a retried save with the version the first request saved.  It's read back from the memories
+// table rather than stored with the key, so encrypted content doesn't get a plaintext copy.
+func (srv *Server) replaySave(ctx context.Context, prior *idempotentSave) (*SavedMemoryResponse, error) {
+	m, err := scanMemory(srv.db.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE id=?`, prior.rowID))
+	if err == sql.ErrNoRows {
+		return nil, fuego.NotFoundError{Title: "Not Found", Detail: "the version saved with this " + idempotencyKeyHeader + " has since been pruned"}
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return &SavedMemoryResponse{Status: "saved", Memory: m, Pruned: prior.pruned}, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// expectedColumns are the tables and columns the server's queries rely on, checked at startup so an incompatible
+// database (eg one from a newer server, or edited by hand) fails straight away rather than on the first request
+var expectedColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"memories", []string{"id", "namespace", "memory_id", "version", "content", "tags", "metadata", "archived", "pinned", "created_at", "updated_at"}},
+	{"schema_migrations", []string{"version", "description", "applied_at"}},
+}
+
+// DatabaseCheck is the result of the startup checks on the database, reported by /healthz
+type DatabaseCheck struct {
+	Integrity string    `json:"integrity"` // "ok", or "skipped" for databases without an integrity check
+	Schema    string    `json:"schema"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// CheckDatabase runs SQLite's integrity check and verifies the schema has every table and column the server needs.
+// It's meant to run once at startup, after Migrate, as the integrity check reads the whole database file.
+func CheckDatabase(db *sql.DB) (DatabaseCheck, error) {
+	check := DatabaseCheck{Integrity: "skipped", CheckedAt: time.Now().UTC()}
+	if !isPostgres(db) {
+		problems, err := integrityProblems(db)
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB) {
+			// Badly enough damaged pages stop the check itself
+			problems, err = []string{err.Error()}, nil
+		}
+		if err != nil {
+			return check, fmt.Errorf("database integrity check failed: %w", err)
+		}
+		if len(problems) > 0 {
+			return check, fmt.Errorf("database is corrupt, restore it from a backup: %s", strings.Join(problems, "; "))
+		}
+		check.Integrity = "ok"
+	}
+
+	columnQuery := "SELECT name FROM pragma_table_info(?)"
+	if isPostgres(db) {
+		columnQuery = "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1"
+	}
+	for _, e := range expectedColumns {
+		have, err := tableColumns(db, columnQuery, e.table)
+		if err != nil {
+			return check, fmt.Errorf("reading the columns of %s: %w", e.table, err)
+		}
+		if len(have) == 0 {
+			return check, fmt.Errorf("database is incompatible with this server: table %s is missing", e.table)
+		}
+		var missing []string
+		for _, c := range e.columns {
+			if !have[c] {
+				missing = append(missing, c)
+			}
+		}
+		if len(missing) > 0 {
+			return check, fmt.Errorf("database is incompatible with this server: table %s is missing columns %s", e.table, strings.Join(missing, ", "))
+		}
+	}
+	check.Schema = "ok"
+	return check, nil
+}
+
+// integrityProblems runs SQLite's integrity_check, which returns a single "ok" row or up to 100 rows describing what's
+// wrong
+func integrityProblems(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// tableColumns returns the set of column names in a table, which is empty if the table doesn't exist
+func tableColumns(db *sql.DB, query, table string) (map[string]bool, error) {
+	rows, err := db.Query(query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
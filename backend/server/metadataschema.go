@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// MetadataSchema checks memory metadata against a JSON Schema, so every client stores it in the same shape.  Schemas
+// use the OpenAPI 3.0 dialect of JSON Schema, which covers type, properties, required, enum, pattern, minimum and
+// the like, but doesn't resolve $ref.
+type MetadataSchema struct {
+	schema *openapi3.Schema
+}
+
+// LoadMetadataSchema reads the JSON Schema file at path
+func LoadMetadataSchema(path string) (*MetadataSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetadataSchema(data)
+}
+
+// ParseMetadataSchema reads a JSON Schema document, checking the schema itself is valid
+func ParseMetadataSchema(data []byte) (*MetadataSchema, error) {
+	var schema openapi3.Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("schema isn't valid JSON: %w", err)
+	}
+	if err := schema.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return &MetadataSchema{schema: &schema}, nil
+}
+
+// Validate checks metadata (already known to be a JSON object) against the schema.  The error lists every mismatch,
+// each prefixed by the JSON pointer to the offending value.
+func (s *MetadataSchema) Validate(metadata json.RawMessage) error {
+	var value any
+	if err := json.Unmarshal(metadata, &value); err != nil {
+		return err
+	}
+	err := s.schema.VisitJSON(value, openapi3.MultiErrors(), openapi3.SetSchemaErrorMessageCustomizer(schemaErrorMessage))
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("metadata doesn't match the schema: %s", strings.Join(schemaErrorMessages(err), "; "))
+}
+
+// schemaErrorMessage describes a single mismatch without kin-openapi's default dump of the schema
+func schemaErrorMessage(err *openapi3.SchemaError) string {
+	reason := err.Reason
+	if reason == "" {
+		reason = fmt.Sprintf("doesn't match the schema's %q", err.SchemaField)
+	}
+	return "/" + strings.Join(err.JSONPointer(), "/") + ": " + reason
+}
+
+// schemaErrorMessages flattens the nested errors from a validation into one message per mismatch
+func schemaErrorMessages(err error) []string {
+	multi, ok := err.(openapi3.MultiError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var msgs []string
+	for _, e := range multi {
+		msgs = append(msgs, schemaErrorMessages(e)...)
+	}
+	return msgs
+}
@@ -0,0 +1,6 @@
+//go:build postgres
+
+package server
+
+// Registers the pgx driver used for postgres:// DSNs.  Build with -tags postgres to include it.
+import _ "github.com/jackc/pgx/v5/stdlib"
@@ -0,0 +1,17 @@
+-- Postgres schema, the equivalent of the SQLite one, used when MEMORY_SERVER_DSN is a postgres:// URL
+CREATE TABLE IF NOT EXISTS memories (
+    id BIGSERIAL PRIMARY KEY,
+    namespace TEXT NOT NULL DEFAULT 'default', -- separate memory space, memory_ids are unique within one
+    memory_id TEXT NOT NULL,                   -- descriptive title/heading
+    version INTEGER NOT NULL,                  -- version number, increments per memory_id
+    content TEXT NOT NULL,                     -- memory content, always plaintext
+    tags JSONB NOT NULL DEFAULT '[]',          -- array of tags
+    metadata JSONB NOT NULL DEFAULT '{}',      -- object of client supplied metadata
+    archived BOOLEAN NOT NULL DEFAULT FALSE,   -- true if archived, false if active
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_memories_namespace_memory_id_version ON memories(namespace, memory_id, version);
+CREATE INDEX IF NOT EXISTS idx_memories_archived ON memories(archived);
+CREATE INDEX IF NOT EXISTS idx_memories_tags ON memories USING GIN (tags);
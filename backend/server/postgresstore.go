@@ -0,0 +1,512 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-fuego/fuego"
+	"github.com/mattn/go-sqlite3"
+)
+
+// postgresDriver is the database/sql driver used for postgres:// DSNs.  It's registered by pgx's stdlib package,
+// which is only compiled in with the postgres build tag (see postgres_driver.go), so SQLite-only builds don't carry
+// it.
+const postgresDriver = "pgx"
+
+// postgresSchema is the initial Postgres schema, with tags and metadata as jsonb
+//
+//go:embed postgres_schema.sql
+var postgresSchema string
+
+// postgresMigrations are applied in order by migratePostgres, the same way as migrations are for SQLite.  The
+// schema is new, so it starts out complete rather than replaying SQLite's history.  postgres_schema.sql is migration
+// 1 and must stay as released, with later changes added as new migrations.
+var postgresMigrations = []struct {
+	version     int
+	description string
+	sql         string
+}{
+	{1, "initial schema", postgresSchema},
+	{2, "add the pinned column", `ALTER TABLE memories ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT FALSE`},
+}
+
+// isPostgresDSN reports whether a DSN refers to a Postgres database rather than a SQLite file
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// isPostgres reports whether db was opened by OpenDB for a Postgres DSN
+func isPostgres(db *sql.DB) bool {
+	_, sqlite := db.Driver().(*sqlite3.SQLiteDriver)
+	return !sqlite
+}
+
+// postgresRoutes are the routes which work with Postgres.  The rest still run SQLite specific queries, so they
+// answer 501 Not Implemented until they're moved to the Store.
+var postgresRoutes = map[string]bool{
+	"/":                             true,
+	"/openapi.json":                 true,
+	"/docs/":                        true,
+	"/healthz":                      true,
+	"/ping":                         true,
+	"/save-memory":                  true,
+	"/update-memory":                true,
+	"/delete-memory":                true,
+	"/list-memories":                true,
+	"/list-memories-by-tag":         true,
+	"/get-memory-by-id/{memory_id}": true,
+	"/search-memories":              true,
+}
+
+// postgresRoutesOnly answers 501 for the routes which don't support Postgres yet
+func postgresRoutesOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Pattern
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		if !postgresRoutes[route] {
+			sendError(w, r, fuego.HTTPError{Status: http.StatusNotImplemented, Title: "Not Implemented", Detail: r.URL.Path + " isn't supported with a Postgres database yet"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// openPostgres opens a Postgres database.  The connection pool is left to database/sql's defaults, capped by
+// MaxOpenConns.
+func openPostgres(cfg Config) (*sql.DB, error) {
+	if !slices.Contains(sql.Drivers(), postgresDriver) {
+		return nil, fmt.Errorf("this server was built without Postgres support, rebuild it with -tags postgres")
+	}
+	if len(cfg.EncryptionKey) > 0 {
+		return nil, fmt.Errorf("encryption at rest isn't supported with Postgres")
+	}
+	slog.Info("Opening database", "dsn", redactDSN(cfg.DSN), "driver", postgresDriver)
+	db, err := sql.Open(postgresDriver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	return db, nil
+}
+
+// redactDSN hides the password in a postgres:// DSN, so it can be logged
+func redactDSN(dsn string) string {
+	scheme, rest, ok := strings.Cut(dsn, "://")
+	userInfo, host, hasUser := strings.Cut(rest, "@")
+	if !ok || !hasUser {
+		return dsn
+	}
+	if user, _, hasPassword := strings.Cut(userInfo, ":"); hasPassword {
+		return scheme + "://" + user + ":xxxxx@" + host
+	}
+	return dsn
+}
+
+// migratePostgres brings a Postgres database's schema up to date, returning how many migrations it applied
+func migratePostgres(db *sql.DB) (int, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`)
+	if err != nil {
+		return 0, err
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return 0, err
+	}
+	if latest := postgresMigrations[len(postgresMigrations)-1].version; current > latest {
+		return 0, fmt.Errorf("database schema version %d is newer than this server supports (%d)", current, latest)
+	}
+	applied := 0
+	for _, m := range postgresMigrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		_, err = tx.Exec(m.sql)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)`, m.version, m.description, time.Now().UTC())
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		slog.Info("Applied database migration", "version", m.version, "description", m.description)
+		applied++
+	}
+	return applied, nil
+}
+
+// postgresMemoryColumns are the columns scanMemory reads, in order.  Content is never encrypted in Postgres.
+const postgresMemoryColumns = "id, namespace, memory_id, version, content, tags, metadata, archived, pinned, created_at, updated_at"
+
+// postgresStore is the Store for a Postgres database.  Postgres handles concurrent writers itself, so writes don't
+// go through the write queue.
+type postgresStore struct {
+	db          *sql.DB
+	versioning  Versioning
+	maxVersions int
+}
+
+// isPostgresUniqueViolation reports whether err is Postgres rejecting a row which breaks a UNIQUE constraint.  The
+// driver's error type isn't imported, so it's recognised by the SQLSTATE it reports.
+func isPostgresUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds.  Failures to begin or commit are 500s, while fn's
+// errors are returned as they are.
+func (st *postgresStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
+
+// insertNextVersion inserts an active row for the version after the latest one of a memory, keeping the memory's
+// original creation time and whether it's pinned, and returns the stored row
+func (st *postgresStore) insertNextVersion(ctx context.Context, tx *sql.Tx, in MemoryInput) (Memory, error) {
+	tagsJSON, err := json.Marshal(in.Tags)
+	if err != nil {
+		return Memory{}, err
+	}
+	return st.scan(tx.QueryRowContext(ctx, `INSERT INTO memories (namespace, memory_id, version, content, tags, metadata, archived, pinned, created_at, updated_at)
+		SELECT $1, $2, COALESCE(MAX(version), 0) + 1, $3, $4, $5, FALSE, COALESCE((ARRAY_AGG(pinned ORDER BY version DESC))[1], FALSE), COALESCE(MIN(created_at), $6), $6
+		FROM memories WHERE namespace = $1 AND memory_id = $2
+		RETURNING `+postgresMemoryColumns, in.Namespace, in.MemoryID, in.Content, string(tagsJSON), string(in.Metadata), time.Now().UTC()))
+}
+
+// pruneVersions deletes the oldest archived versions of a memory beyond maxVersions, returning how many went
+func (st *postgresStore) pruneVersions(ctx context.Context, tx *sql.Tx, namespace, memoryID string) (int64, error) {
+	if st.maxVersions == 0 {
+		return 0, nil
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM memories WHERE id IN (
+		SELECT id FROM memories WHERE namespace=$1 AND memory_id=$2 AND archived ORDER BY version
+		LIMIT GREATEST(0, (SELECT COUNT(*) FROM memories WHERE namespace=$1 AND memory_id=$2) - $3))`, namespace, memoryID, st.maxVersions)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// scan reads a memory, compacting the metadata as jsonb adds spaces to its output.  jsonb doesn't keep the order of
+// object keys either, so metadata with several keys can come back reordered.
+func (st *postgresStore) scan(r rowScanner) (Memory, error) {
+	m, err := scanMemory(r)
+	if err != nil {
+		return m, err
+	}
+	m.Metadata, err = normalizeMetadata(m.Metadata)
+	return m, err
+}
+
+// queryMemories runs a query selecting postgresMemoryColumns, returning every row
+func (st *postgresStore) queryMemories(ctx context.Context, query string, args ...interface{}) ([]Memory, error) {
+	var memories []Memory
+	err := st.eachMemory(ctx, query, args, func(m Memory) error {
+		memories = append(memories, m)
+		return nil
+	})
+	return memories, err
+}
+
+// eachMemory runs a query selecting postgresMemoryColumns, calling fn with each row
+func (st *postgresStore) eachMemory(ctx context.Context, query string, args []interface{}, fn func(Memory) error) error {
+	rows, err := st.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return dbError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := st.scan(rows)
+		if err != nil {
+			return dbError(err)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
+
+func (st *postgresStore) SaveMemory(ctx context.Context, in MemoryInput, cond SaveCondition) (WriteResult, error) {
+	// Saves racing each other can pick the same version, in which case the loser retries with the one after it
+	res := WriteResult{Changed: true}
+	for attempt := 1; ; attempt++ {
+		err := st.inTx(ctx, func(tx *sql.Tx) error {
+			if cond != SaveAlways {
+				var exists bool
+				if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM memories WHERE namespace=$1 AND memory_id=$2 AND NOT archived)", in.Namespace, in.MemoryID).Scan(&exists); err != nil {
+					return dbError(err)
+				}
+				if cond == SaveIfExists && !exists {
+					return fuego.HTTPError{Status: http.StatusPreconditionFailed, Title: "Precondition Failed", Detail: fmt.Sprintf("memory %q doesn't exist", in.MemoryID)}
+				}
+				if cond == SaveIfAbsent && exists {
+					return fuego.HTTPError{Status: http.StatusPreconditionFailed, Title: "Precondition Failed", Detail: fmt.Sprintf("memory %q already exists", in.MemoryID)}
+				}
+			}
+			var err error
+			res.Memory, err = st.insertNextVersion(ctx, tx, in)
+			if err == nil {
+				res.Pruned, err = st.pruneVersions(ctx, tx, in.Namespace, in.MemoryID)
+			}
+			if err != nil && !isPostgresUniqueViolation(err) {
+				return dbError(err)
+			}
+			return err
+		})
+		if err == nil {
+			return res, nil
+		}
+		if !isPostgresUniqueViolation(err) {
+			return WriteResult{}, err
+		}
+		if attempt == saveAttempts {
+			return WriteResult{}, fuego.ConflictError{Title: "Conflict", Detail: fmt.Sprintf("memory %q is being saved concurrently, please retry", in.MemoryID)}
+		}
+	}
+}
+
+func (st *postgresStore) UpdateMemory(ctx context.Context, in MemoryInput, opts UpdateOptions) (WriteResult, error) {
+	res := WriteResult{Changed: true}
+	err := st.inTx(ctx, func(tx *sql.Tx) error {
+		// The latest row is locked, so concurrent updates of a memory take turns
+		current, err := st.scan(tx.QueryRowContext(ctx, `SELECT `+postgresMemoryColumns+` FROM memories WHERE namespace=$1 AND memory_id=$2 AND NOT archived ORDER BY version DESC LIMIT 1 FOR UPDATE`, in.Namespace, in.MemoryID))
+		if err != nil && err != sql.ErrNoRows {
+			return dbError(err)
+		}
+		if opts.ExpectedVersion != nil && current.Version != *opts.ExpectedVersion {
+			return fuego.ConflictError{Title: "Conflict", Detail: fmt.Sprintf("expected version %d but the current version is %d", *opts.ExpectedVersion, current.Version)}
+		}
+		// An update identical to the latest version would only clutter the history
+		if err == nil && !opts.Force && current.Content == in.Content && sameTags(current.Tags, in.Tags) && bytes.Equal(current.Metadata, in.Metadata) {
+			res.Memory, res.Changed = current, false
+			return nil
+		}
+		if err == nil && st.versioning == VersioningMutable {
+			tagsJSON, err := json.Marshal(in.Tags)
+			if err != nil {
+				return dbError(err)
+			}
+			res.Memory, err = st.scan(tx.QueryRowContext(ctx, `UPDATE memories SET content=$1, tags=$2, metadata=$3, updated_at=$4 WHERE id=$5 RETURNING `+postgresMemoryColumns,
+				in.Content, string(tagsJSON), string(in.Metadata), time.Now().UTC(), current.ID))
+			if err != nil {
+				return dbError(err)
+			}
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE memories SET archived=TRUE WHERE namespace=$1 AND memory_id=$2 AND NOT archived", in.Namespace, in.MemoryID); err != nil {
+			return dbError(err)
+		}
+		if res.Memory, err = st.insertNextVersion(ctx, tx, in); err != nil {
+			return dbError(err)
+		}
+		if res.Pruned, err = st.pruneVersions(ctx, tx, in.Namespace, in.MemoryID); err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (st *postgresStore) DeleteMemory(ctx context.Context, namespace, memoryID string, dryRun bool) (int64, error) {
+	var n int64
+	if dryRun {
+		if err := st.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memories WHERE namespace=$1 AND memory_id=$2 AND NOT archived", namespace, memoryID).Scan(&n); err != nil {
+			return 0, dbError(err)
+		}
+		return n, nil
+	}
+	res, err := st.db.ExecContext(ctx, "UPDATE memories SET archived=TRUE WHERE namespace=$1 AND memory_id=$2 AND NOT archived", namespace, memoryID)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return 0, dbError(err)
+	}
+	return n, nil
+}
+
+// postgresArchivedFilters are the Postgres versions of listArchivedFilters
+var postgresArchivedFilters = map[string]string{
+	"active":   "NOT archived",
+	"archived": "archived",
+	"all":      "version = (SELECT MAX(o.version) FROM memories o WHERE o.namespace = memories.namespace AND o.memory_id = memories.memory_id)",
+}
+
+// listWhere builds the WHERE clause selecting the memories for a ListQuery
+func (st *postgresStore) listWhere(p *placeholders, q ListQuery) string {
+	return "namespace=" + p.next(q.Namespace) + " AND " + postgresArchivedFilters[q.Archived] + p.dateRange(q.Dates)
+}
+
+func (st *postgresStore) ListMemories(ctx context.Context, q ListQuery, fn func(Memory) error) error {
+	var p placeholders
+	query := `SELECT ` + postgresMemoryColumns + ` FROM memories WHERE ` + st.listWhere(&p, q) + ` ORDER BY ` + listOrderBy(q)
+	if q.Limit > 0 {
+		query += " LIMIT " + p.next(q.Limit) + " OFFSET " + p.next(q.Offset)
+	}
+	return st.eachMemory(ctx, query, p.args, fn)
+}
+
+func (st *postgresStore) CountMemories(ctx context.Context, q ListQuery) (int, error) {
+	var p placeholders
+	var n int
+	if err := st.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memories WHERE "+st.listWhere(&p, q), p.args...).Scan(&n); err != nil {
+		return 0, dbError(err)
+	}
+	return n, nil
+}
+
+func (st *postgresStore) GetByID(ctx context.Context, namespace, memoryID string) (Memory, error) {
+	m, err := st.scan(st.db.QueryRowContext(ctx, `SELECT `+postgresMemoryColumns+` FROM memories WHERE namespace=$1 AND memory_id=$2 AND NOT archived ORDER BY version DESC LIMIT 1`, namespace, memoryID))
+	if err == sql.ErrNoRows {
+		return Memory{}, fuego.NotFoundError{Title: "Not Found", Detail: "not found"}
+	}
+	if err != nil {
+		return Memory{}, dbError(err)
+	}
+	return m, nil
+}
+
+func (st *postgresStore) Search(ctx context.Context, q SearchQuery) ([]Memory, int, error) {
+	var p placeholders
+	where := "NOT archived AND namespace=" + p.next(q.Namespace) + p.dateRange(q.Dates)
+	for _, tag := range q.Tags {
+		where += " AND tags ? " + p.next(tag)
+	}
+	if q.Fuzzy {
+		// As with SQLite, candidates are scored in Go rather than with an extension such as fuzzystrmatch
+		candidates, err := st.queryMemories(ctx, `SELECT `+postgresMemoryColumns+` FROM memories WHERE `+where+` ORDER BY memory_id, version DESC`, p.args...)
+		if err != nil {
+			return nil, 0, err
+		}
+		type scored struct {
+			m        Memory
+			distance int
+		}
+		var matches []scored
+		for _, m := range candidates {
+			if d, ok := fuzzyMatch(q.searchQuery, m, q.MaxDistance); ok {
+				matches = append(matches, scored{m, d})
+			}
+		}
+		sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+		var memories []Memory
+		for i := q.Offset; i < len(matches) && i < q.Offset+q.Limit; i++ {
+			memories = append(memories, matches[i].m)
+		}
+		return memories, len(matches), nil
+	}
+
+	// Bare text is always applied when there's nothing else, so an empty query still validates the mode
+	if q.Text != "" || (len(q.Content) == 0 && len(q.Tags) == 0) {
+		pred, err := p.textMatch(q.Mode, q.Text, "memory_id", "content")
+		if err != nil {
+			return nil, 0, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		where += " AND " + pred
+	}
+	for _, term := range q.Content {
+		pred, err := p.textMatch(q.Mode, term, "content")
+		if err != nil {
+			return nil, 0, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		where += " AND " + pred
+	}
+	var total int
+	if err := st.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memories WHERE "+where, p.args...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+	page := `SELECT ` + postgresMemoryColumns + ` FROM memories WHERE ` + where + ` ORDER BY memory_id, version DESC LIMIT ` + p.next(q.Limit) + ` OFFSET ` + p.next(q.Offset)
+	memories, err := st.queryMemories(ctx, page, p.args...)
+	return memories, total, err
+}
+
+func (st *postgresStore) ListByTag(ctx context.Context, namespace, tag string, caseInsensitive bool) ([]Memory, error) {
+	match := "tags ? $2"
+	if caseInsensitive {
+		match = "EXISTS (SELECT 1 FROM jsonb_array_elements_text(tags) AS t(value) WHERE LOWER(t.value) = LOWER($2))"
+	}
+	return st.queryMemories(ctx, `SELECT `+postgresMemoryColumns+` FROM memories WHERE namespace=$1 AND NOT archived AND `+match+`
+		ORDER BY memory_id, version DESC`, namespace, tag)
+}
+
+// placeholders numbers the $n parameters of a Postgres query as its WHERE clause is built up
+type placeholders struct {
+	args []interface{}
+}
+
+// next adds an argument, returning its placeholder
+func (p *placeholders) next(arg interface{}) string {
+	p.args = append(p.args, arg)
+	return fmt.Sprintf("$%d", len(p.args))
+}
+
+// dateRange builds the " AND ..." predicates for the bounds of r which are set
+func (p *placeholders) dateRange(r DateRange) string {
+	var where string
+	for _, d := range dateRangeParams {
+		if t := *d.field(&r); !t.IsZero() {
+			where += " AND " + strings.Replace(d.predicate, "?", p.next(t.UTC()), 1)
+		}
+	}
+	return where
+}
+
+// textMatch is the Postgres version of the SQLite textMatch, matching term against any of the columns
+func (p *placeholders) textMatch(mode, term string, columns ...string) (string, error) {
+	var op, arg string
+	switch mode {
+	case "", "substring":
+		op, arg = "ILIKE", "%"+likeEscaper.Replace(term)+"%"
+	case "word":
+		// Postgres regular expressions mark word boundaries with \m and \M rather than \b
+		op, arg = "~*", `\m`+regexp.QuoteMeta(term)+`\M`
+	case "exact":
+		op, arg = "=", term
+	default:
+		return "", fmt.Errorf("mode must be one of 'substring', 'word' or 'exact'")
+	}
+	placeholder := p.next(arg)
+	preds := make([]string, len(columns))
+	for i, col := range columns {
+		preds[i] = col + " " + op + " " + placeholder
+	}
+	return "(" + strings.Join(preds, " OR ") + ")", nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Seed imports the memories in the configured seed file (NDJSON, one SaveMemoryInput per line), but only into an
+// empty database, so restarting a provisioned server doesn't import them again.  It returns how many memories were
+// saved, which is 0 when there's no seed file or the database already has memories.
+//
+// Every record is validated before any is saved, so a bad seed file fails without leaving a partly seeded database
+// which would then be skipped on the next start.
+func (srv *Server) Seed(ctx context.Context) (int, error) {
+	if srv.cfg.SeedFile == "" {
+		return 0, nil
+	}
+	var exists bool
+	if err := srv.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM memories)").Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists {
+		slog.Info("Database already has memories, not seeding", "seed_file", srv.cfg.SeedFile)
+		return 0, nil
+	}
+
+	f, err := os.Open(srv.cfg.SeedFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var inputs []MemoryInput
+	dec := json.NewDecoder(f)
+	for record := 1; ; record++ {
+		var in SaveMemoryInput
+		if err := dec.Decode(&in); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("%s record %d: %w", srv.cfg.SeedFile, record, err)
+		}
+		if in.Namespace, err = resolveNamespace(in.Namespace); err == nil {
+			in.Content = srv.normalizeContent(in.Content)
+			if in.Tags, err = srv.validateMemoryInput(in.MemoryID, in.Content, in.Tags); err == nil {
+				in.Metadata, err = srv.validateMetadata(in.Metadata)
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s record %d: %w", srv.cfg.SeedFile, record, err)
+		}
+		inputs = append(inputs, MemoryInput{in.Namespace, in.MemoryID, in.Content, in.Tags, in.Metadata})
+	}
+
+	for _, in := range inputs {
+		if _, err := srv.store.SaveMemory(ctx, in, SaveAlways); err != nil {
+			return 0, fmt.Errorf("saving %q: %w", in.MemoryID, err)
+		}
+	}
+	slog.Info("Seeded the database", "seed_file", srv.cfg.SeedFile, "memories", len(inputs))
+	return len(inputs), nil
+}
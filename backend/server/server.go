@@ -0,0 +1,4168 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-fuego/fuego"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/text/unicode/norm"
+)
+
+type Memory struct {
+	ID        int      `json:"id"`
+	Namespace string   `json:"namespace"`
+	MemoryID  string   `json:"memory_id"`
+	Version   int      `json:"version"`
+	Content   string   `json:"content"`
+	Tags      []string `json:"tags"`
+	// Metadata is an arbitrary JSON object supplied by the client, "{}" when none was given
+	Metadata  json.RawMessage `json:"metadata"`
+	Archived  bool            `json:"archived"`
+	Pinned    bool            `json:"pinned"` // Listed first by /list-memories
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	// Snippet is only set by /search-memories?highlight=true, with the matching part of the content marked
+	Snippet string `json:"snippet,omitempty"`
+	// Truncated and ContentLength are only set when a list or search is asked to truncate content.  ContentLength
+	// is the full content's length in bytes.
+	Truncated     bool `json:"truncated,omitempty"`
+	ContentLength int  `json:"content_length,omitempty"`
+}
+
+type SaveMemoryInput struct {
+	// Namespace keeps separate sets of memories apart, so the same memory_id can be used in each.  Defaults to
+	// "default" when omitted, as it does on every other endpoint.
+	Namespace string `json:"namespace,omitempty"`
+	// MemoryID may be left out of /save-memory, which then generates a ULID for it
+	MemoryID string          `json:"memory_id,omitempty"`
+	Content  string          `json:"content"`
+	Tags     []string        `json:"tags"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+type UpdateMemoryInput struct {
+	Namespace string          `json:"namespace,omitempty"`
+	MemoryID  string          `json:"memory_id"`
+	Content   string          `json:"content"`
+	Tags      []string        `json:"tags"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+	// Optional compare-and-swap guard.  When set, the update fails with 409 unless the latest active version
+	// matches.  When omitted, the update always wins (last writer wins).
+	ExpectedVersion *int `json:"expected_version,omitempty"`
+	// Force writes a new version even when nothing differs from the latest one
+	Force bool `json:"force,omitempty"`
+}
+
+type DeleteMemoryInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+	DryRun    bool   `json:"dry_run,omitempty"` // Only count the active rows which would be archived
+}
+
+// PinMemoryInput is the body of /pin-memory and /unpin-memory
+type PinMemoryInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+}
+
+// UndoMemoryInput is the body of /undo-memory
+type UndoMemoryInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+}
+
+// DeleteByTagInput is the body of /delete-by-tag
+type DeleteByTagInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	Tag       string `json:"tag"`
+	DryRun    bool   `json:"dry_run,omitempty"` // Only list the memories which would be archived
+}
+
+// DeleteByTagResponse lists the memories archived (or with dry_run, which would be) by /delete-by-tag
+type DeleteByTagResponse struct {
+	Status    string   `json:"status"`
+	Namespace string   `json:"namespace"`
+	Tag       string   `json:"tag"`
+	MemoryIDs []string `json:"memory_ids"`
+	Count     int      `json:"count"`
+}
+
+type DeleteVersionInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+	Version   int    `json:"version"`
+}
+
+type PurgeArchivedInput struct {
+	// Only purge archived rows last written more than this many days ago.  When omitted, every archived row is purged.
+	OlderThanDays *int `json:"older_than_days,omitempty"`
+	Vacuum        bool `json:"vacuum"`
+}
+
+type CompactMemoryInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+	KeepLast  int    `json:"keep_last"`
+	// Permanently delete the older versions, rather than just archiving them
+	HardDelete bool `json:"hard_delete"`
+}
+
+type CompactResponse struct {
+	Status    string `json:"status"`
+	Namespace string `json:"namespace"`
+	MemoryID  string `json:"memory_id"`
+	Removed   int64  `json:"removed"`
+}
+
+type PurgeResponse struct {
+	Status   string `json:"status"`
+	Purged   int64  `json:"purged"`
+	Vacuumed bool   `json:"vacuumed"`
+}
+
+// SavedMemoryResponse is the stored record returned by /save-memory and /update-memory, alongside the status
+type SavedMemoryResponse struct {
+	Status string `json:"status"`
+	Memory
+	// Pruned is how many old archived versions were deleted to keep within MEMORY_SERVER_MAX_VERSIONS
+	Pruned int64 `json:"pruned,omitempty"`
+}
+
+type GetMemoriesInput struct {
+	Namespace string   `json:"namespace,omitempty"`
+	MemoryIDs []string `json:"memory_ids"`
+}
+
+type TagInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+	Tag       string `json:"tag"`
+}
+
+// TextInput is the body of /append-memory and /prepend-memory
+type TextInput struct {
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+	Text      string `json:"text"`
+}
+
+type RenameMemoryInput struct {
+	Namespace   string `json:"namespace,omitempty"`
+	OldMemoryID string `json:"old_memory_id"`
+	NewMemoryID string `json:"new_memory_id"`
+}
+
+type StatusResponse struct {
+	Status    string `json:"status"`
+	Namespace string `json:"namespace,omitempty"`
+	MemoryID  string `json:"memory_id"`
+	Version   int    `json:"version,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// WouldArchive is only set by a /delete-memory dry run
+	WouldArchive *int64 `json:"would_archive,omitempty"`
+	// Pruned is how many old archived versions a /bulk-save item deleted to keep within MEMORY_SERVER_MAX_VERSIONS
+	Pruned int64 `json:"pruned,omitempty"`
+}
+
+type SearchResponse struct {
+	Total    int      `json:"total"`
+	Limit    int      `json:"limit"`
+	Offset   int      `json:"offset"`
+	Memories []Memory `json:"memories"`
+}
+
+// ExportDocument is the layout produced by /export and accepted by /import
+type ExportDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	ExportedAt    time.Time `json:"exported_at"`
+	Memories      []Memory  `json:"memories"`
+}
+
+type ImportResponse struct {
+	Status   string `json:"status"`
+	Mode     string `json:"mode"`
+	Imported int    `json:"imported"`
+	Skipped  int    `json:"skipped"`
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// TagReportEntry is one row of /tag-report
+type TagReportEntry struct {
+	Tag         string `json:"tag"`
+	MemoryCount int    `json:"memory_count"`
+}
+
+// RelatedMemory is a memory returned by /related, with how many tags it shares with the one asked about
+type RelatedMemory struct {
+	Memory
+	SharedTags int `json:"shared_tags"`
+}
+
+// RecentMemory is a memory returned by /recent, with when /get-memory-by-id last read it
+type RecentMemory struct {
+	Memory
+	LastAccessedAt time.Time `json:"last_accessed_at"`
+}
+
+// MemoryIDEntry summarises a memory without its content, for listing many memories cheaply
+type MemoryIDEntry struct {
+	MemoryID      string    `json:"memory_id"`
+	LatestVersion int       `json:"latest_version"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	TagCount      int       `json:"tag_count"`
+}
+
+type PingResponse struct {
+	Pong          bool   `json:"pong"`
+	Version       string `json:"version"`
+	GoVersion     string `json:"go_version"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+type HealthResponse struct {
+	Status   string         `json:"status"`
+	Database *DatabaseCheck `json:"database,omitempty"` // The startup checks, when they were run
+}
+
+type StatsResponse struct {
+	ActiveMemories    int `json:"active_memories"`
+	ArchivedRows      int `json:"archived_rows"`
+	DistinctMemoryIDs int `json:"distinct_memory_ids"`
+	DistinctTags      int `json:"distinct_tags"`
+	TotalRows         int `json:"total_rows"`
+	// WriteQueueDepth is how many write transactions are waiting for, or held by, the single database writer
+	WriteQueueDepth int `json:"write_queue_depth"`
+}
+
+// MemoryStatsResponse is the storage footprint of one memory across all its versions, archived or not.  Sizes are
+// in bytes as stored, so encrypted content counts its ciphertext.
+type MemoryStatsResponse struct {
+	Namespace      string    `json:"namespace"`
+	MemoryID       string    `json:"memory_id"`
+	Versions       int       `json:"versions"`
+	TotalBytes     int64     `json:"total_bytes"`
+	LargestBytes   int64     `json:"largest_bytes"`
+	FirstCreatedAt time.Time `json:"first_created_at"`
+	LastUpdatedAt  time.Time `json:"last_updated_at"`
+}
+
+// ChangesResponse is the result of /changes.  ServerTime is the since value for the next call.
+type ChangesResponse struct {
+	ServerTime time.Time `json:"server_time"`
+	Memories   []Memory  `json:"memories"`
+}
+
+// MaintenanceResponse reports the database size in bytes before and after /maintenance
+type MaintenanceResponse struct {
+	Status     string `json:"status"`
+	SizeBefore int64  `json:"size_before"`
+	SizeAfter  int64  `json:"size_after"`
+}
+
+// BackupInput is the body of /backup
+type BackupInput struct {
+	// Path is where to write the backup.  With MEMORY_SERVER_BACKUP_DIR set it can only be a file name in that
+	// directory, and defaults to one named after the current time.
+	Path string `json:"path,omitempty"`
+}
+
+// BackupResponse describes the snapshot written by /backup
+type BackupResponse struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// DiffResponse is the change between two versions of a memory, as returned by /diff
+type DiffResponse struct {
+	Namespace   string   `json:"namespace"`
+	MemoryID    string   `json:"memory_id"`
+	From        int      `json:"from"`
+	To          int      `json:"to"`
+	Diff        string   `json:"diff"`
+	TagsAdded   []string `json:"tags_added"`
+	TagsRemoved []string `json:"tags_removed"`
+}
+
+// Default and maximum page sizes for paginated endpoints
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// defaultRelatedLimit is how many memories /related returns when no limit is given
+const defaultRelatedLimit = 10
+
+// defaultRecentLimit is how many memories /recent returns when no limit is given
+const defaultRecentLimit = 20
+
+// defaultAutocompleteLimit is how many memory_ids /autocomplete suggests when no limit is given
+const defaultAutocompleteLimit = 10
+
+// saveAttempts is how many times /save-memory tries for a free version before answering 409 Conflict
+const saveAttempts = 3
+
+// memoryColumns is the column list expected by scanMemory, in order.  Content is decrypted by open_content when
+// it's stored encrypted.
+const memoryColumns = "id, namespace, memory_id, version, open_content(content, nonce), tags, metadata, archived, pinned, created_at, updated_at"
+
+// insertMemory adds a row, taking namespace, memory_id, version, content, tags, metadata, archived, pinned,
+// created_at and updated_at.  The content is encrypted when a key is set, using a nonce made once for the row.
+const insertMemory = `WITH n AS MATERIALIZED (SELECT content_nonce() AS nonce)
+	INSERT INTO memories (namespace, memory_id, version, content, nonce, tags, metadata, archived, pinned, created_at, updated_at)
+	SELECT ?, ?, ?, seal_content(?, n.nonce), n.nonce, ?, ?, ?, ?, ?, ? FROM n`
+
+// insertNextMemory stores the next version of a memory, numbered one past its latest version (archived or not).  New
+// versions keep the memory's original creation time and whether it's pinned, updated_at records when this version
+// was written.  The parameters are namespace, memory_id, content, tags, metadata and the current time.
+const insertNextMemory = `WITH n AS MATERIALIZED (SELECT content_nonce() AS nonce),
+	latest AS (SELECT COALESCE(MAX(version), 0) + 1 AS version,
+		(SELECT created_at FROM memories WHERE namespace = ?1 AND memory_id = ?2 ORDER BY created_at ASC LIMIT 1) AS created_at,
+		(SELECT pinned FROM memories WHERE namespace = ?1 AND memory_id = ?2 ORDER BY version DESC LIMIT 1) AS pinned
+		FROM memories WHERE namespace = ?1 AND memory_id = ?2)
+	INSERT INTO memories (namespace, memory_id, version, content, nonce, tags, metadata, archived, pinned, created_at, updated_at)
+	SELECT ?1, ?2, latest.version, seal_content(?3, n.nonce), n.nonce, ?4, ?5, 0, COALESCE(latest.pinned, 0), COALESCE(latest.created_at, ?6), ?6 FROM n, latest`
+
+// returningSupported reports whether the linked SQLite (3.35 onwards) understands INSERT ... RETURNING.  It only
+// matters when building against a system SQLite with the libsqlite3 tag, as the bundled one is always new enough.
+var returningSupported = func() bool {
+	_, version, _ := sqlite3.Version()
+	return version >= 3035000
+}()
+
+// embeddedIndexHTML is the web interface served at /, compiled into the binary so it works from any directory
+//
+//go:embed index.html
+var embeddedIndexHTML string
+
+// swaggerUIFiles is Swagger UI 5.18.2 (Apache 2.0 licensed), served at /docs.  Its distribution files are committed
+// rather than loaded from a CDN so the docs work offline.  To upgrade, change the version here and run
+// "go generate ./backend/server".
+//
+//go:generate sh -c "curl -fsSL -o swaggerui/swagger-ui-bundle.js https://unpkg.com/swagger-ui-dist@5.18.2/swagger-ui-bundle.js && curl -fsSL -o swaggerui/swagger-ui.css https://unpkg.com/swagger-ui-dist@5.18.2/swagger-ui.css"
+//go:embed swaggerui
+var swaggerUIFiles embed.FS
+
+// newSQLiteDriver returns a go-sqlite3 driver whose connections have our custom SQL functions
+func newSQLiteDriver(c *contentCipher) *sqlite3.SQLiteDriver {
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// SQLite parses "X REGEXP Y" but has no built in implementation of it
+			if err := conn.RegisterFunc("regexp", sqlRegexp, true); err != nil {
+				return err
+			}
+			return c.register(conn)
+		},
+	}
+}
+
+// regexpCache holds compiled REGEXP patterns, as SQLite calls the function once per row
+var regexpCache = struct {
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}{patterns: make(map[string]*regexp.Regexp)}
+
+// sqlRegexp implements the SQLite REGEXP operator using Go's regexp syntax
+func sqlRegexp(pattern, value string) (bool, error) {
+	regexpCache.Lock()
+	re, ok := regexpCache.patterns[pattern]
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			regexpCache.Unlock()
+			return false, err
+		}
+		// Keep the cache from growing forever with one-off search terms
+		if len(regexpCache.patterns) >= 100 {
+			regexpCache.patterns = make(map[string]*regexp.Regexp)
+		}
+		regexpCache.patterns[pattern] = re
+	}
+	regexpCache.Unlock()
+	return re.MatchString(value), nil
+}
+
+// memoryIDPattern is the allowed format for memory_id values
+var memoryIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// queryContext derives the context for a request's database calls.  It's cancelled when the client disconnects
+// or the configured QueryTimeout passes, whichever comes first.
+func (srv *Server) queryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, srv.cfg.QueryTimeout)
+}
+
+// Version is the server's release, reported by /ping.  Release builds set it with
+// -ldflags "-X justinclift/windsurf_memory_server_v2/backend/server.Version=v1.2.3".
+var Version = "dev"
+
+// exportSchemaVersion is written into /export documents, and bumped whenever the exported layout changes
+const exportSchemaVersion = 1
+
+// Server is the memory server's HTTP API, serving from a database which has already been migrated
+type Server struct {
+	cfg          Config
+	db           *sql.DB
+	fuego        *fuego.Server
+	events       *eventBroker
+	writes       *writeQueue
+	store        Store
+	dbCheck      *DatabaseCheck
+	access       *accessTracker // Nil unless TrackAccess is set
+	startedAt    time.Time
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	draining     atomic.Bool // Set by Close, after which new requests get a 503
+}
+
+// NewServer creates the server and registers every route
+func NewServer(cfg Config, db *sql.DB) *Server {
+	srv := &Server{
+		cfg:       cfg,
+		db:        db,
+		events:    &eventBroker{subs: make(map[chan MemoryEvent]struct{}), done: make(chan struct{})},
+		writes:    newWriteQueue(db),
+		shutdown:  make(chan struct{}),
+		startedAt: time.Now(),
+	}
+	srv.store = &sqliteStore{db: db, writes: srv.writes, versioning: cfg.Versioning, maxVersions: cfg.MaxVersions}
+	if isPostgres(db) {
+		srv.store = &postgresStore{db: db, versioning: cfg.Versioning, maxVersions: cfg.MaxVersions}
+	}
+	// Access tracking writes SQLite specific queries, so isn't available with Postgres yet
+	if cfg.TrackAccess && !isPostgres(db) {
+		srv.access = newAccessTracker(srv.writes, cfg.QueryTimeout)
+	}
+
+	// Fuego's built in request logging is replaced by our own requestLogger middleware.  The OpenAPI spec is
+	// served from /openapi.json, so fuego doesn't need to write it to disk.  Errors are converted to APIError
+	// rather than fuego's problem details, and documented as such.
+	s := fuego.NewServer(
+		fuego.WithLoggingMiddleware(fuego.LoggingConfig{DisableRequest: true, DisableResponse: true}),
+		fuego.WithEngineOptions(
+			fuego.WithOpenAPIConfig(fuego.OpenAPIConfig{DisableLocalSave: true}),
+			fuego.WithErrorHandler(toAPIError),
+		),
+		fuego.WithRouteOptions(
+			fuego.OptionAddResponse(http.StatusBadRequest, "Bad Request", fuego.Response{Type: APIError{}, ContentTypes: []string{"application/json"}}),
+			fuego.OptionAddResponse(http.StatusInternalServerError, "Internal Server Error", fuego.Response{Type: APIError{}, ContentTypes: []string{"application/json"}}),
+		),
+		fuego.WithErrorSerializer(sendError),
+		fuego.WithSerializer(sendResponse),
+	)
+	s.OpenAPI.Description().Info.Title = "Windsurf Memory Server API"
+	s.OpenAPI.Description().Info.Description = "API for storing and managing versioned memories."
+	s.OpenAPI.Description().Info.Version = "1.0"
+	fuego.Use(s, assignRequestID, requestLogger, requestMetrics, srv.rejectWhileDraining, compressResponse)
+	if cfg.LogBodies {
+		fuego.Use(s, logBodies)
+	}
+	if cfg.RateLimit > 0 {
+		fuego.Use(s, limitWrites(newRateLimiter(cfg.RateLimit), cfg.APIKey))
+	}
+	if cfg.APIKey != "" {
+		fuego.Use(s, requireAPIKey(cfg.APIKey))
+	}
+	if isPostgres(db) {
+		fuego.Use(s, postgresRoutesOnly)
+	}
+	fuego.Use(s, requireJSONBody)
+	slog.Debug("Fuego server created")
+
+	// Serve the VueJS interface at the root.  MEMORY_SERVER_INDEX_HTML points at an alternative page, which is
+	// re-read on each request so it can be edited without a restart.  Otherwise the embedded copy is used.
+	indexPath := cfg.IndexHTMLPath
+	fuego.Get(s, "/", func(c fuego.ContextNoBody) (fuego.HTML, error) {
+		if indexPath != "" {
+			data, err := os.ReadFile(indexPath)
+			if err == nil {
+				return fuego.HTML(string(data)), nil
+			}
+			slog.WarnContext(c.Context(), "Could not read MEMORY_SERVER_INDEX_HTML, serving the embedded index.html", "path", indexPath, "error", err)
+		}
+		return fuego.HTML(embeddedIndexHTML), nil
+	})
+
+	// The API and other routes remain unchanged
+
+	// Prometheus metrics.  Deliberately unauthenticated, so scrapers don't need credentials.
+	fuego.GetStd(s, "/metrics", promhttp.Handler().ServeHTTP, fuego.OptionHide())
+
+	// OpenAPI spec, generated by fuego from the registered routes.  It's read at request time, so routes
+	// registered after this one are still included.
+	fuego.Get(s, "/openapi.json", s.Engine.SpecHandler(), fuego.OptionHide())
+
+	// Interactive API docs, using the spec above.  The mux redirects /docs to /docs/, so relative asset URLs resolve.
+	swaggerUI, err := fs.Sub(swaggerUIFiles, "swaggerui")
+	if err != nil {
+		panic(err)
+	}
+	fuego.GetStd(s, "/docs/", http.StripPrefix("/docs/", http.FileServerFS(swaggerUI)).ServeHTTP, fuego.OptionHide())
+
+	// Save memory
+	fuego.Post(s, "/save-memory", func(c fuego.ContextWithBody[SaveMemoryInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		// The fingerprint is taken before the server fills anything in, so a retry matches the original request
+		idempotencyKey, fingerprint := c.Header(idempotencyKeyHeader), ""
+		if idempotencyKey != "" {
+			if fingerprint, err = saveFingerprint(body); err != nil {
+				return nil, err
+			}
+		}
+		// Clients which don't need to pick a memory_id can leave it to the server
+		if body.MemoryID == "" {
+			body.MemoryID = newULID(time.Now())
+		}
+		body.Content = srv.normalizeContent(body.Content)
+		body.Tags, err = srv.validateMemoryInput(body.MemoryID, body.Content, body.Tags)
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		body.Metadata, err = srv.validateMetadata(body.Metadata)
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		// If-Match: * only saves over an existing memory, If-None-Match: * only creates a new one
+		cond := SaveAlways
+		for _, h := range []struct {
+			name string
+			cond SaveCondition
+		}{{"If-Match", SaveIfExists}, {"If-None-Match", SaveIfAbsent}} {
+			switch c.Header(h.name) {
+			case "":
+			case "*":
+				cond = h.cond
+			default:
+				return nil, fuego.BadRequestError{Title: "Bad Request", Detail: h.name + " only supports *"}
+			}
+		}
+		// A retry with the Idempotency-Key of a finished save gets the same answer instead of saving again
+		if idempotencyKey != "" {
+			prior, err := srv.claimIdempotencyKey(ctx, idempotencyKey, fingerprint)
+			if err != nil {
+				return nil, err
+			}
+			if prior != nil {
+				c.SetHeader("Idempotent-Replayed", "true")
+				return srv.replaySave(ctx, prior)
+			}
+		}
+		res, err := srv.store.SaveMemory(ctx, MemoryInput{body.Namespace, body.MemoryID, body.Content, body.Tags, body.Metadata}, cond)
+		if idempotencyKey != "" {
+			if err != nil {
+				srv.releaseIdempotencyKey(ctx, idempotencyKey)
+			} else if err := srv.finishIdempotencyKey(ctx, idempotencyKey, res); err != nil {
+				slog.WarnContext(ctx, "Could not record the save for its idempotency key", "error", err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := res.Memory
+		memoryWrites.WithLabelValues("save").Inc()
+		srv.events.Publish(MemoryEvent{Type: "saved", Namespace: m.Namespace, MemoryID: m.MemoryID, Version: m.Version})
+		return &SavedMemoryResponse{Status: "saved", Memory: m, Pruned: res.Pruned}, nil
+	},
+		fuego.OptionHeader("If-Match", "Send * to only save if the memory already has an active version, otherwise 412"),
+		fuego.OptionHeader("If-None-Match", "Send * to only save if the memory has no active version, otherwise 412"),
+		fuego.OptionHeader(idempotencyKeyHeader, "Unique key for this save.  Retries with the same key get the first save's response rather than saving again"),
+	)
+
+	// Update memory
+	fuego.Post(s, "/update-memory", func(c fuego.ContextWithBody[UpdateMemoryInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		body.Content = srv.normalizeContent(body.Content)
+		body.Tags, err = srv.validateMemoryInput(body.MemoryID, body.Content, body.Tags)
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		body.Metadata, err = srv.validateMetadata(body.Metadata)
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		res, err := srv.store.UpdateMemory(ctx, MemoryInput{body.Namespace, body.MemoryID, body.Content, body.Tags, body.Metadata}, UpdateOptions{ExpectedVersion: body.ExpectedVersion, Force: body.Force})
+		if err != nil {
+			return nil, err
+		}
+		m := res.Memory
+		if !res.Changed {
+			return &SavedMemoryResponse{Status: "unchanged", Memory: m}, nil
+		}
+		memoryWrites.WithLabelValues("update").Inc()
+		srv.events.Publish(MemoryEvent{Type: "updated", Namespace: m.Namespace, MemoryID: m.MemoryID, Version: m.Version})
+		return &SavedMemoryResponse{Status: "updated", Memory: m, Pruned: res.Pruned}, nil
+	})
+
+	// Add a tag to the latest version of a memory, writing a new version with the same content
+	fuego.Post(s, "/add-tag", func(c fuego.ContextWithBody[TagInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		// Only tags being added are checked, so existing tags with commas can still be removed
+		if tag, err := srv.normalizeTag(body.Tag); err == nil {
+			if err := checkTagCharacters(tag); err != nil {
+				return nil, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("tag %q %s", body.Tag, err.Error())}
+			}
+		}
+		return srv.retagMemory(ctx, body, func(tags []string, tag string) []string {
+			for _, t := range tags {
+				if t == tag {
+					return nil
+				}
+			}
+			return append(tags, tag)
+		})
+	})
+
+	// Remove a tag from the latest version of a memory, writing a new version with the same content
+	fuego.Post(s, "/remove-tag", func(c fuego.ContextWithBody[TagInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		return srv.retagMemory(ctx, body, func(tags []string, tag string) []string {
+			kept := make([]string, 0, len(tags))
+			for _, t := range tags {
+				if t != tag {
+					kept = append(kept, t)
+				}
+			}
+			if len(kept) == len(tags) {
+				return nil
+			}
+			return kept
+		})
+	})
+
+	// Pin a memory, so /list-memories shows it first.  Pinning doesn't write a new version.
+	fuego.Post(s, "/pin-memory", func(c fuego.ContextWithBody[PinMemoryInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		return srv.setPinned(ctx, body, true)
+	})
+
+	// Unpin a memory, returning it to its usual place in /list-memories
+	fuego.Post(s, "/unpin-memory", func(c fuego.ContextWithBody[PinMemoryInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		return srv.setPinned(ctx, body, false)
+	})
+
+	// Add text to the end of the latest version of a memory, writing a new version with the same tags
+	fuego.Post(s, "/append-memory", func(c fuego.ContextWithBody[TextInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		return srv.editContent(ctx, body, func(content, text string) string { return content + text })
+	})
+
+	// Add text to the start of the latest version of a memory, writing a new version with the same tags
+	fuego.Post(s, "/prepend-memory", func(c fuego.ContextWithBody[TextInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		return srv.editContent(ctx, body, func(content, text string) string { return text + content })
+	})
+
+	// Revert a memory to the version before its latest one, archiving the latest and making the previous one active
+	// again
+	fuego.Post(s, "/undo-memory", func(c fuego.ContextWithBody[UndoMemoryInput]) (*SavedMemoryResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if err := validateMemoryID("memory_id", body.MemoryID); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		var m Memory
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			current, err := scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND archived=0 ORDER BY version DESC LIMIT 1`, body.Namespace, body.MemoryID))
+			if err == sql.ErrNoRows {
+				return fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", body.MemoryID)}
+			}
+			if err != nil {
+				return dbError(err)
+			}
+			// Earlier versions are normally archived, having been replaced by an update
+			previous, err := scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND version<? ORDER BY version DESC LIMIT 1`, body.Namespace, body.MemoryID, current.Version))
+			if err == sql.ErrNoRows {
+				return withCode(CodeVersionNotFound, fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q has no version before %d to revert to", body.MemoryID, current.Version)})
+			}
+			if err != nil {
+				return dbError(err)
+			}
+			// Archives the current version and restores the previous one
+			if _, err := tx.ExecContext(ctx, "UPDATE memories SET archived = (id = ?) WHERE id IN (?, ?)", current.ID, current.ID, previous.ID); err != nil {
+				return dbError(err)
+			}
+			previous.Archived = false
+			m = previous
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		memoryWrites.WithLabelValues("update").Inc()
+		srv.events.Publish(MemoryEvent{Type: "updated", Namespace: m.Namespace, MemoryID: m.MemoryID, Version: m.Version})
+		return &SavedMemoryResponse{Status: "reverted", Memory: m}, nil
+	})
+
+	// Bulk save memories in a single transaction.  With ?atomic=true any invalid item rolls back the whole batch,
+	// otherwise invalid items are reported as failed and the rest are saved.
+	fuego.Post(s, "/bulk-save", func(c fuego.ContextWithBody[[]SaveMemoryInput]) ([]StatusResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		atomicBatch, err := queryBool(c.QueryParam, "atomic")
+		if err != nil {
+			return nil, err
+		}
+		results := make([]StatusResponse, 0, len(body))
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			for i, item := range body {
+				var err error
+				item.Namespace, err = resolveNamespace(item.Namespace)
+				if err == nil {
+					item.Content = srv.normalizeContent(item.Content)
+					item.Tags, err = srv.validateMemoryInput(item.MemoryID, item.Content, item.Tags)
+				}
+				if err == nil {
+					item.Metadata, err = srv.validateMetadata(item.Metadata)
+				}
+				if err != nil {
+					if atomicBatch {
+						return fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("item %d: %s", i, err.Error())}
+					}
+					results = append(results, StatusResponse{Status: "failed", Namespace: item.Namespace, MemoryID: item.MemoryID, Error: err.Error()})
+					continue
+				}
+				m, err := insertNextVersion(ctx, tx, item.Namespace, item.MemoryID, item.Content, item.Tags, item.Metadata)
+				if err != nil {
+					return dbError(err)
+				}
+				pruned, err := pruneVersions(ctx, tx, item.Namespace, item.MemoryID, srv.cfg.MaxVersions)
+				if err != nil {
+					return dbError(err)
+				}
+				results = append(results, StatusResponse{Status: "saved", Namespace: m.Namespace, MemoryID: m.MemoryID, Version: m.Version, Pruned: pruned})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Only counted and announced once the batch is committed, as nothing is saved before then
+		for _, r := range results {
+			if r.Status == "saved" {
+				memoryWrites.WithLabelValues("save").Inc()
+				srv.events.Publish(MemoryEvent{Type: "saved", Namespace: r.Namespace, MemoryID: r.MemoryID, Version: r.Version})
+			}
+		}
+		return results, nil
+	},
+		fuego.OptionQueryBool("atomic", "Roll back the whole batch if any item is invalid"),
+	)
+
+	// Delete memory (archive all)
+	fuego.Post(s, "/delete-memory", func(c fuego.ContextWithBody[DeleteMemoryInput]) (*StatusResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		count, err := srv.store.DeleteMemory(ctx, body.Namespace, body.MemoryID, body.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		if body.DryRun {
+			return &StatusResponse{Status: "dry_run", Namespace: body.Namespace, MemoryID: body.MemoryID, WouldArchive: &count}, nil
+		}
+		memoryWrites.WithLabelValues("delete").Inc()
+		srv.events.Publish(MemoryEvent{Type: "deleted", Namespace: body.Namespace, MemoryID: body.MemoryID})
+		return &StatusResponse{Status: "archived", Namespace: body.Namespace, MemoryID: body.MemoryID}, nil
+	})
+
+	// Delete every memory whose latest version has a tag, archiving all their active rows in one transaction
+	fuego.Post(s, "/delete-by-tag", func(c fuego.ContextWithBody[DeleteByTagInput]) (*DeleteByTagResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Tag, err = srv.normalizeTag(body.Tag); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		resp := &DeleteByTagResponse{Status: "archived", Namespace: body.Namespace, Tag: body.Tag, MemoryIDs: []string{}}
+		if body.DryRun {
+			resp.Status = "dry_run"
+		}
+		// Only the latest active version's tags count, so a memory which has since dropped the tag is left alone
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx, `SELECT memory_id FROM memories m
+				WHERE namespace=? AND archived=0
+					AND version = (SELECT MAX(version) FROM memories o WHERE o.namespace=m.namespace AND o.memory_id=m.memory_id AND o.archived=0)
+					AND EXISTS (SELECT 1 FROM json_each(CAST(tags AS TEXT)) WHERE value = ?)
+				ORDER BY memory_id`, body.Namespace, body.Tag)
+			if err != nil {
+				return dbError(err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err != nil {
+					return dbError(err)
+				}
+				resp.MemoryIDs = append(resp.MemoryIDs, id)
+			}
+			if err := rows.Err(); err != nil {
+				return dbError(err)
+			}
+			if body.DryRun {
+				return nil
+			}
+			for _, id := range resp.MemoryIDs {
+				if _, err := tx.ExecContext(ctx, "UPDATE memories SET archived=1 WHERE namespace=? AND memory_id=? AND archived=0", body.Namespace, id); err != nil {
+					return dbError(err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp.Count = len(resp.MemoryIDs)
+		if !body.DryRun {
+			for _, id := range resp.MemoryIDs {
+				memoryWrites.WithLabelValues("delete").Inc()
+				srv.events.Publish(MemoryEvent{Type: "deleted", Namespace: body.Namespace, MemoryID: id})
+			}
+		}
+		return resp, nil
+	})
+
+	// Delete a single version (archive just that row)
+	fuego.Post(s, "/delete-version", func(c fuego.ContextWithBody[DeleteVersionInput]) (*StatusResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			res, err := tx.ExecContext(ctx, "UPDATE memories SET archived=1 WHERE namespace=? AND memory_id=? AND version=? AND archived=0", body.Namespace, body.MemoryID, body.Version)
+			if err != nil {
+				return dbError(err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return dbError(err)
+			}
+			if n == 0 {
+				return withCode(CodeVersionNotFound, fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("no active version %d of %q", body.Version, body.MemoryID)})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		memoryWrites.WithLabelValues("delete").Inc()
+		srv.events.Publish(MemoryEvent{Type: "deleted", Namespace: body.Namespace, MemoryID: body.MemoryID, Version: body.Version})
+		return &StatusResponse{Status: "archived", Namespace: body.Namespace, MemoryID: body.MemoryID, Version: body.Version}, nil
+	})
+
+	// Rename a memory, moving every version (active and archived) so its history is kept, along with its blobs
+	fuego.Post(s, "/rename-memory", func(c fuego.ContextWithBody[RenameMemoryInput]) (*StatusResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if err := validateMemoryID("old_memory_id", body.OldMemoryID); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if err := validateMemoryID("new_memory_id", body.NewMemoryID); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		var version int
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			var exists bool
+			err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM memories WHERE namespace = ? AND memory_id = ?)", body.Namespace, body.NewMemoryID).Scan(&exists)
+			if err != nil {
+				return dbError(err)
+			}
+			if exists {
+				return withCode(CodeMemoryExists, fuego.ConflictError{Title: "Conflict", Detail: fmt.Sprintf("memory %q already exists", body.NewMemoryID)})
+			}
+			res, err := tx.ExecContext(ctx, "UPDATE memories SET memory_id=? WHERE namespace=? AND memory_id=?", body.NewMemoryID, body.Namespace, body.OldMemoryID)
+			if err != nil {
+				return dbError(err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return dbError(err)
+			}
+			if n == 0 {
+				return fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", body.OldMemoryID)}
+			}
+			// Blobs are found by memory_id, so left behind they'd turn up on whatever is saved under the old one next
+			if _, err := tx.ExecContext(ctx, "UPDATE blobs SET memory_id=? WHERE namespace=? AND memory_id=?", body.NewMemoryID, body.Namespace, body.OldMemoryID); err != nil {
+				return dbError(err)
+			}
+			if err := tx.QueryRowContext(ctx, "SELECT MAX(version) FROM memories WHERE namespace=? AND memory_id=?", body.Namespace, body.NewMemoryID).Scan(&version); err != nil {
+				return dbError(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		memoryWrites.WithLabelValues("rename").Inc()
+		// Subscribers see the old memory_id go and the new one arrive, so clients reload without knowing about renames
+		srv.events.Publish(MemoryEvent{Type: "deleted", Namespace: body.Namespace, MemoryID: body.OldMemoryID})
+		srv.events.Publish(MemoryEvent{Type: "saved", Namespace: body.Namespace, MemoryID: body.NewMemoryID, Version: version})
+		return &StatusResponse{Status: "renamed", Namespace: body.Namespace, MemoryID: body.NewMemoryID}, nil
+	})
+
+	// Permanently delete archived rows, optionally only those older than a cutoff
+	fuego.Post(s, "/purge-archived", func(c fuego.ContextWithBody[PurgeArchivedInput]) (*PurgeResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		query := "DELETE FROM memories WHERE archived=1"
+		var args []interface{}
+		if body.OlderThanDays != nil {
+			if *body.OlderThanDays < 0 {
+				return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "older_than_days must not be negative"}
+			}
+			// Archiving doesn't touch updated_at, so this is when the version was written
+			query += " AND updated_at < ?"
+			args = append(args, time.Now().UTC().AddDate(0, 0, -*body.OlderThanDays))
+		}
+		var n int64
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			res, err := tx.ExecContext(ctx, query, args...)
+			if err == nil {
+				n, err = res.RowsAffected()
+			}
+			if err != nil {
+				return dbError(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// VACUUM can't run inside a transaction, so it happens after the commit
+		if body.Vacuum {
+			err = srv.writes.Exclusive(ctx, func() error {
+				if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+					return dbError(err)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &PurgeResponse{Status: "purged", Purged: n, Vacuumed: body.Vacuum}, nil
+	})
+
+	// Reclaim free space and refresh the query planner's statistics.  In-memory databases have nothing to reclaim,
+	// so they're left alone.
+	fuego.Post(s, "/maintenance", func(c fuego.ContextNoBody) (*MaintenanceResponse, error) {
+		if isMemoryDSN(cfg.DSN) {
+			return &MaintenanceResponse{Status: "skipped"}, nil
+		}
+		// No query timeout, as VACUUM rewrites the whole database and can take a while
+		ctx := c.Context()
+		resp := &MaintenanceResponse{Status: "ok"}
+		err := srv.writes.Exclusive(ctx, func() error {
+			var err error
+			if resp.SizeBefore, err = databaseSize(ctx, db); err != nil {
+				return dbError(err)
+			}
+			for _, stmt := range []string{"VACUUM", "ANALYZE"} {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					return dbError(err)
+				}
+			}
+			if resp.SizeAfter, err = databaseSize(ctx, db); err != nil {
+				return dbError(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "Database maintenance complete", "size_before", resp.SizeBefore, "size_after", resp.SizeAfter)
+		return resp, nil
+	})
+
+	// Write a consistent copy of the live database to a new file with VACUUM INTO, which reads it in a single
+	// transaction, so requests carry on being served (and writes don't end up half in the copy) while it runs
+	fuego.Post(s, "/backup", func(c fuego.ContextWithBody[BackupInput]) (*BackupResponse, error) {
+		// It writes files on the server, so is only available to clients with the API key
+		if cfg.APIKey == "" {
+			return nil, fuego.HTTPError{Status: http.StatusForbidden, Title: "Forbidden", Detail: "backups need MEMORY_SERVER_API_KEY to be set"}
+		}
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		path, err := srv.backupPath(body.Path, time.Now())
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if _, err := os.Stat(path); err == nil {
+			return nil, fuego.ConflictError{Title: "Conflict", Detail: fmt.Sprintf("%s already exists", path)}
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		// No query timeout, as copying a large database can take a while
+		ctx := c.Context()
+		if _, err := db.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+			return nil, dbError(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "Database backed up", "path", path, "size", info.Size())
+		return &BackupResponse{Path: path, Size: info.Size()}, nil
+	})
+
+	// Bound a memory's history to its newest keep_last versions.  Older versions are archived, or deleted outright
+	// with hard_delete.
+	fuego.Post(s, "/compact-memory", func(c fuego.ContextWithBody[CompactMemoryInput]) (*CompactResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if err := validateMemoryID("memory_id", body.MemoryID); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.KeepLast < 1 {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "keep_last must be at least 1"}
+		}
+		older := `namespace = ? AND memory_id = ? AND version NOT IN (SELECT version FROM memories WHERE namespace = ? AND memory_id = ? ORDER BY version DESC LIMIT ?)`
+		query := "UPDATE memories SET archived=1 WHERE archived=0 AND " + older
+		if body.HardDelete {
+			query = "DELETE FROM memories WHERE " + older
+		}
+		var n int64
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			var exists bool
+			err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM memories WHERE namespace = ? AND memory_id = ?)", body.Namespace, body.MemoryID).Scan(&exists)
+			if err != nil {
+				return dbError(err)
+			}
+			if !exists {
+				return fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", body.MemoryID)}
+			}
+			res, err := tx.ExecContext(ctx, query, body.Namespace, body.MemoryID, body.Namespace, body.MemoryID, body.KeepLast)
+			if err == nil {
+				n, err = res.RowsAffected()
+			}
+			if err != nil {
+				return dbError(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &CompactResponse{Status: "compacted", Namespace: body.Namespace, MemoryID: body.MemoryID, Removed: n}, nil
+	})
+
+	// List memories (latest, not archived)
+	fuego.Get(s, "/list-memories", func(c fuego.ContextNoBody) ([]Memory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		q, err := parseListQuery(c.QueryParam)
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		q.Namespace = namespace
+		truncate, err := queryTruncate(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		// Everything is listed unless a page is asked for
+		if c.QueryParam("limit") != "" || c.QueryParam("offset") != "" {
+			if q.Limit, q.Offset, err = parsePagination(c.QueryParam); err != nil {
+				return nil, err
+			}
+			total, err := srv.store.CountMemories(ctx, q)
+			if err != nil {
+				return nil, err
+			}
+			c.SetHeader("Link", paginationLinks(c.Request().URL, q.Limit, q.Offset, total))
+		}
+		list := func(fn func(Memory) error) error {
+			return srv.store.ListMemories(ctx, q, func(m Memory) error {
+				m.truncate(truncate)
+				return fn(m)
+			})
+		}
+		if wantsNDJSON(c.Request()) {
+			streamNDJSON(c.Response(), c.Request(), list)
+			return nil, nil
+		}
+		var memories []Memory
+		err = list(func(m Memory) error {
+			memories = append(memories, m)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return memories, nil
+	},
+		fuego.OptionQuery("sort", "One of 'memory_id' (default), 'created_at' or 'updated_at'"),
+		fuego.OptionQuery("order", "'asc' (default) or 'desc'"),
+		fuego.OptionQuery("archived", "'active' (default), 'archived', or 'all' for the newest version of every memory"),
+		fuego.OptionQueryInt("limit", "List at most this many memories, with Link headers to the other pages (max 500).  Lists everything by default"),
+		fuego.OptionQueryInt("offset", "Number of memories to skip"),
+		truncateOption,
+		fieldsOption,
+		namespaceOption,
+		dateRangeOptions,
+	)
+
+	// List memories by tag (latest, not archived)
+	fuego.Get(s, "/list-memories-by-tag", func(c fuego.ContextNoBody) ([]Memory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		tag := c.QueryParam("tag")
+		if tag == "" {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "Missing tag parameter"}
+		}
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		caseInsensitive, err := queryBool(c.QueryParam, "case_insensitive")
+		if err != nil {
+			return nil, err
+		}
+		return srv.store.ListByTag(ctx, namespace, tag, caseInsensitive)
+	},
+		fuego.OptionQuery("tag", "Tag to filter by"),
+		fuego.OptionQueryBool("case_insensitive", "Match the tag regardless of case, so 'API' finds 'api'"),
+		namespaceOption,
+	)
+
+	// List the IDs of the active memories with a few details but no content, for navigation trees and the like
+	fuego.Get(s, "/list-memory-ids", func(c fuego.ContextNoBody) ([]MemoryIDEntry, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		// With MAX, SQLite takes the other columns from the row holding the latest version
+		rows, err := db.QueryContext(ctx, `SELECT memory_id, MAX(version), updated_at, json_array_length(CAST(tags AS TEXT)) FROM memories
+			WHERE namespace=? AND archived=0 GROUP BY memory_id ORDER BY memory_id`, namespace)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		entries := []MemoryIDEntry{}
+		for rows.Next() {
+			var e MemoryIDEntry
+			if err := rows.Scan(&e.MemoryID, &e.LatestVersion, &e.UpdatedAt, &e.TagCount); err != nil {
+				return nil, dbError(err)
+			}
+			e.UpdatedAt = e.UpdatedAt.UTC()
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return entries, nil
+	},
+		namespaceOption,
+	)
+
+	// Active memory_ids starting with a prefix, alphabetically, for type-ahead in a search box
+	fuego.Get(s, "/autocomplete", func(c fuego.ContextNoBody) ([]string, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := queryInt(c.QueryParam, "limit", defaultAutocompleteLimit)
+		if err != nil {
+			return nil, err
+		}
+		limit = min(max(limit, 1), maxPageLimit)
+		ids := []string{}
+		// A prefix with characters memory_ids can't have matches nothing.  Checking that also means it holds no
+		// wildcards, so it can go straight into the pattern.
+		prefix := c.QueryParam("prefix")
+		if prefix != "" && !memoryIDPattern.MatchString(prefix) {
+			return ids, nil
+		}
+		// GLOB rather than LIKE, as SQLite's LIKE ignores case so can't use the memory_id index
+		rows, err := db.QueryContext(ctx, `SELECT DISTINCT memory_id FROM memories
+			WHERE namespace=? AND archived=0 AND memory_id GLOB ?
+			ORDER BY memory_id LIMIT ?`, namespace, prefix+"*", limit)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return nil, dbError(err)
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return ids, nil
+	},
+		fuego.OptionQuery("prefix", "Only suggest memory_ids starting with this (case-sensitive)"),
+		fuego.OptionQueryInt("limit", "Most memory_ids to suggest (default 10, max 500)"),
+		namespaceOption,
+	)
+
+	// Get memory by id (latest, not archived)
+	fuego.Get(s, "/get-memory-by-id/{memory_id}", func(c fuego.ContextNoBody) (*Memory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		memoryID := c.PathParam("memory_id")
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		format := c.QueryParam("format")
+		if format != "" && format != "json" && format != "markdown" {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "format must be json or markdown"}
+		}
+		m, err := srv.store.GetByID(ctx, namespace, memoryID)
+		if err != nil {
+			return nil, err
+		}
+		if srv.access != nil {
+			srv.access.Record(namespace, memoryID)
+		}
+		etag := memoryETag(m)
+		c.SetHeader("ETag", etag)
+		c.SetHeader("Last-Modified", m.UpdatedAt.UTC().Format(http.TimeFormat))
+		if notModified(c.Header("If-None-Match"), c.Header("If-Modified-Since"), etag, m.UpdatedAt) {
+			c.SetStatus(http.StatusNotModified)
+			return nil, nil
+		}
+		if format == "markdown" {
+			c.SetHeader("Content-Type", markdownContentType)
+			if _, err := io.WriteString(c.Response(), memoryMarkdown(m)); err != nil {
+				slog.DebugContext(ctx, "Markdown write failed", "error", err)
+			}
+			return nil, nil
+		}
+		return &m, nil
+	},
+		namespaceOption,
+		fuego.OptionQuery("format", "json (the default), or markdown for a document to paste into a wiki"),
+		fieldsOption,
+		fuego.OptionHeader("If-None-Match", "Return 304 Not Modified if the ETag still matches"),
+		fuego.OptionHeader("If-Modified-Since", "Return 304 Not Modified if unchanged since this HTTP date"),
+		fuego.OptionMiddleware(dropNotModifiedBody),
+	)
+
+	// Check a memory exists and how fresh it is without downloading it: the same status and caching headers as the
+	// GET, with no body.  It's not counted as a read by access tracking.  Registered directly on the mux, as fuego
+	// has no HEAD routes, so it isn't in the OpenAPI spec.
+	fuego.Handle(s, "HEAD /get-memory-by-id/{memory_id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := srv.queryContext(r.Context())
+		defer cancel()
+		namespace, err := queryNamespace(r.URL.Query().Get)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		m, err := srv.store.GetByID(ctx, namespace, r.PathValue("memory_id"))
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		etag := memoryETag(m)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", m.UpdatedAt.UTC().Format(http.TimeFormat))
+		if notModified(r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since"), etag, m.UpdatedAt) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Get one specific version of a memory, whether or not it's been archived
+	fuego.Get(s, "/get-memory-by-id/{memory_id}/version/{version}", func(c fuego.ContextNoBody) (*Memory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		memoryID := c.PathParam("memory_id")
+		version, err := strconv.Atoi(c.PathParam("version"))
+		if err != nil || version < 1 {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "version must be a positive integer"}
+		}
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		m, err := scanMemory(db.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND version=?`, namespace, memoryID, version))
+		if err == sql.ErrNoRows {
+			return nil, withCode(CodeVersionNotFound, fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q has no version %d", memoryID, version)})
+		}
+		if err != nil {
+			return nil, dbError(err)
+		}
+		return &m, nil
+	},
+		namespaceOption,
+	)
+
+	// Compare two versions of a memory, as a unified diff of the content plus the tags added and removed
+	fuego.Get(s, "/diff/{memory_id}", func(c fuego.ContextNoBody) (*DiffResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		memoryID := c.PathParam("memory_id")
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		versions := make([]int, 2)
+		for i, name := range []string{"from", "to"} {
+			v, err := strconv.Atoi(c.QueryParam(name))
+			if err != nil || v < 1 {
+				return nil, fuego.BadRequestError{Title: "Bad Request", Detail: name + " must be a positive integer"}
+			}
+			versions[i] = v
+		}
+		memories := make([]Memory, 2)
+		for i, version := range versions {
+			m, err := scanMemory(db.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND version=?`, namespace, memoryID, version))
+			if err == sql.ErrNoRows {
+				return nil, withCode(CodeVersionNotFound, fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q has no version %d", memoryID, version)})
+			}
+			if err != nil {
+				return nil, dbError(err)
+			}
+			memories[i] = m
+		}
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(memories[0].Content),
+			B:        difflib.SplitLines(memories[1].Content),
+			FromFile: fmt.Sprintf("%s@%d", memoryID, versions[0]),
+			ToFile:   fmt.Sprintf("%s@%d", memoryID, versions[1]),
+			Context:  3,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &DiffResponse{
+			Namespace:   namespace,
+			MemoryID:    memoryID,
+			From:        versions[0],
+			To:          versions[1],
+			Diff:        diff,
+			TagsAdded:   tagsMissingFrom(memories[1].Tags, memories[0].Tags),
+			TagsRemoved: tagsMissingFrom(memories[0].Tags, memories[1].Tags),
+		}, nil
+	},
+		fuego.OptionQueryInt("from", "Version to compare from", fuego.ParamRequired()),
+		fuego.OptionQueryInt("to", "Version to compare to", fuego.ParamRequired()),
+		namespaceOption,
+	)
+
+	// Every version of a memory (active or archived) whose content contains a phrase, oldest first, so the first
+	// result is the version which introduced it
+	fuego.Get(s, "/search-history/{memory_id}", func(c fuego.ContextNoBody) ([]Memory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		q := strings.TrimSpace(c.QueryParam("q"))
+		if q == "" {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "q is required"}
+		}
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		// Content may be encrypted, so it's matched here after decryption rather than in SQL.  Matching is
+		// case-insensitive, like the default search mode.
+		phrase := regexp.MustCompile("(?i)" + regexp.QuoteMeta(q))
+		rows, err := db.QueryContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? ORDER BY version`, namespace, c.PathParam("memory_id"))
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		matches := []Memory{}
+		for rows.Next() {
+			m, err := scanMemory(rows)
+			if err != nil {
+				return nil, dbError(err)
+			}
+			if phrase.MatchString(m.Content) {
+				m.Snippet = highlightSnippet(m.Content, []string{q}, "<mark>", "</mark>", true)
+				matches = append(matches, m)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return matches, nil
+	},
+		fuego.OptionQuery("q", "Phrase to find in the content, case-insensitively", fuego.ParamRequired()),
+		namespaceOption,
+	)
+
+	// Other active memories sharing tags with this one, most shared tags first, for a "see also" list
+	fuego.Get(s, "/related/{memory_id}", func(c fuego.ContextNoBody) ([]RelatedMemory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := queryInt(c.QueryParam, "limit", defaultRelatedLimit)
+		if err != nil {
+			return nil, err
+		}
+		limit = min(max(limit, 1), maxPageLimit)
+		m, err := srv.store.GetByID(ctx, namespace, c.PathParam("memory_id"))
+		if err != nil {
+			return nil, err
+		}
+		related := []RelatedMemory{}
+		if len(m.Tags) == 0 {
+			return related, nil
+		}
+		tagsJSON, err := json.Marshal(m.Tags)
+		if err != nil {
+			return nil, err
+		}
+		// Only the latest active version of each memory counts, with its shared tags counted by joining its tags
+		// against this memory's
+		rows, err := db.QueryContext(ctx, `SELECT `+memoryColumns+`, shared FROM memories JOIN (
+				SELECT l.id AS related_id, COUNT(DISTINCT t.value) AS shared
+				FROM memories l, json_each(CAST(l.tags AS TEXT)) t
+				WHERE l.namespace=? AND l.archived=0 AND l.memory_id != ?
+					AND l.version = (SELECT MAX(version) FROM memories o WHERE o.namespace=l.namespace AND o.memory_id=l.memory_id AND o.archived=0)
+					AND t.value IN (SELECT value FROM json_each(?))
+				GROUP BY l.id
+			) ON id = related_id
+			ORDER BY shared DESC, memory_id
+			LIMIT ?`, namespace, m.MemoryID, string(tagsJSON), limit)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r RelatedMemory
+			if r.Memory, err = scanMemory(withExtraColumns{rows, []interface{}{&r.SharedTags}}); err != nil {
+				return nil, dbError(err)
+			}
+			related = append(related, r)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return related, nil
+	},
+		fuego.OptionQueryInt("limit", "Most related memories to return (default 10, max 500)"),
+		namespaceOption,
+	)
+
+	// The active memories most recently read through /get-memory-by-id, latest first.  Needs MEMORY_SERVER_TRACK_ACCESS.
+	fuego.Get(s, "/recent", func(c fuego.ContextNoBody) ([]RecentMemory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := queryInt(c.QueryParam, "limit", defaultRecentLimit)
+		if err != nil {
+			return nil, err
+		}
+		limit = min(max(limit, 1), maxPageLimit)
+		if srv.access == nil {
+			return nil, fuego.HTTPError{Status: http.StatusNotImplemented, Title: "Not Implemented", Detail: "access tracking is off, set MEMORY_SERVER_TRACK_ACCESS=true to enable /recent"}
+		}
+		// Deleted memories keep their access row, but have no active version to join
+		rows, err := db.QueryContext(ctx, `SELECT `+memoryColumns+`, a.last_accessed_at FROM memories
+			JOIN memory_access a USING (namespace, memory_id)
+			WHERE namespace=? AND archived=0
+				AND version = (SELECT MAX(version) FROM memories o WHERE o.namespace=memories.namespace AND o.memory_id=memories.memory_id AND o.archived=0)
+			ORDER BY a.last_accessed_at DESC, memory_id
+			LIMIT ?`, namespace, limit)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		recent := []RecentMemory{}
+		for rows.Next() {
+			var r RecentMemory
+			if r.Memory, err = scanMemory(withExtraColumns{rows, []interface{}{&r.LastAccessedAt}}); err != nil {
+				return nil, dbError(err)
+			}
+			r.LastAccessedAt = r.LastAccessedAt.UTC()
+			recent = append(recent, r)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return recent, nil
+	},
+		fuego.OptionQueryInt("limit", "Most memories to return (default 20, max 500)"),
+		namespaceOption,
+	)
+
+	// Fetch the latest active version of several memories at once.  IDs which aren't found are left out of the map.
+	fuego.Post(s, "/get-memories", func(c fuego.ContextWithBody[GetMemoriesInput]) (map[string]Memory, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.Namespace, err = resolveNamespace(body.Namespace); err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if len(body.MemoryIDs) > maxPageLimit {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("at most %d memory_ids can be fetched at once", maxPageLimit)}
+		}
+		memories := make(map[string]Memory, len(body.MemoryIDs))
+		if len(body.MemoryIDs) == 0 {
+			return memories, nil
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(body.MemoryIDs)), ",")
+		args := []interface{}{body.Namespace}
+		for _, id := range body.MemoryIDs {
+			args = append(args, id)
+		}
+		rows, err := db.QueryContext(ctx, `SELECT `+memoryColumns+` FROM memories m
+			WHERE namespace=? AND archived=0 AND memory_id IN (`+placeholders+`)
+				AND version = (SELECT MAX(version) FROM memories WHERE namespace=m.namespace AND memory_id=m.memory_id AND archived=0)`, args...)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			m, err := scanMemory(rows)
+			if err != nil {
+				return nil, dbError(err)
+			}
+			memories[m.MemoryID] = m
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return memories, nil
+	})
+
+	// Search memories (active only, paginated)
+	fuego.Get(s, "/search-memories", func(c fuego.ContextNoBody) (*SearchResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		q := c.QueryParam("q")
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		limit, offset, err := parsePagination(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		fuzzy, err := queryBool(c.QueryParam, "fuzzy")
+		if err != nil {
+			return nil, err
+		}
+		highlight, err := queryBool(c.QueryParam, "highlight")
+		if err != nil {
+			return nil, err
+		}
+		truncate, err := queryTruncate(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+
+		sq := parseSearchQuery(q)
+		highlighted := func(resp *SearchResponse, err error) (*SearchResponse, error) {
+			if err != nil || !highlight {
+				return resp, err
+			}
+			// The default <mark> tags are meant for inserting into HTML, so the text around them is escaped
+			markStart, markEnd, escape := c.QueryParam("highlight_start"), c.QueryParam("highlight_end"), false
+			if markStart == "" && markEnd == "" {
+				markStart, markEnd, escape = "<mark>", "</mark>", true
+			}
+			terms := append([]string{sq.Text}, sq.Content...)
+			for i := range resp.Memories {
+				resp.Memories[i].Snippet = highlightSnippet(resp.Memories[i].Content, terms, markStart, markEnd, escape)
+			}
+			return resp, nil
+		}
+		dates, err := parseDateRange(c.QueryParam)
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		query := SearchQuery{searchQuery: sq, Namespace: namespace, Mode: c.QueryParam("mode"), Fuzzy: fuzzy, Dates: dates, Limit: limit, Offset: offset}
+		if fuzzy {
+			if query.Mode != "" {
+				return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "mode can't be combined with fuzzy"}
+			}
+			if query.MaxDistance, err = queryInt(c.QueryParam, "max_distance", defaultFuzzyDistance); err != nil {
+				return nil, err
+			}
+			if query.MaxDistance < 0 || query.MaxDistance > maxFuzzyDistance {
+				return nil, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("max_distance must be between 0 and %d", maxFuzzyDistance)}
+			}
+		}
+		memories, total, err := srv.store.Search(ctx, query)
+		if err == nil {
+			c.SetHeader("Link", paginationLinks(c.Request().URL, limit, offset, total))
+		}
+		resp, err := highlighted(&SearchResponse{Total: total, Limit: limit, Offset: offset, Memories: memories}, err)
+		// Snippets are taken from the full content, so it's only truncated afterwards
+		for i := range memories {
+			memories[i].truncate(truncate)
+		}
+		return resp, err
+	},
+		fuego.OptionQuery("q", "Text to search for in memory_id and content.  'tag:x' and 'content:x' terms narrow the search."),
+		fuego.OptionQuery("mode", "'substring' (default) and 'word' are case-insensitive, 'exact' matches the whole field"),
+		fuego.OptionQueryBool("fuzzy", "Tolerate typos, ranking results by edit distance.  Can't be combined with mode"),
+		fuego.OptionQueryInt("max_distance", "Most edits allowed per word in a fuzzy search (default 2, max 5)"),
+		fuego.OptionQueryBool("highlight", "Add a snippet of the content around the first match, with matches marked"),
+		fuego.OptionQuery("highlight_start", "Inserted before each match in the snippet instead of <mark>"),
+		fuego.OptionQuery("highlight_end", "Inserted after each match in the snippet instead of </mark>"),
+		fuego.OptionQueryInt("limit", "Maximum number of results (default 50, max 500)"),
+		fuego.OptionQueryInt("offset", "Number of results to skip"),
+		truncateOption,
+		fieldsOption,
+		namespaceOption,
+		dateRangeOptions,
+	)
+
+	// Every row (archived or not) written after a point in time, oldest first, for incremental sync
+	fuego.Get(s, "/changes", func(c fuego.ContextNoBody) (*ChangesResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		since, err := time.Parse(time.RFC3339, c.QueryParam("since"))
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("since must be an RFC3339 timestamp, got %q", c.QueryParam("since"))}
+		}
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		// Taken before the query, so anything written while it runs is picked up by the next call
+		resp := &ChangesResponse{ServerTime: time.Now().UTC(), Memories: []Memory{}}
+		rows, err := db.QueryContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace = ? AND updated_at > ? ORDER BY updated_at, id`, namespace, since.UTC())
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			m, err := scanMemory(rows)
+			if err != nil {
+				return nil, dbError(err)
+			}
+			resp.Memories = append(resp.Memories, m)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return resp, nil
+	},
+		fuego.OptionQuery("since", "RFC3339 timestamp, usually the server_time from the previous call", fuego.ParamRequired()),
+		namespaceOption,
+	)
+
+	// Liveness probe for latency checks, which never touches the database
+	fuego.Get(s, "/ping", func(c fuego.ContextNoBody) (*PingResponse, error) {
+		return &PingResponse{Pong: true, Version: Version, GoVersion: runtime.Version(), UptimeSeconds: int64(time.Since(srv.startedAt).Seconds())}, nil
+	})
+
+	// Liveness/readiness probe, which checks the database is reachable rather than just the HTTP server
+	fuego.Get(s, "/healthz", func(c fuego.ContextNoBody) (*HealthResponse, error) {
+		ctx, cancel := context.WithTimeout(c.Context(), 2*time.Second)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			return nil, fuego.HTTPError{Status: http.StatusServiceUnavailable, Title: "Service Unavailable", Detail: err.Error()}
+		}
+		return &HealthResponse{Status: "ok", Database: srv.dbCheck}, nil
+	})
+
+	// Summary counts for dashboards, so clients don't need to download everything
+	fuego.Get(s, "/stats", func(c fuego.ContextNoBody) (*StatsResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		var stats StatsResponse
+		err = db.QueryRowContext(ctx, `SELECT
+				COUNT(DISTINCT CASE WHEN archived=0 THEN memory_id END),
+				COALESCE(SUM(archived=1), 0),
+				COUNT(DISTINCT memory_id),
+				COUNT(*)
+			FROM memories WHERE namespace=?`, namespace).Scan(&stats.ActiveMemories, &stats.ArchivedRows, &stats.DistinctMemoryIDs, &stats.TotalRows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		// Tags are only counted on active rows, so retired tags don't linger in the total.  The tags column holds
+		// JSON text written as a blob, so it's cast to TEXT for json_each (which would otherwise expect JSONB).
+		err = db.QueryRowContext(ctx, `SELECT COUNT(DISTINCT t.value) FROM memories m, json_each(CAST(m.tags AS TEXT)) t WHERE m.namespace=? AND m.archived=0`, namespace).Scan(&stats.DistinctTags)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		stats.WriteQueueDepth = srv.writes.Depth()
+		return &stats, nil
+	},
+		namespaceOption,
+	)
+
+	// Storage footprint of a single memory, for spotting ones worth compacting
+	fuego.Get(s, "/memory-stats/{memory_id}", func(c fuego.ContextNoBody) (*MemoryStatsResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		stats := &MemoryStatsResponse{Namespace: namespace, MemoryID: c.PathParam("memory_id")}
+		// Content is cast to a BLOB so length() counts bytes rather than characters
+		err = db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(length(CAST(content AS BLOB))), 0), COALESCE(MAX(length(CAST(content AS BLOB))), 0)
+			FROM memories WHERE namespace=? AND memory_id=?`, namespace, stats.MemoryID).Scan(&stats.Versions, &stats.TotalBytes, &stats.LargestBytes)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		if stats.Versions == 0 {
+			return nil, fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", stats.MemoryID)}
+		}
+		// Aggregates lose the column type the driver needs to return a time, so the timestamps are read as plain columns
+		if stats.FirstCreatedAt, err = firstCreatedAt(ctx, db, namespace, stats.MemoryID, time.Time{}); err != nil {
+			return nil, dbError(err)
+		}
+		err = db.QueryRowContext(ctx, `SELECT updated_at FROM memories WHERE namespace=? AND memory_id=? ORDER BY updated_at DESC LIMIT 1`, namespace, stats.MemoryID).Scan(&stats.LastUpdatedAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		stats.LastUpdatedAt = stats.LastUpdatedAt.UTC()
+		return stats, nil
+	},
+		namespaceOption,
+	)
+
+	// Distinct tags on active memories with how many memories use each, most used first
+	fuego.Get(s, "/tags", func(c fuego.ContextNoBody) ([]TagCount, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		prefix := c.QueryParam("prefix")
+		// Same JSON text cast as /stats.  Only string elements are counted, in case anything else slipped in.  Saves
+		// don't archive the previous version, so a memory can have several active versions, and /import doesn't
+		// de-duplicate tags, so each memory is counted once per tag like /tag-report does.
+		rows, err := db.QueryContext(ctx, `SELECT t.value, COUNT(DISTINCT m.memory_id) AS n
+			FROM memories m, json_each(CAST(m.tags AS TEXT)) t
+			WHERE m.namespace=? AND m.archived=0 AND t.type='text' AND substr(t.value, 1, length(?)) = ?
+			GROUP BY t.value
+			ORDER BY n DESC, t.value`, namespace, prefix, prefix)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		tags := []TagCount{}
+		for rows.Next() {
+			var tc TagCount
+			if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+				return nil, dbError(err)
+			}
+			tags = append(tags, tc)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return tags, nil
+	},
+		fuego.OptionQuery("prefix", "Only return tags starting with this (case-sensitive)"),
+		namespaceOption,
+	)
+
+	// How many active memories carry each tag, for reporting.  Unlike /tags it can leave out the rarely used ones.
+	fuego.Get(s, "/tag-report", func(c fuego.ContextNoBody) ([]TagReportEntry, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		minCount, err := queryInt(c.QueryParam, "min", 1)
+		if err != nil {
+			return nil, err
+		}
+		// Tags live in each row's JSON array, so they're expanded with json_each as for /tags.  Memories are counted
+		// distinctly in case a stored array repeats a tag.
+		rows, err := db.QueryContext(ctx, `SELECT t.value, COUNT(DISTINCT m.memory_id) AS n
+			FROM memories m, json_each(CAST(m.tags AS TEXT)) t
+			WHERE m.namespace=? AND m.archived=0 AND t.type='text'
+			GROUP BY t.value
+			HAVING n >= ?
+			ORDER BY n DESC, t.value`, namespace, minCount)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer rows.Close()
+		report := []TagReportEntry{}
+		for rows.Next() {
+			var e TagReportEntry
+			if err := rows.Scan(&e.Tag, &e.MemoryCount); err != nil {
+				return nil, dbError(err)
+			}
+			report = append(report, e)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, dbError(err)
+		}
+		return report, nil
+	},
+		fuego.OptionQueryInt("min", "Only report tags on at least this many memories (default 1)"),
+		namespaceOption,
+	)
+
+	// Live stream of memory changes as server-sent events, so clients don't need to poll
+	fuego.GetStd(s, "/events", func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			slog.ErrorContext(r.Context(), "Event stream can't be flushed", "error", err)
+			return
+		}
+
+		events, unsubscribe := srv.events.Subscribe()
+		defer unsubscribe()
+		// Comments keep idle connections from being closed by proxies
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-srv.events.Done():
+				return
+			case <-heartbeat.C:
+				w.Write([]byte(": ping\n\n"))
+			case ev := <-events:
+				data, err := json.Marshal(ev)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Event marshal failed", "error", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	// Export the whole database, including archived versions.  Rows are streamed straight to the client as they
+	// are scanned, so large databases don't need to be held in memory.
+	fuego.GetStd(s, "/export", func(w http.ResponseWriter, r *http.Request) {
+		// No query timeout here, as a large export can legitimately take a while.  It still stops if the client
+		// goes away.
+		ctx := r.Context()
+		rows, err := db.QueryContext(ctx, `SELECT `+memoryColumns+` FROM memories ORDER BY namespace, memory_id, version`)
+		if err != nil {
+			dbErrors.Inc()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		if wantsNDJSON(r) {
+			streamNDJSON(w, r, eachRow(rows))
+			return
+		}
+		exportedAt, err := json.Marshal(time.Now().UTC())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"schema_version":%d,"exported_at":%s,"memories":[`, exportSchemaVersion, exportedAt)
+		first := true
+		for rows.Next() {
+			m, err := scanMemory(rows)
+			if err != nil {
+				// The status code has already been sent, so all we can do is stop and leave the document truncated
+				dbErrors.Inc()
+				slog.ErrorContext(r.Context(), "Export scan failed", "error", err)
+				return
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Export marshal failed", "error", err)
+				return
+			}
+			if !first {
+				w.Write([]byte(","))
+			}
+			first = false
+			w.Write(data)
+		}
+		if err := rows.Err(); err != nil {
+			dbErrors.Inc()
+			slog.ErrorContext(r.Context(), "Export row iteration failed", "error", err)
+			return
+		}
+		w.Write([]byte("]}"))
+	})
+
+	// Import an /export document.  mode=replace wipes the database first, mode=merge (the default) keeps existing
+	// rows and skips any versions which are already present.
+	fuego.Post(s, "/import", func(c fuego.ContextWithBody[ExportDocument]) (*ImportResponse, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		body, err := c.Body()
+		if err != nil {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+		}
+		if body.SchemaVersion != exportSchemaVersion {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("unsupported schema_version %d, expected %d", body.SchemaVersion, exportSchemaVersion)}
+		}
+		mode := c.QueryParam("mode")
+		if mode == "" {
+			mode = "merge"
+		}
+		if mode != "merge" && mode != "replace" {
+			return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "mode must be 'merge' or 'replace'"}
+		}
+		resp := &ImportResponse{Status: "imported", Mode: mode}
+		err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+			if mode == "replace" {
+				// Exports don't include blobs, so the replaced memories' blobs go with them
+				for _, table := range []string{"memories", "blobs"} {
+					if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+						return dbError(err)
+					}
+				}
+			}
+			for _, m := range body.Memories {
+				if m.MemoryID == "" || m.Version < 1 {
+					return fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("invalid memory %q version %d", m.MemoryID, m.Version)}
+				}
+				// Exports from before namespaces existed don't have one
+				namespace, err := resolveNamespace(m.Namespace)
+				if err != nil {
+					return fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("memory %q version %d: %s", m.MemoryID, m.Version, err.Error())}
+				}
+				var exists bool
+				err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM memories WHERE namespace = ? AND memory_id = ? AND version = ?)", namespace, m.MemoryID, m.Version).Scan(&exists)
+				if err != nil {
+					return dbError(err)
+				}
+				if exists {
+					resp.Skipped++
+					continue
+				}
+				if m.Tags == nil {
+					m.Tags = []string{}
+				}
+				m.Metadata, err = normalizeMetadata(m.Metadata)
+				if err != nil {
+					return fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("memory %q version %d: %s", m.MemoryID, m.Version, err.Error())}
+				}
+				tagsJSON, err := json.Marshal(m.Tags)
+				if err != nil {
+					return dbError(err)
+				}
+				_, err = tx.ExecContext(ctx, insertMemory, namespace, m.MemoryID, m.Version, m.Content, tagsJSON, string(m.Metadata), m.Archived, m.Pinned, m.CreatedAt.UTC(), m.UpdatedAt.UTC())
+				if err != nil {
+					return dbError(err)
+				}
+				resp.Imported++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	},
+		fuego.OptionQuery("mode", "'merge' (default) keeps existing rows, 'replace' wipes the database first"),
+	)
+
+	// Attach a file to a memory, uploaded as the "file" field of a multipart form, returning the blob's details
+	fuego.Post(s, "/memory/{memory_id}/blob", func(c fuego.ContextNoBody) (*Blob, error) {
+		ctx, cancel := srv.queryContext(c.Context())
+		defer cancel()
+		namespace, err := queryNamespace(c.QueryParam)
+		if err != nil {
+			return nil, err
+		}
+		return srv.uploadBlob(ctx, c.Request(), namespace, c.PathParam("memory_id"))
+	},
+		fuego.OptionDescription("Upload a file as the \"file\" field of a multipart/form-data body.  At most MEMORY_SERVER_MAX_BLOB_BYTES, 413 otherwise."),
+		namespaceOption,
+	)
+
+	// Download a blob, with the content type it was uploaded with
+	fuego.GetStd(s, "/blob/{blob_id}", srv.serveBlob, namespaceOption)
+
+	// Test-only shutdown endpoint
+	fuego.Post(s, "/shutdown", func(c fuego.ContextNoBody) (string, error) {
+		slog.InfoContext(c.Context(), "/shutdown endpoint triggered, shutting down")
+		srv.shutdownOnce.Do(func() { close(srv.shutdown) })
+		return "Shutting down...", nil
+	})
+
+	// Finalise (and validate) the OpenAPI spec now that all routes are registered
+	s.OutputOpenAPISpec()
+	srv.fuego = s
+	return srv
+}
+
+// Handler returns the HTTP handler serving every route.  CORS is handled in front of the routes, as preflight
+// OPTIONS requests don't match any of them.
+func (srv *Server) Handler() http.Handler {
+	if len(srv.cfg.CORSOrigins) == 0 {
+		return srv.fuego.Mux
+	}
+	return allowCORS(srv.cfg.CORSOrigins, srv.fuego.Mux)
+}
+
+// ShutdownRequested is closed when a client calls /shutdown
+func (srv *Server) ShutdownRequested() <-chan struct{} {
+	return srv.shutdown
+}
+
+// SetDatabaseCheck records the result of CheckDatabase, for /healthz to report
+func (srv *Server) SetDatabaseCheck(check DatabaseCheck) {
+	srv.dbCheck = &check
+}
+
+// Drain starts draining the server for shutdown: new requests are answered with a 503, and any open /events streams,
+// which never go idle by themselves and would otherwise hold up a graceful shutdown, are ended.  Requests already
+// being handled carry on.
+func (srv *Server) Drain() {
+	srv.draining.Store(true)
+	srv.events.Close()
+}
+
+// Close shuts the server down once requests have finished, draining it first if Drain wasn't called.  Queued writes
+// and access times are written, then the goroutines writing them end.  The database is left open for the caller to
+// close.
+func (srv *Server) Close() {
+	srv.Drain()
+	if srv.access != nil {
+		srv.access.Stop()
+	}
+	srv.writes.Stop()
+}
+
+// drainRetryAfter is the Retry-After sent with the 503s while draining, in seconds.  By then a restarted server (or
+// another instance behind the load balancer) should be ready.
+const drainRetryAfter = "5"
+
+// rejectWhileDraining answers 503 Service Unavailable once Close has been called, rather than starting requests
+// which the shutdown might cut off.  Load balancers see /healthz fail too, so they stop sending traffic.
+func (srv *Server) rejectWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.draining.Load() {
+			w.Header().Set("Retry-After", drainRetryAfter)
+			w.Header().Set("Connection", "close")
+			sendError(w, r, fuego.HTTPError{Status: http.StatusServiceUnavailable, Title: "Service Unavailable", Detail: "the server is shutting down"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// multipartRoutes are the routes taking file uploads, which requireJSONBody lets send multipart/form-data
+var multipartRoutes = map[string]bool{
+	"POST /memory/{memory_id}/blob": true,
+}
+
+// requireJSONBody answers 415 Unsupported Media Type to requests sending a body which isn't declared as JSON, so a
+// client posting form data or plain text by mistake gets told so rather than a confusing decoding error.  Requests
+// without a body (eg POST /maintenance) don't need a Content-Type.
+func requireJSONBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			if r.ContentLength == 0 {
+				break
+			}
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err == nil && mediaType == "multipart/form-data" && multipartRoutes[r.Pattern] {
+				break
+			}
+			if err != nil || mediaType != "application/json" {
+				sendError(w, r, fuego.HTTPError{Status: http.StatusUnsupportedMediaType, Title: "Unsupported Media Type", Detail: fmt.Sprintf("request bodies must be sent as application/json, not %q", r.Header.Get("Content-Type"))})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// baselineSchema is the schema of the first release, before migrations were tracked.  Migration 1 creates it, and
+// the later ones build on it, so it must stay exactly as released.  Schema changes go in a new migration instead.
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS memories (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    memory_id TEXT NOT NULL,           -- descriptive title/heading
+    version INTEGER NOT NULL,          -- version number, increments per memory_id
+    content TEXT NOT NULL,             -- memory content
+    tags TEXT,                        -- JSON array of tags
+    archived BOOLEAN NOT NULL DEFAULT 0, -- true if archived, false if active
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_memories_memory_id ON memories(memory_id);
+CREATE INDEX IF NOT EXISTS idx_memories_archived ON memories(archived);
+CREATE INDEX IF NOT EXISTS idx_memories_latest_active ON memories(memory_id, version, archived);
+`
+
+// migration is one step in evolving the database schema.  Each is applied in its own transaction and recorded in
+// schema_migrations, so it only ever runs once per database.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in the order they're applied.  New ones go on the end, and released ones
+// must never be changed or reordered.  Databases from before migrations were tracked have had some of these applied
+// already, so the early ones are written to be safe to re-run.
+var migrations = []migration{
+	{1, "create the memories table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(baselineSchema)
+		return err
+	}},
+	{2, "add the metadata column", func(tx *sql.Tx) error {
+		// Existing rows default to an empty object
+		err := addColumnIfMissing(tx, "memories", "metadata", "TEXT")
+		if err == nil {
+			_, err = tx.Exec(`UPDATE memories SET metadata='{}' WHERE metadata IS NULL`)
+		}
+		return err
+	}},
+	{3, "store missing tags as an empty array", func(tx *sql.Tx) error {
+		// Older versions stored missing tags as JSON null rather than an empty array
+		_, err := tx.Exec(`UPDATE memories SET tags='[]' WHERE tags IS NULL OR CAST(tags AS TEXT)='null'`)
+		return err
+	}},
+	{4, "make memory versions unique", func(tx *sql.Tx) error {
+		// Any duplicates left by racing saves in earlier releases are renumbered first, as the index can't be
+		// created while they exist
+		renumbered, err := renumberDuplicateVersions(tx)
+		if err != nil {
+			return err
+		}
+		if renumbered > 0 {
+			slog.Warn("Renumbered duplicate memory versions", "rows", renumbered)
+		}
+		_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_memories_memory_id_version ON memories(memory_id, version)`)
+		return err
+	}},
+	{5, "add the nonce column for encrypted content", func(tx *sql.Tx) error {
+		// Existing rows keep a NULL nonce, marking their content as plaintext
+		return addColumnIfMissing(tx, "memories", "nonce", "BLOB")
+	}},
+	{6, "add namespaces", func(tx *sql.Tx) error {
+		// Existing memories all go into the default namespace, and versions become unique within a namespace rather
+		// than across the whole database
+		if err := addColumnIfMissing(tx, "memories", "namespace", "TEXT NOT NULL DEFAULT '"+defaultNamespace+"'"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DROP INDEX IF EXISTS idx_memories_memory_id_version;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_memories_namespace_memory_id_version ON memories(namespace, memory_id, version)`)
+		return err
+	}},
+	{7, "add the pinned column", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "memories", "pinned", "BOOLEAN NOT NULL DEFAULT 0")
+	}},
+	{8, "add the memory_access table", func(tx *sql.Tx) error {
+		// Kept apart from memories, as an access isn't a change to any version
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS memory_access (
+			namespace TEXT NOT NULL,
+			memory_id TEXT NOT NULL,
+			last_accessed_at DATETIME NOT NULL,
+			PRIMARY KEY (namespace, memory_id)
+		)`)
+		return err
+	}},
+	{9, "add the blobs table", func(tx *sql.Tx) error {
+		// Files attached to memories, kept out of the memories table so listing and searching never read them
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS blobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			namespace TEXT NOT NULL,
+			memory_id TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_blobs_namespace_memory_id ON blobs(namespace, memory_id)`)
+		return err
+	}},
+	{10, "add the idempotency_keys table", func(tx *sql.Tx) error {
+		// memory_row_id stays NULL while the first save with a key is in progress
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			idempotency_key TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			memory_row_id INTEGER,
+			pruned INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at)`)
+		return err
+	}},
+}
+
+// Migrate applies any migrations the database hasn't had yet, in order, returning how many were applied
+func Migrate(db *sql.DB) (int, error) {
+	if isPostgres(db) {
+		return migratePostgres(db)
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return 0, err
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return 0, err
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return 0, fmt.Errorf("database schema version %d is newer than this server supports (%d)", current, latest)
+	}
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		err = m.apply(tx)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`, m.version, m.description, time.Now().UTC())
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		slog.Info("Applied database migration", "version", m.version, "description", m.description)
+		applied++
+	}
+	return applied, nil
+}
+
+// addColumnIfMissing adds a column to a table, unless the table already has it
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	var exists bool
+	err := tx.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// withExtraColumns scans the columns selected after memoryColumns into extra, so scanMemory can read rows with
+// additional columns
+type withExtraColumns struct {
+	rowScanner
+	extra []interface{}
+}
+
+func (w withExtraColumns) Scan(dest ...interface{}) error {
+	return w.rowScanner.Scan(append(dest, w.extra...)...)
+}
+
+// scanMemory reads a single memory row selected using memoryColumns
+func scanMemory(r rowScanner) (Memory, error) {
+	var m Memory
+	var tagsJSON []byte
+	var metadata sql.NullString
+	if err := r.Scan(&m.ID, &m.Namespace, &m.MemoryID, &m.Version, &m.Content, &tagsJSON, &metadata, &m.Archived, &m.Pinned, &m.CreatedAt, &m.UpdatedAt); err != nil {
+		return m, err
+	}
+	// The driver keeps whatever offset a timestamp was stored with, so they're normalised to always serialise as
+	// RFC3339 in UTC
+	m.CreatedAt = m.CreatedAt.UTC()
+	m.UpdatedAt = m.UpdatedAt.UTC()
+	m.Metadata = json.RawMessage("{}")
+	if metadata.Valid && metadata.String != "" {
+		m.Metadata = json.RawMessage(metadata.String)
+	}
+	err := json.Unmarshal(tagsJSON, &m.Tags)
+	if m.Tags == nil {
+		m.Tags = []string{}
+	}
+	return m, err
+}
+
+// overwriteVersion replaces the content, tags and metadata of a stored version in place, bumping its updated_at, and
+// returns the stored row.  It's how updates work in mutable versioning mode.
+func overwriteVersion(ctx context.Context, tx *sql.Tx, id int, content string, tags []string, metadata json.RawMessage) (Memory, error) {
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return Memory{}, err
+	}
+	_, err = tx.ExecContext(ctx, `WITH n AS MATERIALIZED (SELECT content_nonce() AS nonce)
+		UPDATE memories SET content = seal_content(?, (SELECT nonce FROM n)), nonce = (SELECT nonce FROM n), tags = ?, metadata = ?, updated_at = ?
+		WHERE id = ?`, content, tagsJSON, string(metadata), time.Now().UTC(), id)
+	if err != nil {
+		return Memory{}, err
+	}
+	return scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE id = ?`, id))
+}
+
+// pruneVersions permanently deletes the oldest archived versions of a memory beyond maxVersions in total, returning
+// how many were deleted.  Active versions are never pruned, so a memory can still have more than maxVersions if
+// enough of them are active.  A maxVersions of 0 keeps everything.
+func pruneVersions(ctx context.Context, tx *sql.Tx, namespace, memoryID string, maxVersions int) (int64, error) {
+	if maxVersions == 0 {
+		return 0, nil
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM memories WHERE id IN (
+		SELECT id FROM memories WHERE namespace=?1 AND memory_id=?2 AND archived=1 ORDER BY version
+		LIMIT max(0, (SELECT COUNT(*) FROM memories WHERE namespace=?1 AND memory_id=?2) - ?3))`, namespace, memoryID, maxVersions)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// writeNewVersion archives the active version of a memory and inserts the next version in its place, returning
+// the stored row
+func writeNewVersion(ctx context.Context, tx *sql.Tx, namespace, memoryID, content string, tags []string, metadata json.RawMessage) (Memory, error) {
+	_, err := tx.ExecContext(ctx, "UPDATE memories SET archived=1 WHERE namespace=? AND memory_id=? AND archived=0", namespace, memoryID)
+	if err != nil {
+		return Memory{}, err
+	}
+	return insertNextVersion(ctx, tx, namespace, memoryID, content, tags, metadata)
+}
+
+// insertNextVersion inserts an active row for the version after the latest one of a memory, returning the stored row.
+// The version is worked out by the INSERT itself, so there's no window between reading the latest version and
+// writing the next one.
+func insertNextVersion(ctx context.Context, tx *sql.Tx, namespace, memoryID, content string, tags []string, metadata json.RawMessage) (Memory, error) {
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return Memory{}, err
+	}
+	args := []any{namespace, memoryID, content, tagsJSON, string(metadata), time.Now().UTC()}
+	if returningSupported {
+		return scanMemory(tx.QueryRowContext(ctx, insertNextMemory+" RETURNING "+memoryColumns, args...))
+	}
+	// Without RETURNING the stored row has to be read back
+	res, err := tx.ExecContext(ctx, insertNextMemory, args...)
+	if err != nil {
+		return Memory{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Memory{}, err
+	}
+	return scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE id = ?`, id))
+}
+
+// isUniqueViolation reports whether err is SQLite rejecting a row which breaks a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// renumberDuplicateVersions gives any rows sharing a memory_id and version with an earlier row the memory's next
+// version number, returning how many were changed.  Saves racing each other could write duplicates before versions
+// were enforced to be unique.
+func renumberDuplicateVersions(tx *sql.Tx) (int, error) {
+	rows, err := tx.Query(`SELECT m.id FROM memories m WHERE EXISTS (SELECT 1 FROM memories o WHERE o.memory_id = m.memory_id AND o.version = m.version AND o.id < m.id) ORDER BY m.id`)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		_, err = tx.Exec(`UPDATE memories SET version = (SELECT MAX(o.version) FROM memories o WHERE o.memory_id = memories.memory_id) + 1 WHERE id = ?`, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// retagMemory applies change to the tags of the latest active version of a memory, passing it the requested tag
+// after normalisation.  If change returns nil the tags are already as requested and the current version is returned
+// unchanged, otherwise a new version is written.
+//
+// The tags are read and rewritten in one transaction on the write queue, so concurrent tag edits each apply to the
+// tags left by the last (see writeQueue).
+func (srv *Server) retagMemory(ctx context.Context, body TagInput, change func(tags []string, tag string) []string) (*SavedMemoryResponse, error) {
+	namespace, err := resolveNamespace(body.Namespace)
+	if err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	if err := validateMemoryID("memory_id", body.MemoryID); err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	tag, err := srv.normalizeTag(body.Tag)
+	if err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "tag " + err.Error()}
+	}
+	var current, m Memory
+	var pruned int64
+	unchanged := false
+	err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+		var err error
+		current, err = scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND archived=0 ORDER BY version DESC LIMIT 1`, namespace, body.MemoryID))
+		if err == sql.ErrNoRows {
+			return fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", body.MemoryID)}
+		}
+		if err != nil {
+			return dbError(err)
+		}
+		tags := change(current.Tags, tag)
+		if tags == nil {
+			unchanged = true
+			return nil
+		}
+		if len(tags) > srv.cfg.MaxTags {
+			return fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("memory %q already has the maximum of %d tags", body.MemoryID, srv.cfg.MaxTags)}
+		}
+		m, err = writeNewVersion(ctx, tx, current.Namespace, current.MemoryID, current.Content, tags, current.Metadata)
+		if err == nil {
+			pruned, err = pruneVersions(ctx, tx, current.Namespace, current.MemoryID, srv.cfg.MaxVersions)
+		}
+		if err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unchanged {
+		return &SavedMemoryResponse{Status: "unchanged", Memory: current}, nil
+	}
+	memoryWrites.WithLabelValues("update").Inc()
+	srv.events.Publish(MemoryEvent{Type: "updated", Namespace: m.Namespace, MemoryID: m.MemoryID, Version: m.Version})
+	return &SavedMemoryResponse{Status: "updated", Memory: m, Pruned: pruned}, nil
+}
+
+// setPinned pins or unpins every version of a memory, so archived versions restored later keep the same state.  The
+// status is "pinned" or "unpinned", or "unchanged" when it already was.
+func (srv *Server) setPinned(ctx context.Context, body PinMemoryInput, pinned bool) (*SavedMemoryResponse, error) {
+	namespace, err := resolveNamespace(body.Namespace)
+	if err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	if err := validateMemoryID("memory_id", body.MemoryID); err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	var m Memory
+	err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+		var err error
+		m, err = scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND archived=0 ORDER BY version DESC LIMIT 1`, namespace, body.MemoryID))
+		if err == sql.ErrNoRows {
+			return fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", body.MemoryID)}
+		}
+		if err != nil {
+			return dbError(err)
+		}
+		if m.Pinned == pinned {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE memories SET pinned=? WHERE namespace=? AND memory_id=?", pinned, namespace, body.MemoryID); err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m.Pinned == pinned {
+		return &SavedMemoryResponse{Status: "unchanged", Memory: m}, nil
+	}
+	m.Pinned = pinned
+	srv.events.Publish(MemoryEvent{Type: "updated", Namespace: m.Namespace, MemoryID: m.MemoryID, Version: m.Version})
+	status := "unpinned"
+	if pinned {
+		status = "pinned"
+	}
+	return &SavedMemoryResponse{Status: status, Memory: m}, nil
+}
+
+// editContent writes a new version of a memory with its content changed by edit, which is given the latest active
+// content and the requested text.  Tags and metadata are kept.
+func (srv *Server) editContent(ctx context.Context, body TextInput, edit func(content, text string) string) (*SavedMemoryResponse, error) {
+	namespace, err := resolveNamespace(body.Namespace)
+	if err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	if err := validateMemoryID("memory_id", body.MemoryID); err != nil {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	if body.Text == "" {
+		return nil, fuego.BadRequestError{Title: "Bad Request", Detail: "text is required"}
+	}
+	var m Memory
+	var pruned int64
+	err = srv.writes.Write(ctx, func(tx *sql.Tx) error {
+		current, err := scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND archived=0 ORDER BY version DESC LIMIT 1`, namespace, body.MemoryID))
+		if err == sql.ErrNoRows {
+			return fuego.NotFoundError{Title: "Not Found", Detail: fmt.Sprintf("memory %q not found", body.MemoryID)}
+		}
+		if err != nil {
+			return dbError(err)
+		}
+		content := edit(current.Content, body.Text)
+		if len(content) > srv.cfg.MaxContentBytes {
+			return fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("content would be %d bytes, the maximum is %d", len(content), srv.cfg.MaxContentBytes)}
+		}
+		m, err = writeNewVersion(ctx, tx, current.Namespace, current.MemoryID, content, current.Tags, current.Metadata)
+		if err == nil {
+			pruned, err = pruneVersions(ctx, tx, current.Namespace, current.MemoryID, srv.cfg.MaxVersions)
+		}
+		if err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	memoryWrites.WithLabelValues("update").Inc()
+	srv.events.Publish(MemoryEvent{Type: "updated", Namespace: m.Namespace, MemoryID: m.MemoryID, Version: m.Version})
+	return &SavedMemoryResponse{Status: "updated", Memory: m, Pruned: pruned}, nil
+}
+
+// memoryETag identifies a stored memory version for HTTP caching.  The update time is included as in mutable
+// versioning mode a version's content can change without its number changing.
+func memoryETag(m Memory) string {
+	return fmt.Sprintf(`"%s-v%d-%x"`, m.MemoryID, m.Version, m.UpdatedAt.UnixNano())
+}
+
+// notModified reports whether a conditional GET can be answered with 304.  As per RFC 9110, If-Modified-Since is
+// ignored when If-None-Match is present.
+func notModified(ifNoneMatch, ifModifiedSince, etag string, updatedAt time.Time) bool {
+	if ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		// HTTP dates only have one second resolution
+		return err == nil && !updatedAt.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// backupPath works out where /backup writes to.  With a backup directory configured, requests can only name a file in
+// it (or leave it to be named after now), so API clients can't write anywhere else on the server.  Without one, the
+// request has to give the path.
+func (srv *Server) backupPath(requested string, now time.Time) (string, error) {
+	dir := srv.cfg.BackupDir
+	if dir == "" {
+		if requested == "" {
+			return "", fmt.Errorf("path is required when MEMORY_SERVER_BACKUP_DIR isn't set")
+		}
+		return filepath.Abs(requested)
+	}
+	if requested == "" {
+		requested = "memories-" + now.UTC().Format("20060102T150405.000Z") + ".sqlite"
+	}
+	if filepath.Base(requested) != requested || requested == "." || requested == ".." {
+		return "", fmt.Errorf("path must be a file name within the backup directory, got %q", requested)
+	}
+	return filepath.Join(dir, requested), nil
+}
+
+// isMemoryDSN reports whether a DSN refers to an in-memory SQLite database
+func isMemoryDSN(dsn string) bool {
+	return dsn == ":memory:" || strings.HasPrefix(dsn, "file::memory:") || strings.Contains(dsn, "mode=memory")
+}
+
+// sqliteDSN adds the connection settings we rely on to a SQLite DSN.  They're passed as DSN parameters rather
+// than PRAGMA statements so that every connection in the pool gets them, not just the first one:
+//   - WAL journaling, so readers don't block on the writer
+//   - a busy timeout, so writers wait for the lock instead of failing with "database is locked"
+//   - immediate transactions, so a transaction takes the write lock up front and can't deadlock upgrading a read
+func sqliteDSN(dsn string, busyTimeoutMS int) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", dsn, sep, busyTimeoutMS)
+}
+
+// OpenDB opens the database named by cfg.DSN with the connection settings the server relies on.  The schema isn't
+// touched, so Migrate needs calling before a Server uses it.
+func OpenDB(cfg Config) (*sql.DB, error) {
+	if isPostgresDSN(cfg.DSN) {
+		return openPostgres(cfg)
+	}
+	// A plain :memory: DSN gives every pooled connection its own empty database.  Using a named shared cache
+	// database instead means all connections see the same data, and a single connection keeps it alive.
+	dsn := cfg.DSN
+	inMemory := isMemoryDSN(dsn)
+	if dsn == ":memory:" {
+		dsn = "file::memory:?cache=shared"
+	}
+	slog.Info("Opening database", "dsn", dsn, "encrypted", len(cfg.EncryptionKey) > 0)
+	c, err := newContentCipher(cfg.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	db := sql.OpenDB(sqliteConnector{driver: newSQLiteDriver(c), dsn: sqliteDSN(dsn, int(cfg.BusyTimeout/time.Millisecond))})
+
+	// An in-memory database is lost when its last connection closes, and shared cache connections lock whole
+	// tables rather than waiting on busy_timeout, so these always use exactly one connection
+	maxOpenConns := cfg.MaxOpenConns
+	if inMemory {
+		maxOpenConns = 1
+	}
+	// WAL lets reads run alongside the (single) writer, so a small pool helps concurrent readers.  Idle connections
+	// are kept so their per-connection settings don't need re-establishing.
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+	return db, nil
+}
+
+// databaseSize returns the size of the main database in bytes, from its page count
+func databaseSize(ctx context.Context, db *sql.DB) (int64, error) {
+	var size int64
+	err := db.QueryRowContext(ctx, "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	return size, err
+}
+
+// statusRecorder captures the status code written by a handler, for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (eg for flushing)
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// notModifiedWriter discards the body fuego serialises after a handler has already sent 304 Not Modified, which
+// would otherwise fail (and be logged as an error) because 304 responses can't have a body
+type notModifiedWriter struct {
+	statusRecorder
+}
+
+func (w *notModifiedWriter) Write(b []byte) (int, error) {
+	if w.status == http.StatusNotModified {
+		return len(b), nil
+	}
+	return w.statusRecorder.Write(b)
+}
+
+// dropNotModifiedBody is route middleware for handlers which may answer with 304 Not Modified
+func dropNotModifiedBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&notModifiedWriter{statusRecorder{ResponseWriter: w}}, r)
+	})
+}
+
+// Prometheus metrics, registered with the default registry alongside the Go runtime and process collectors
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_server_http_requests_total",
+		Help: "HTTP requests handled, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "memory_server_http_request_duration_seconds",
+		Help:    "HTTP request latency, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	dbErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memory_server_db_errors_total",
+		Help: "Database operations which failed, causing a 500 response or a truncated export.",
+	})
+	memoryWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_server_memory_writes_total",
+		Help: "Memory versions saved, updated or deleted, and memories renamed.",
+	}, []string{"operation"})
+)
+
+// MemoryEvent is sent to /events subscribers whenever a memory is saved, updated or deleted
+type MemoryEvent struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+	MemoryID  string `json:"memory_id"`
+	Version   int    `json:"version,omitempty"`
+}
+
+// eventBroker fans out memory events to every connected /events client
+type eventBroker struct {
+	mu     sync.Mutex
+	subs   map[chan MemoryEvent]struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// Subscribe registers a new listener.  The returned function must be called to unsubscribe.
+func (b *eventBroker) Subscribe() (<-chan MemoryEvent, func()) {
+	ch := make(chan MemoryEvent, 64)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Publish sends an event to all subscribers.  A subscriber which has fallen too far behind misses the event
+// rather than holding up the write which caused it.
+func (b *eventBroker) Publish(ev MemoryEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			slog.Warn("Dropping event for slow /events subscriber", "type", ev.Type, "memory_id", ev.MemoryID)
+		}
+	}
+}
+
+// Done is closed once the broker shuts down
+func (b *eventBroker) Done() <-chan struct{} {
+	return b.done
+}
+
+// Close ends all event streams
+func (b *eventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// dbError counts a failed database operation and converts it into a 500 response
+func dbError(err error) error {
+	dbErrors.Inc()
+	return fuego.HTTPError{Status: http.StatusInternalServerError, Title: "Internal Server Error", Detail: err.Error()}
+}
+
+// requestMetrics records the count and latency of each request.  Routes are labelled by their pattern rather than
+// the actual path, so memory IDs don't each become a new time series.
+func requestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.Pattern
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// allowCORS lets browser pages from the given origins call the API.  "*" allows any origin.  Requests from other
+// origins get no CORS headers, so browsers keep blocking them.
+func allowCORS(origins []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(allowed[origin] || allowed["*"]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed, Last-Modified, Link, X-Request-ID")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Match, If-Modified-Since, If-None-Match, X-Request-ID")
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipMinBytes is the smallest response compressResponse will gzip, as compressing tiny bodies saves nothing
+const gzipMinBytes = 1024
+
+// compressResponse gzips responses of gzipMinBytes or more for clients which accept it.  The start of the body is
+// buffered until it's clear whether it's big enough, so small responses go out untouched.  Responses which already
+// have a Content-Encoding (such as /metrics) and streams which flush before reaching the threshold (such as
+// /events) are passed through as they are.
+func compressResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, ie lists it without q=0
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the header and the first gzipMinBytes of the body, then decides whether to compress
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool // Whether compression has been settled and the header sent
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= gzipMinBytes {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the header, compressed if compress is set and the handler hasn't encoded the body itself, followed by
+// anything buffered so far
+func (w *gzipResponseWriter) decide(compress bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if compress && w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Encoding", "gzip")
+		// The handler's length (if any) was for the uncompressed body
+		w.Header().Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// FlushError sends everything written so far.  A response which flushes before reaching gzipMinBytes is a stream,
+// and is left uncompressed so each flush reaches the client straight away.
+func (w *gzipResponseWriter) FlushError() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Flush is FlushError for handlers using http.Flusher
+func (w *gzipResponseWriter) Flush() {
+	w.FlushError()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the response, sending it uncompressed if it never reached gzipMinBytes
+func (w *gzipResponseWriter) Close() error {
+	if !w.decided {
+		return w.decide(false)
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+// requestIDKey is the context key holding the request ID
+type requestIDKey struct{}
+
+// RequestID returns the ID assigned to the request ctx belongs to, or "" outside of a request
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// maxRequestIDLength bounds client supplied X-Request-ID values, as they're echoed back and logged
+const maxRequestIDLength = 128
+
+// assignRequestID gives each request an ID, keeping the client's X-Request-ID if it sent a usable one, so a request
+// can be followed across logs.  The ID is echoed in the response headers and stored in the request context.
+func assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newUUID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether a client supplied request ID can be used as is.  Only printable ASCII without
+// spaces is accepted, so an ID can't break up a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// crockford is the base32 alphabet used by ULIDs, which leaves out I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48 bit millisecond timestamp followed by 80 random bits, as 26 base32 characters.  They
+// sort by creation time (to the millisecond) and are valid memory IDs.
+func newULID(t time.Time) string {
+	var b [16]byte
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	rand.Read(b[6:])
+	// Each character is 5 of the 128 bits, with the first padded by two zero bits at the front
+	var out [26]byte
+	for i := range out {
+		v := 0
+		for bit := i*5 - 2; bit < i*5+3; bit++ {
+			v <<= 1
+			if bit >= 0 && b[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out[:])
+}
+
+// markdownContentType is sent by /get-memory-by-id?format=markdown
+const markdownContentType = "text/markdown; charset=utf-8"
+
+// memoryMarkdown renders a memory as a Markdown document: its memory_id as the heading, then the content, then a
+// footer listing its tags when it has any
+func memoryMarkdown(m Memory) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%s\n", m.MemoryID, strings.TrimRight(m.Content, "\n"))
+	if len(m.Tags) > 0 {
+		quoted := make([]string, len(m.Tags))
+		for i, tag := range m.Tags {
+			quoted[i] = "`" + tag + "`"
+		}
+		fmt.Fprintf(&b, "\n---\n\nTags: %s\n", strings.Join(quoted, ", "))
+	}
+	return b.String()
+}
+
+// ndjsonContentType is negotiated through the Accept header by /list-memories and /export, which then stream one
+// memory per line instead of building a single JSON document
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsNDJSON reports whether the client asked for newline delimited JSON
+func wantsNDJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), ndjsonContentType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamNDJSON writes each memory as a line of JSON as list produces it, so the full result set is never held in
+// memory.  Once the first line is sent the status can't change, so a failure part way through is logged and leaves
+// the stream truncated.
+func streamNDJSON(w http.ResponseWriter, r *http.Request, list func(fn func(Memory) error) error) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	enc := json.NewEncoder(w)
+	var writeErr error
+	fields := requestedFields(r)
+	err := list(func(m Memory) error {
+		if fields == nil {
+			writeErr = enc.Encode(m)
+		} else if sparse, err := selectFields(m, fields); err != nil {
+			writeErr = err
+		} else {
+			writeErr = enc.Encode(sparse)
+		}
+		return writeErr
+	})
+	switch {
+	case writeErr != nil:
+		slog.DebugContext(r.Context(), "NDJSON write failed", "error", writeErr)
+	case err != nil:
+		slog.ErrorContext(r.Context(), "NDJSON listing failed", "error", err)
+	}
+}
+
+// eachRow returns a lister for streamNDJSON which scans the memories from rows
+func eachRow(rows *sql.Rows) func(fn func(Memory) error) error {
+	return func(fn func(Memory) error) error {
+		for rows.Next() {
+			m, err := scanMemory(rows)
+			if err != nil {
+				return dbError(err)
+			}
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return dbError(err)
+		}
+		return nil
+	}
+}
+
+// sendResponse serialises handler results as fuego normally would, except for responses a handler has already
+// written itself, as NDJSON or Markdown.  Memories are cut down to the fields parameter's fields when it's given.
+func sendResponse(w http.ResponseWriter, r *http.Request, ans any) error {
+	if ct := w.Header().Get("Content-Type"); ct == ndjsonContentType || ct == markdownContentType {
+		return nil
+	}
+	if fields := requestedFields(r); fields != nil {
+		var err error
+		if ans, err = sparseResponse(ans, fields); err != nil {
+			return err
+		}
+	}
+	return fuego.Send(w, r, ans)
+}
+
+// memoryFields are the JSON names of Memory's fields, which the fields parameter selects from
+var memoryFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(Memory{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// requestedFields returns the memory fields named by a request's comma separated fields parameter, or nil for every
+// field.  Unknown names are ignored, and if none of the names are known every field is returned.
+func requestedFields(r *http.Request) map[string]bool {
+	var fields map[string]bool
+	for _, name := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		if name = strings.TrimSpace(name); memoryFields[name] {
+			if fields == nil {
+				fields = make(map[string]bool)
+			}
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// selectFields returns m as a JSON object holding only the given fields
+func selectFields(m Memory, fields map[string]bool) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for name := range all {
+		if !fields[name] {
+			delete(all, name)
+		}
+	}
+	return all, nil
+}
+
+// sparseResponse applies selectFields to the memories in a handler's result.  Results without memories are returned
+// as they are.
+func sparseResponse(ans any, fields map[string]bool) (any, error) {
+	sparseList := func(memories []Memory) ([]map[string]json.RawMessage, error) {
+		list := make([]map[string]json.RawMessage, 0, len(memories))
+		for _, m := range memories {
+			sparse, err := selectFields(m, fields)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, sparse)
+		}
+		return list, nil
+	}
+	switch v := ans.(type) {
+	case *Memory:
+		if v != nil {
+			return selectFields(*v, fields)
+		}
+	case []Memory:
+		return sparseList(v)
+	case *SearchResponse:
+		if v != nil {
+			memories, err := sparseList(v.Memories)
+			if err != nil {
+				return nil, err
+			}
+			return struct {
+				Total    int                          `json:"total"`
+				Limit    int                          `json:"limit"`
+				Offset   int                          `json:"offset"`
+				Memories []map[string]json.RawMessage `json:"memories"`
+			}{v.Total, v.Limit, v.Offset, memories}, nil
+		}
+	}
+	return ans, nil
+}
+
+// LogHandler wraps h so records logged with a request's context include its request_id
+func LogHandler(h slog.Handler) slog.Handler {
+	return requestIDLogHandler{h}
+}
+
+// requestIDLogHandler is the slog.Handler returned by LogHandler
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h requestIDLogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
+
+// requestLogger logs the method, path, status and latency of each request
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		slog.InfoContext(r.Context(), "Request handled", "method", r.Method, "path", r.URL.Path, "status", rec.status, "latency", time.Since(start))
+	})
+}
+
+// logBodyLimit is the most of each request and response body logged by logBodies
+const logBodyLimit = 4096
+
+// logBodies logs the headers and body of each request and response at debug level, up to logBodyLimit bytes of
+// each body.  Only the start of the request body is read ahead, then put back in front of the rest, so handlers
+// still see all of it.  The Authorization header is redacted, as it holds the API key.
+func logBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		head, err := io.ReadAll(io.LimitReader(r.Body, logBodyLimit+1))
+		if err != nil {
+			sendError(w, r, fuego.BadRequestError{Title: "Bad Request", Detail: "could not read the request body"})
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		headers := r.Header.Clone()
+		if headers.Get("Authorization") != "" {
+			headers.Set("Authorization", "[redacted]")
+		}
+		slog.DebugContext(r.Context(), "Request body", "method", r.Method, "path", r.URL.Path, "headers", headers, "body", logBody(head))
+
+		rec := &bodyRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(rec, r)
+		slog.DebugContext(r.Context(), "Response body", "method", r.Method, "path", r.URL.Path, "status", rec.status, "headers", w.Header(), "body", logBody(rec.body.Bytes()))
+	})
+}
+
+// logBody formats a captured body for logging, noting when it was cut short
+func logBody(b []byte) string {
+	if len(b) > logBodyLimit {
+		return string(b[:logBodyLimit]) + "... (truncated)"
+	}
+	return string(b)
+}
+
+// bodyRecorder keeps the first logBodyLimit (plus one, to tell it was cut short) bytes written to a response
+type bodyRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if room := logBodyLimit + 1 - r.body.Len(); room > 0 {
+		r.body.Write(b[:min(len(b), room)])
+	}
+	return r.statusRecorder.Write(b)
+}
+
+// requireAPIKey rejects any request which could change data unless it carries key as a bearer token.  Reads are
+// left open, so the web interface and monitoring work without it.
+func requireAPIKey(key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					sendError(w, r, fuego.HTTPError{Status: http.StatusUnauthorized, Title: "Unauthorized", Detail: "a valid API key is required"})
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimiter is a token bucket per client.  Each bucket holds up to burst tokens and refills at rate per second.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiterMaxIdle is how many buckets may be tracked before full (idle) ones are dropped
+const rateLimiterMaxIdle = 10000
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: math.Max(1, math.Ceil(rate)), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the client's bucket.  When the bucket is empty it returns false along with how long
+// until the next token is available.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= rateLimiterMaxIdle {
+			l.dropFull(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// dropFull forgets clients whose buckets have refilled, as they're indistinguishable from new ones
+func (l *rateLimiter) dropFull(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// limitWrites rate limits requests which can change data, per client.  Requests bearing the API key share its
+// bucket, everything else is limited by client IP.  Reads aren't limited.
+func limitWrites(limiter *rateLimiter, key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if key != "" && ok && subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+				client = "api key"
+			}
+			if ok, wait := limiter.allow(client, time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				sendError(w, r, fuego.HTTPError{Status: http.StatusTooManyRequests, Title: "Too Many Requests", Detail: "rate limit exceeded, retry later"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sameTags reports whether a and b hold the same tags, in any order
+func sameTags(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// tagsMissingFrom returns the tags in tags which aren't in other, in their original order.  Never nil, so it
+// serialises as an empty list.
+func tagsMissingFrom(tags, other []string) []string {
+	missing := []string{}
+	for _, tag := range tags {
+		if !slices.Contains(other, tag) {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// firstCreatedAt returns the created_at of the earliest stored version of a memory, or fallback if the memory_id
+// has never been seen before
+func firstCreatedAt(ctx context.Context, q queryRower, namespace, memoryID string, fallback time.Time) (time.Time, error) {
+	var createdAt time.Time
+	err := q.QueryRowContext(ctx, "SELECT created_at FROM memories WHERE namespace = ? AND memory_id = ? ORDER BY created_at ASC LIMIT 1", namespace, memoryID).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return fallback, nil
+	}
+	return createdAt.UTC(), err
+}
+
+// validateMemoryInput checks the fields of a memory being saved or updated, returning the tags normalised and with
+// duplicates removed (keeping the first occurrence of each)
+func (srv *Server) validateMemoryInput(memoryID, content string, tags []string) ([]string, error) {
+	if err := validateMemoryID("memory_id", memoryID); err != nil {
+		return nil, err
+	}
+	if content == "" {
+		return nil, fmt.Errorf("content is required")
+	}
+	if len(content) > srv.cfg.MaxContentBytes {
+		return nil, fmt.Errorf("content is %d bytes, the maximum is %d", len(content), srv.cfg.MaxContentBytes)
+	}
+	// Tags are always stored as a JSON array, never null
+	if tags == nil {
+		return []string{}, nil
+	}
+	seen := make(map[string]bool, len(tags))
+	deduped := make([]string, 0, len(tags))
+	for i, given := range tags {
+		tag, err := srv.normalizeTag(given)
+		if err == nil {
+			err = checkTagCharacters(tag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tag %d (%q) %s", i, given, err.Error())
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		deduped = append(deduped, tag)
+	}
+	if len(deduped) > srv.cfg.MaxTags {
+		return nil, fmt.Errorf("%d tags given, the maximum is %d", len(deduped), srv.cfg.MaxTags)
+	}
+	return deduped, nil
+}
+
+// normalizeContent trims surrounding whitespace from content and converts it to Unicode NFC when NormalizeContent is
+// on, so the same text typed or pasted differently is stored (and searched) the same way.  Whitespace inside the
+// content is left alone.
+func (srv *Server) normalizeContent(content string) string {
+	if !srv.cfg.NormalizeContent {
+		return content
+	}
+	return norm.NFC.String(strings.TrimSpace(content))
+}
+
+// normalizeTag checks a single tag, first trimming and lower casing it when NormalizeTags is on.  Errors describe
+// the problem without naming the tag, so callers can say which one it was.
+func (srv *Server) normalizeTag(tag string) (string, error) {
+	if srv.cfg.NormalizeTags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+	}
+	if tag == "" {
+		return "", fmt.Errorf("is empty")
+	}
+	if n := utf8.RuneCountInString(tag); n > srv.cfg.MaxTagLength {
+		return "", fmt.Errorf("is %d characters, the maximum is %d", n, srv.cfg.MaxTagLength)
+	}
+	return tag, nil
+}
+
+// checkTagCharacters rejects tags with control characters, which break rendering in the web interface, or commas,
+// so tags can always be written as a comma separated list (eg in configuration) without being split apart.  It's
+// only applied when tags are written, so existing tags can still be looked up and removed.
+func checkTagCharacters(tag string) error {
+	if i := strings.IndexFunc(tag, unicode.IsControl); i >= 0 {
+		r, _ := utf8.DecodeRuneInString(tag[i:])
+		return fmt.Errorf("contains the control character %U", r)
+	}
+	if strings.Contains(tag, ",") {
+		return fmt.Errorf("contains a comma")
+	}
+	return nil
+}
+
+// normalizeMetadata checks metadata is a JSON object, returning it compacted.  Missing or null metadata becomes {}.
+func normalizeMetadata(raw json.RawMessage) (json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return json.RawMessage("{}"), nil
+	}
+	if trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil, fmt.Errorf("metadata must be a JSON object")
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, trimmed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// validateMetadata normalises client supplied metadata, then checks it against the configured MetadataSchema if
+// there is one.  Imports skip the schema, so backups taken before it was set can still be restored.
+func (srv *Server) validateMetadata(raw json.RawMessage) (json.RawMessage, error) {
+	metadata, err := normalizeMetadata(raw)
+	if err != nil || srv.cfg.MetadataSchema == nil {
+		return metadata, err
+	}
+	if err := srv.cfg.MetadataSchema.Validate(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// validateMemoryID checks a memory_id against memoryIDPattern, using field to name it in the error
+func validateMemoryID(field, memoryID string) error {
+	if memoryID == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+	if !memoryIDPattern.MatchString(memoryID) {
+		return fmt.Errorf("%s must be 1-128 characters of A-Z, a-z, 0-9, '.', '_' or '-'", field)
+	}
+	return nil
+}
+
+// defaultNamespace holds memories saved without a namespace, including everything from before namespaces existed
+const defaultNamespace = "default"
+
+// namespaceOption documents the namespace query parameter on the routes reading memories
+var namespaceOption = fuego.OptionQuery("namespace", "Namespace to read from (default 'default')")
+
+// resolveNamespace returns the namespace a request applies to, defaultNamespace when none was given.  Namespaces
+// follow the same rules as memory IDs.
+func resolveNamespace(namespace string) (string, error) {
+	if namespace == "" {
+		return defaultNamespace, nil
+	}
+	if err := validateMemoryID("namespace", namespace); err != nil {
+		return "", err
+	}
+	return namespace, nil
+}
+
+// Columns /list-memories may be sorted by.  Only these are ever placed into the ORDER BY clause.
+var listSortColumns = map[string]string{
+	"memory_id":  "memory_id",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// Row filters for the /list-memories archived parameter.  'active' and 'archived' return every matching row, while
+// 'all' returns only the newest version of each memory_id whether it's archived or not, so a deleted memory appears
+// once rather than once per version.
+var listArchivedFilters = map[string]string{
+	"active":   "archived=0",
+	"archived": "archived=1",
+	"all":      "version = (SELECT MAX(o.version) FROM memories o WHERE o.namespace = memories.namespace AND o.memory_id = memories.memory_id)",
+}
+
+// parseListQuery reads the /list-memories query parameters, other than the namespace.  The defaults list the
+// active memories in the original memory_id then version DESC order.
+func parseListQuery(param func(name string) string) (ListQuery, error) {
+	q := ListQuery{Sort: param("sort"), Archived: param("archived")}
+	if q.Sort == "" {
+		q.Sort = "memory_id"
+	}
+	if _, ok := listSortColumns[q.Sort]; !ok {
+		return q, fmt.Errorf("sort must be one of 'memory_id', 'created_at' or 'updated_at'")
+	}
+	switch strings.ToLower(param("order")) {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, fmt.Errorf("order must be 'asc' or 'desc'")
+	}
+	if q.Archived == "" {
+		q.Archived = "active"
+	}
+	if _, ok := listArchivedFilters[q.Archived]; !ok {
+		return q, fmt.Errorf("archived must be one of 'active', 'archived' or 'all'")
+	}
+	var err error
+	q.Dates, err = parseDateRange(param)
+	return q, err
+}
+
+// listOrderBy builds the ORDER BY clause for a ListQuery
+func listOrderBy(q ListQuery) string {
+	col, dir := listSortColumns[q.Sort], "ASC"
+	if q.Descending {
+		dir = "DESC"
+	}
+	// Pinned memories come first whichever way the rest are sorted
+	if col == "memory_id" {
+		return "pinned DESC, memory_id " + dir + ", version DESC"
+	}
+	// Timestamps are stored as UTC strings, which sort chronologically.  memory_id breaks ties.
+	return "pinned DESC, " + col + " " + dir + ", memory_id, version DESC"
+}
+
+// snippetLength is roughly how many characters of content a search snippet shows around the first match
+const snippetLength = 200
+
+// highlightSnippet returns about snippetLength characters of content around the first case-insensitive match of any
+// of terms, with every match in it wrapped in markStart and markEnd.  Without a match the start of the content is used.
+// Cut off ends are marked with "…", and with escape the content is HTML escaped (but markStart and markEnd aren't).
+func highlightSnippet(content string, terms []string, markStart, markEnd string, escape bool) string {
+	var quoted []string
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	var matches [][]int
+	var re *regexp.Regexp
+	if len(quoted) > 0 {
+		// Longest first, so a term containing another is marked as a whole
+		sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+		re = regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+		matches = re.FindAllStringIndex(content, -1)
+	}
+
+	// Centre the window on the first match, measured in runes so multi-byte characters aren't split
+	runes := []rune(content)
+	start := 0
+	if len(matches) > 0 {
+		matchStart := utf8.RuneCountInString(content[:matches[0][0]])
+		matchLen := utf8.RuneCountInString(content[matches[0][0]:matches[0][1]])
+		start = max(0, matchStart-max(0, snippetLength-matchLen)/2)
+	}
+	end := min(len(runes), start+snippetLength)
+	start = max(0, min(start, end-snippetLength))
+	window := string(runes[start:end])
+
+	esc := func(s string) string { return s }
+	if escape {
+		esc = html.EscapeString
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	last := 0
+	if re != nil {
+		for _, m := range re.FindAllStringIndex(window, -1) {
+			b.WriteString(esc(window[last:m[0]]))
+			b.WriteString(markStart)
+			b.WriteString(esc(window[m[0]:m[1]]))
+			b.WriteString(markEnd)
+			last = m[1]
+		}
+	}
+	b.WriteString(esc(window[last:]))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// searchQuery is a parsed /search-memories query.  Text is matched against memory_id and content, each Content
+// term against content only, and each Tags entry must be one of the memory's tags.
+type searchQuery struct {
+	Text    string
+	Content []string
+	Tags    []string
+}
+
+// parseSearchQuery splits field scoped terms (tag:x, content:x) out of a search query.  Values may be double
+// quoted to include spaces, with \" for a literal quote.  The remaining bare words form Text, so a query without
+// any scoped terms is searched for exactly as given.
+func parseSearchQuery(q string) searchQuery {
+	var sq searchQuery
+	var bare []string
+	scoped := false
+	for _, token := range splitSearchTokens(q) {
+		switch {
+		case strings.HasPrefix(strings.ToLower(token), "tag:"):
+			scoped = true
+			if v := token[len("tag:"):]; v != "" {
+				sq.Tags = append(sq.Tags, v)
+			}
+		case strings.HasPrefix(strings.ToLower(token), "content:"):
+			scoped = true
+			if v := token[len("content:"):]; v != "" {
+				sq.Content = append(sq.Content, v)
+			}
+		default:
+			bare = append(bare, token)
+		}
+	}
+	if !scoped {
+		sq.Text = q
+		return sq
+	}
+	sq.Text = strings.Join(bare, " ")
+	return sq
+}
+
+// splitSearchTokens splits on whitespace, keeping double quoted sections (which lose their quotes) together
+func splitSearchTokens(q string) []string {
+	var tokens []string
+	var cur strings.Builder
+	inToken, inQuotes := false, false
+	for i := 0; i < len(q); i++ {
+		ch := q[i]
+		switch {
+		case inQuotes && ch == '\\' && i+1 < len(q) && (q[i+1] == '"' || q[i+1] == '\\'):
+			i++
+			cur.WriteByte(q[i])
+		case ch == '"':
+			inQuotes = !inQuotes
+			inToken = true
+		case !inQuotes && (ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'):
+			if inToken {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			cur.WriteByte(ch)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// likeEscaper escapes LIKE's wildcards, so user input only ever matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// textMatch builds a predicate matching term against any of the given columns, using the search mode
+func textMatch(mode, term string, columns ...string) (string, []interface{}, error) {
+	var op string
+	var arg interface{}
+	switch mode {
+	case "", "substring":
+		// LIKE is case-insensitive for ASCII in SQLite
+		op = `LIKE ? ESCAPE '\'`
+		arg = "%" + likeEscaper.Replace(term) + "%"
+	case "word":
+		op = "REGEXP ?"
+		arg = `(?i)\b` + regexp.QuoteMeta(term) + `\b`
+	case "exact":
+		op = "= ?"
+		arg = term
+	default:
+		return "", nil, fmt.Errorf("mode must be one of 'substring', 'word' or 'exact'")
+	}
+	preds := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, col := range columns {
+		preds[i] = col + " " + op
+		args[i] = arg
+	}
+	return "(" + strings.Join(preds, " OR ") + ")", args, nil
+}
+
+// searchFilter builds the WHERE predicates for a parsed search, all of which must match
+func searchFilter(sq searchQuery, mode string) (string, []interface{}, error) {
+	var preds []string
+	var args []interface{}
+	// Bare text is always applied when there's nothing else, so an empty query still validates the mode
+	if sq.Text != "" || (len(sq.Content) == 0 && len(sq.Tags) == 0) {
+		pred, a, err := textMatch(mode, sq.Text, "memory_id", "content")
+		if err != nil {
+			return "", nil, err
+		}
+		preds = append(preds, pred)
+		args = append(args, a...)
+	}
+	for _, term := range sq.Content {
+		pred, a, err := textMatch(mode, term, "content")
+		if err != nil {
+			return "", nil, err
+		}
+		preds = append(preds, pred)
+		args = append(args, a...)
+	}
+	tagPreds, tagArgs := tagFilter(sq.Tags)
+	preds = append(preds, tagPreds...)
+	args = append(args, tagArgs...)
+	return strings.Join(preds, " AND "), args, nil
+}
+
+// tagFilter builds a predicate for each tag a memory must have
+func tagFilter(tags []string) ([]string, []interface{}) {
+	var preds []string
+	var args []interface{}
+	for _, tag := range tags {
+		preds = append(preds, "EXISTS (SELECT 1 FROM json_each(CAST(tags AS TEXT)) WHERE value = ?)")
+		args = append(args, tag)
+	}
+	return preds, args
+}
+
+// Bounds for the /search-memories max_distance parameter
+const (
+	defaultFuzzyDistance = 2
+	maxFuzzyDistance     = 5
+)
+
+// fuzzyMatch scores a memory against the words of a fuzzy search.  Each word of the bare text must be within
+// maxDistance edits of some word in the memory_id or content, and each word of the content terms within maxDistance
+// of a word in the content.  The score is the total of those distances, so lower is better.
+func fuzzyMatch(sq searchQuery, m Memory, maxDistance int) (int, bool) {
+	idWords := searchWords(m.MemoryID)
+	contentWords := searchWords(m.Content)
+	total := 0
+	check := func(words []string, candidates ...[]string) bool {
+		for _, w := range words {
+			best := maxDistance + 1
+			for _, list := range candidates {
+				for _, c := range list {
+					if d := levenshtein(w, c, best); d < best {
+						best = d
+					}
+				}
+			}
+			if best > maxDistance {
+				return false
+			}
+			total += best
+		}
+		return true
+	}
+	if !check(searchWords(sq.Text), idWords, contentWords) {
+		return 0, false
+	}
+	for _, term := range sq.Content {
+		if !check(searchWords(term), contentWords) {
+			return 0, false
+		}
+	}
+	return total, true
+}
+
+// searchWords splits text into lower case words, treating anything other than letters and digits as a separator
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// levenshtein returns the edit distance between a and b, counting runes.  Once the distance is known to be at
+// least limit it stops early and returns limit.
+func levenshtein(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if diff := len(ra) - len(rb); diff >= limit || -diff >= limit {
+		return limit
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin >= limit {
+			return limit
+		}
+		prev, cur = cur, prev
+	}
+	return min(prev[len(rb)], limit)
+}
+
+// dateRangeOptions documents the date range query parameters on the routes accepting them
+var dateRangeOptions = fuego.GroupOptions(
+	fuego.OptionQuery("created_after", "Only memories created after this RFC3339 time"),
+	fuego.OptionQuery("created_before", "Only memories created before this RFC3339 time"),
+	fuego.OptionQuery("updated_after", "Only memories updated after this RFC3339 time"),
+	fuego.OptionQuery("updated_before", "Only memories updated before this RFC3339 time"),
+)
+
+// truncateOption documents the truncate query parameter on the routes listing memories
+var truncateOption = fuego.OptionQueryInt("truncate", "Return at most this many bytes of each memory's content, with truncated and content_length set.  Fetch the rest with /get-memory-by-id")
+
+// fieldsOption documents the fields query parameter, which sendResponse applies
+var fieldsOption = fuego.OptionQuery("fields", "Comma separated memory fields to return, eg memory_id,content.  Unknown names are ignored")
+
+// queryTruncate reads the truncate query parameter, 0 (the default) meaning content isn't truncated
+func queryTruncate(param func(name string) string) (int, error) {
+	n, err := queryInt(param, "truncate", 0)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("truncate must not be negative, got %d", n)}
+	}
+	return n, nil
+}
+
+// truncate cuts the content down to at most n bytes, backing off to the start of a character rather than splitting
+// one, and records the full length.  An n of 0 leaves the memory unchanged.
+func (m *Memory) truncate(n int) {
+	if n == 0 {
+		return
+	}
+	m.ContentLength = len(m.Content)
+	if len(m.Content) <= n {
+		return
+	}
+	for n > 0 && !utf8.RuneStart(m.Content[n]) {
+		n--
+	}
+	m.Content, m.Truncated = m.Content[:n], true
+}
+
+// paginationLinks builds a Link header (RFC 8288) to the first, previous, next and last pages of a paginated
+// request, keeping its other query parameters.  The URLs are relative to the host, so they work behind a proxy.
+func paginationLinks(u *url.URL, limit, offset, total int) string {
+	link := func(rel string, offset int) string {
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(offset))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, q.Encode(), rel)
+	}
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+	links := []string{link("first", 0)}
+	if offset > 0 {
+		links = append(links, link("prev", max(offset-limit, 0)))
+	}
+	if offset+limit < total {
+		links = append(links, link("next", offset+limit))
+	}
+	return strings.Join(append(links, link("last", last)), ", ")
+}
+
+// parsePagination reads the limit and offset query parameters.  Missing values fall back to the defaults, the limit
+// is clamped to 1..maxPageLimit, and negative offsets become 0.  Values which aren't integers are a 400.
+func parsePagination(param func(name string) string) (limit, offset int, err error) {
+	if limit, err = queryInt(param, "limit", defaultPageLimit); err != nil {
+		return 0, 0, err
+	}
+	if offset, err = queryInt(param, "offset", 0); err != nil {
+		return 0, 0, err
+	}
+	return min(max(limit, 1), maxPageLimit), max(offset, 0), nil
+}
+
+// queryInt reads an optional integer query parameter, returning def when it's absent.  Anything else is a 400
+// naming the parameter, rather than being quietly replaced by the default.
+func queryInt(param func(name string) string, name string, def int) (int, error) {
+	v := param(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("%s must be an integer, got %q", name, v)}
+	}
+	return n, nil
+}
+
+// queryNamespace reads the namespace query parameter through resolveNamespace, with invalid values a 400
+func queryNamespace(param func(name string) string) (string, error) {
+	namespace, err := resolveNamespace(param("namespace"))
+	if err != nil {
+		return "", fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	return namespace, nil
+}
+
+// queryBool reads an optional boolean query parameter ("true", "false", "1", "0" etc), false when absent.  Anything
+// else is a 400 naming the parameter.
+func queryBool(param func(name string) string, name string) (bool, error) {
+	v := param(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fuego.BadRequestError{Title: "Bad Request", Detail: fmt.Sprintf("%s must be true or false, got %q", name, v)}
+	}
+	return b, nil
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-fuego/fuego"
+)
+
+// sqliteStore is the Store for the server's SQLite database.  Writes go through the server's write queue.
+type sqliteStore struct {
+	db          *sql.DB
+	writes      *writeQueue
+	versioning  Versioning
+	maxVersions int
+}
+
+func (st *sqliteStore) SaveMemory(ctx context.Context, in MemoryInput, cond SaveCondition) (WriteResult, error) {
+	// Versions are unique per memory_id.  Saves through this server are serialised by the write queue, but if
+	// another process sharing the database took the next version first this retries with the one after it.
+	res := WriteResult{Changed: true}
+	for attempt := 1; ; attempt++ {
+		err := st.writes.Write(ctx, func(tx *sql.Tx) error {
+			if cond != SaveAlways {
+				var exists bool
+				if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM memories WHERE namespace=? AND memory_id=? AND archived=0)", in.Namespace, in.MemoryID).Scan(&exists); err != nil {
+					return dbError(err)
+				}
+				if cond == SaveIfExists && !exists {
+					return fuego.HTTPError{Status: http.StatusPreconditionFailed, Title: "Precondition Failed", Detail: fmt.Sprintf("memory %q doesn't exist", in.MemoryID)}
+				}
+				if cond == SaveIfAbsent && exists {
+					return fuego.HTTPError{Status: http.StatusPreconditionFailed, Title: "Precondition Failed", Detail: fmt.Sprintf("memory %q already exists", in.MemoryID)}
+				}
+			}
+			var err error
+			res.Memory, err = insertNextVersion(ctx, tx, in.Namespace, in.MemoryID, in.Content, in.Tags, in.Metadata)
+			if err == nil {
+				res.Pruned, err = pruneVersions(ctx, tx, in.Namespace, in.MemoryID, st.maxVersions)
+			}
+			if err != nil && !isUniqueViolation(err) {
+				return dbError(err)
+			}
+			return err
+		})
+		if err == nil {
+			return res, nil
+		}
+		if !isUniqueViolation(err) {
+			return WriteResult{}, err
+		}
+		if attempt == saveAttempts {
+			return WriteResult{}, fuego.ConflictError{Title: "Conflict", Detail: fmt.Sprintf("memory %q is being saved concurrently, please retry", in.MemoryID)}
+		}
+	}
+}
+
+func (st *sqliteStore) UpdateMemory(ctx context.Context, in MemoryInput, opts UpdateOptions) (WriteResult, error) {
+	res := WriteResult{Changed: true}
+	err := st.writes.Write(ctx, func(tx *sql.Tx) error {
+		current, err := scanMemory(tx.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND archived=0 ORDER BY version DESC LIMIT 1`, in.Namespace, in.MemoryID))
+		if err != nil && err != sql.ErrNoRows {
+			return dbError(err)
+		}
+		if opts.ExpectedVersion != nil && current.Version != *opts.ExpectedVersion {
+			return fuego.ConflictError{Title: "Conflict", Detail: fmt.Sprintf("expected version %d but the current version is %d", *opts.ExpectedVersion, current.Version)}
+		}
+		// An update identical to the latest version would only clutter the history
+		if err == nil && !opts.Force && current.Content == in.Content && sameTags(current.Tags, in.Tags) && bytes.Equal(current.Metadata, in.Metadata) {
+			res.Memory, res.Changed = current, false
+			return nil
+		}
+		if err == nil && st.versioning == VersioningMutable {
+			res.Memory, err = overwriteVersion(ctx, tx, current.ID, in.Content, in.Tags, in.Metadata)
+		} else {
+			res.Memory, err = writeNewVersion(ctx, tx, in.Namespace, in.MemoryID, in.Content, in.Tags, in.Metadata)
+		}
+		if err == nil {
+			res.Pruned, err = pruneVersions(ctx, tx, in.Namespace, in.MemoryID, st.maxVersions)
+		}
+		if err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (st *sqliteStore) DeleteMemory(ctx context.Context, namespace, memoryID string, dryRun bool) (int64, error) {
+	var n int64
+	if dryRun {
+		if err := st.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memories WHERE namespace=? AND memory_id=? AND archived=0", namespace, memoryID).Scan(&n); err != nil {
+			return 0, dbError(err)
+		}
+		return n, nil
+	}
+	err := st.writes.Write(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE memories SET archived=1 WHERE namespace=? AND memory_id=? AND archived=0", namespace, memoryID)
+		if err != nil {
+			return dbError(err)
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// listWhere builds the WHERE clause selecting the memories for a ListQuery
+func (st *sqliteStore) listWhere(q ListQuery) (string, []interface{}) {
+	dateWhere, args := q.Dates.sqlFilter()
+	return "namespace=? AND " + listArchivedFilters[q.Archived] + dateWhere, append([]interface{}{q.Namespace}, args...)
+}
+
+func (st *sqliteStore) ListMemories(ctx context.Context, q ListQuery, fn func(Memory) error) error {
+	where, args := st.listWhere(q)
+	query := `SELECT ` + memoryColumns + ` FROM memories WHERE ` + where + ` ORDER BY ` + listOrderBy(q)
+	if q.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, q.Limit, q.Offset)
+	}
+	rows, err := st.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return dbError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanMemory(rows)
+		if err != nil {
+			return dbError(err)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
+
+func (st *sqliteStore) CountMemories(ctx context.Context, q ListQuery) (int, error) {
+	where, args := st.listWhere(q)
+	var n int
+	if err := st.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memories WHERE "+where, args...).Scan(&n); err != nil {
+		return 0, dbError(err)
+	}
+	return n, nil
+}
+
+func (st *sqliteStore) GetByID(ctx context.Context, namespace, memoryID string) (Memory, error) {
+	m, err := scanMemory(st.db.QueryRowContext(ctx, `SELECT `+memoryColumns+` FROM memories WHERE namespace=? AND memory_id=? AND archived=0 ORDER BY version DESC LIMIT 1`, namespace, memoryID))
+	if err == sql.ErrNoRows {
+		return Memory{}, fuego.NotFoundError{Title: "Not Found", Detail: "not found"}
+	}
+	if err != nil {
+		return Memory{}, dbError(err)
+	}
+	return m, nil
+}
+
+func (st *sqliteStore) Search(ctx context.Context, q SearchQuery) ([]Memory, int, error) {
+	if q.Fuzzy {
+		return st.fuzzySearch(ctx, q)
+	}
+	// The count and the page must use the same WHERE clause, so the total stays consistent with the results
+	match, args, err := searchFilter(q.searchQuery, q.Mode)
+	if err != nil {
+		return nil, 0, fuego.BadRequestError{Title: "Bad Request", Detail: err.Error()}
+	}
+	dateWhere, dateArgs := q.Dates.sqlFilter()
+	where := "archived=0 AND namespace=? AND " + match + dateWhere
+	args = append(append([]interface{}{q.Namespace}, args...), dateArgs...)
+	var total int
+	if err := st.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memories WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, dbError(err)
+	}
+	memories, err := st.queryMemories(ctx, `SELECT `+memoryColumns+` FROM memories WHERE `+where+` ORDER BY memory_id, version DESC LIMIT ? OFFSET ?`, append(args, q.Limit, q.Offset)...)
+	return memories, total, err
+}
+
+// fuzzySearch answers a fuzzy search.  SQLite has no edit distance function without the spellfix extension, so
+// every active row passing the tag and date filters is scored in Go, and results come back closest first.  This
+// reads all the candidate rows on each search, so it's much slower than a plain search on a large database.
+func (st *sqliteStore) fuzzySearch(ctx context.Context, q SearchQuery) ([]Memory, int, error) {
+	dateWhere, args := q.Dates.sqlFilter()
+	where := "archived=0 AND namespace=?" + dateWhere
+	args = append([]interface{}{q.Namespace}, args...)
+	tagPreds, tagArgs := tagFilter(q.Tags)
+	for _, pred := range tagPreds {
+		where += " AND " + pred
+	}
+	args = append(args, tagArgs...)
+	candidates, err := st.queryMemories(ctx, `SELECT `+memoryColumns+` FROM memories WHERE `+where+` ORDER BY memory_id, version DESC`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	type scored struct {
+		m        Memory
+		distance int
+	}
+	var matches []scored
+	for _, m := range candidates {
+		if d, ok := fuzzyMatch(q.searchQuery, m, q.MaxDistance); ok {
+			matches = append(matches, scored{m, d})
+		}
+	}
+	// Stable, so equally close matches keep the usual memory_id order
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+	var memories []Memory
+	for i := q.Offset; i < len(matches) && i < q.Offset+q.Limit; i++ {
+		memories = append(memories, matches[i].m)
+	}
+	return memories, len(matches), nil
+}
+
+func (st *sqliteStore) ListByTag(ctx context.Context, namespace, tag string, caseInsensitive bool) ([]Memory, error) {
+	// SQLite's LOWER only folds ASCII letters
+	match := "value = ?"
+	if caseInsensitive {
+		match = "LOWER(value) = LOWER(?)"
+	}
+	return st.queryMemories(ctx, `SELECT `+memoryColumns+` FROM memories
+		WHERE namespace=? AND archived=0 AND EXISTS (SELECT 1 FROM json_each(CAST(tags AS TEXT)) WHERE `+match+`)
+		ORDER BY memory_id, version DESC`, namespace, tag)
+}
+
+// queryMemories runs a query selecting memoryColumns, returning every row
+func (st *sqliteStore) queryMemories(ctx context.Context, query string, args ...interface{}) ([]Memory, error) {
+	rows, err := st.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+	var memories []Memory
+	for rows.Next() {
+		m, err := scanMemory(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		memories = append(memories, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+	return memories, nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Store is the storage behind the core memory endpoints: saving, updating, deleting, listing, fetching and
+// searching memories.  Their handlers only parse requests and shape responses, leaving the queries to the Store, so
+// other backends can be added by implementing it.  Errors come back ready to send, as fuego errors carrying the
+// status (eg a fuego.NotFoundError for an unknown memory), with database failures as 500s.
+type Store interface {
+	// SaveMemory stores a new active version of a memory, numbered after its latest one
+	SaveMemory(ctx context.Context, in MemoryInput, cond SaveCondition) (WriteResult, error)
+	// UpdateMemory replaces the latest version of a memory, leaving Changed false instead of writing anything when
+	// the update is identical to it
+	UpdateMemory(ctx context.Context, in MemoryInput, opts UpdateOptions) (WriteResult, error)
+	// DeleteMemory archives every version of a memory, returning how many active versions were (or with dryRun,
+	// would be) archived
+	DeleteMemory(ctx context.Context, namespace, memoryID string, dryRun bool) (int64, error)
+	// ListMemories calls fn with each memory matching q in order, stopping at the first error
+	ListMemories(ctx context.Context, q ListQuery, fn func(Memory) error) error
+	// CountMemories returns how many memories match q, ignoring its Limit and Offset
+	CountMemories(ctx context.Context, q ListQuery) (int, error)
+	// GetByID returns the latest active version of a memory
+	GetByID(ctx context.Context, namespace, memoryID string) (Memory, error)
+	// Search returns a page of the active memories matching q, along with how many match in total
+	Search(ctx context.Context, q SearchQuery) ([]Memory, int, error)
+	// ListByTag returns the active memories with a tag
+	ListByTag(ctx context.Context, namespace, tag string, caseInsensitive bool) ([]Memory, error)
+}
+
+// MemoryInput is the content of a memory version being written, already validated
+type MemoryInput struct {
+	Namespace string
+	MemoryID  string
+	Content   string
+	Tags      []string
+	Metadata  json.RawMessage
+}
+
+// WriteResult is the outcome of a save or update
+type WriteResult struct {
+	Memory  Memory
+	Changed bool  // False when an update was identical to the latest version, so nothing was written
+	Pruned  int64 // Old archived versions deleted to keep the memory within MaxVersions
+}
+
+// SaveCondition restricts a save to memories which do or don't already exist
+type SaveCondition int
+
+const (
+	SaveAlways   SaveCondition = iota
+	SaveIfExists               // Only save over a memory with an active version (If-Match: *)
+	SaveIfAbsent               // Only save a memory without an active version (If-None-Match: *)
+)
+
+// UpdateOptions are the optional parts of an update
+type UpdateOptions struct {
+	ExpectedVersion *int // When set, the update fails with a 409 unless this is the latest version
+	Force           bool // Write a new version even if it's identical to the latest one
+}
+
+// ListQuery selects and orders the memories for /list-memories.  Its values are checked by parseListQuery.
+type ListQuery struct {
+	Namespace  string
+	Sort       string // memory_id, created_at or updated_at
+	Descending bool
+	Archived   string // active, archived or all
+	Dates      DateRange
+	Limit      int // Most memories to list, 0 for all of them
+	Offset     int
+}
+
+// SearchQuery is a /search-memories request.  Mode is checked by the Store, as fuzzy searches can't have one.
+type SearchQuery struct {
+	searchQuery
+	Namespace   string
+	Mode        string
+	Fuzzy       bool
+	MaxDistance int // Most edits allowed per word in a fuzzy search
+	Dates       DateRange
+	Limit       int
+	Offset      int
+}
+
+// DateRange bounds the creation and update times of the memories returned.  Zero times are unbounded.
+type DateRange struct {
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+}
+
+// dateRangeParams maps the date range query parameters to their DateRange field and the SQL comparison each applies
+var dateRangeParams = []struct {
+	name, predicate string
+	field           func(*DateRange) *time.Time
+}{
+	{"created_after", "created_at > ?", func(r *DateRange) *time.Time { return &r.CreatedAfter }},
+	{"created_before", "created_at < ?", func(r *DateRange) *time.Time { return &r.CreatedBefore }},
+	{"updated_after", "updated_at > ?", func(r *DateRange) *time.Time { return &r.UpdatedAfter }},
+	{"updated_before", "updated_at < ?", func(r *DateRange) *time.Time { return &r.UpdatedBefore }},
+}
+
+// parseDateRange reads whichever date range parameters are present, returning an error for any which aren't valid
+// RFC3339
+func parseDateRange(param func(name string) string) (DateRange, error) {
+	var r DateRange
+	for _, p := range dateRangeParams {
+		v := param(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return DateRange{}, fmt.Errorf("%s must be an RFC3339 timestamp, got %q", p.name, v)
+		}
+		*p.field(&r) = t
+	}
+	return r, nil
+}
+
+// sqlFilter builds the " AND ..." predicates for the bounds which are set
+func (r DateRange) sqlFilter() (string, []interface{}) {
+	var where string
+	var args []interface{}
+	for _, p := range dateRangeParams {
+		t := *p.field(&r)
+		if t.IsZero() {
+			continue
+		}
+		// Stored timestamps are UTC strings, so the bound must be UTC too for the comparison to hold
+		where += " AND " + p.predicate
+		args = append(args, t.UTC())
+	}
+	return where, args
+}
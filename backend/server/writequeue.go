@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-fuego/fuego"
+)
+
+// writeQueueSize is how many write transactions may wait for the writer before callers block
+const writeQueueSize = 256
+
+// writeQueue funnels every write transaction through a single goroutine, so writers never contend for the SQLite
+// lock.  Reads don't go through it and stay concurrent.
+//
+// Every write to the SQLite database must go through the queue, as the handlers rely on it for correctness as well as
+// speed.  Read-modify-write changes, such as /add-tag merging a tag into the latest version's tags or /update-memory
+// checking expected_version, read and write in one queued transaction and count on nothing else writing in between.
+// A write made on the database directly could slip in between and be lost.  Migrations are the exception, as they
+// run before the server starts.
+type writeQueue struct {
+	db      *sql.DB
+	jobs    chan writeJob
+	pending atomic.Int64
+	done    chan struct{} // Closed when the writer goroutine has finished
+
+	mu      sync.RWMutex // Held for reading while a job is queued, so Stop can't close jobs under a sender
+	stopped bool
+}
+
+type writeJob struct {
+	ctx    context.Context
+	run    func() error
+	result chan error
+}
+
+// newWriteQueue starts the writer goroutine, which runs until Stop is called
+func newWriteQueue(db *sql.DB) *writeQueue {
+	q := &writeQueue{db: db, jobs: make(chan writeJob, writeQueueSize), done: make(chan struct{})}
+	go func() {
+		defer close(q.done)
+		for job := range q.jobs {
+			// The caller may have given up while the job was queued
+			if err := job.ctx.Err(); err != nil {
+				job.result <- dbError(err)
+			} else {
+				job.result <- job.run()
+			}
+			q.pending.Add(-1)
+		}
+	}()
+	return q
+}
+
+// Stop waits for the writes already queued to finish, then ends the writer goroutine.  Writes after it fail with a
+// 503, as the server is shutting down.  It's safe to call more than once.
+func (q *writeQueue) Stop() {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
+
+// Depth returns the number of write transactions queued or running
+func (q *writeQueue) Depth() int {
+	return int(q.pending.Load())
+}
+
+// Write runs fn in a transaction on the writer goroutine and waits for it, committing if fn returns nil.  Errors
+// returned by fn are passed back unchanged, while failures to begin or commit the transaction go through dbError.
+func (q *writeQueue) Write(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return q.Exclusive(ctx, func() error {
+		tx, err := q.db.BeginTx(ctx, nil)
+		if err != nil {
+			return dbError(err)
+		}
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+}
+
+// Exclusive runs fn on the writer goroutine without a transaction, for statements such as VACUUM which can't run
+// inside one.  No other queued write runs alongside it.
+func (q *writeQueue) Exclusive(ctx context.Context, fn func() error) error {
+	job := writeJob{ctx: ctx, run: fn, result: make(chan error, 1)}
+	q.mu.RLock()
+	if q.stopped {
+		q.mu.RUnlock()
+		return fuego.HTTPError{Status: http.StatusServiceUnavailable, Title: "Service Unavailable", Detail: "the server is shutting down"}
+	}
+	q.pending.Add(1)
+	select {
+	case q.jobs <- job:
+	case <-ctx.Done():
+		q.mu.RUnlock()
+		q.pending.Add(-1)
+		return dbError(ctx.Err())
+	}
+	q.mu.RUnlock()
+	// Always wait for the result, even if ctx ends, as fn may still be running.  Its database work uses ctx, so it's
+	// abandoned promptly.
+	return <-job.result
+}
@@ -1,31 +1,72 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"justinclift/windsurf_memory_server_v2/backend/server"
 )
 
 type Memory struct {
 	ID        int       `json:"id"`
+	Namespace string    `json:"namespace"`
 	MemoryID  string    `json:"memory_id"`
 	Version   int       `json:"version"`
 	Content   string    `json:"content"`
 	Tags      []string  `json:"tags"`
+	Metadata  json.RawMessage `json:"metadata"`
 	Archived  bool      `json:"archived"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Snippet   string    `json:"snippet"`
+}
+
+type StatusResponse struct {
+	Status   string `json:"status"`
+	MemoryID string `json:"memory_id"`
+	Version  int    `json:"version,omitempty"`
+	Error    string `json:"error,omitempty"`
+	WouldArchive *int64 `json:"would_archive,omitempty"`
 }
 
-// Use a test-only port to avoid interfering with real server
-const testPort = "18080"
-const baseURL = "http://localhost:" + testPort
+type SearchResponse struct {
+	Total    int      `json:"total"`
+	Limit    int      `json:"limit"`
+	Offset   int      `json:"offset"`
+	Memories []Memory `json:"memories"`
+}
+
+// baseURL is the address of the server started by TestMemoryAPI, which postJSON and getJSON send requests to
+var baseURL string
 
 func postJSON(t *testing.T, path string, body interface{}) *http.Response {
 	data, _ := json.Marshal(body)
@@ -44,52 +85,53 @@ func getJSON(t *testing.T, path string) *http.Response {
 	return r
 }
 
-func startTestServer() (*exec.Cmd, error) {
-	cmd := exec.Command("go", "run", "../backend/main.go")
-	cmd.Env = append(os.Environ(), "MEMORY_SERVER_DSN=:memory:", "MEMORY_SERVER_PORT="+testPort)
+// TestMain silences the servers' request logging, which would otherwise bury the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
 
-	logFile, err := os.Create("test_server.log")
+// newTestServer starts an in-process server using the database at dsn, migrated to the current schema.  configure,
+// when given, adjusts the default settings first.  Everything is shut down once the test finishes.
+func newTestServer(t testing.TB, dsn string, configure func(cfg *server.Config)) *httptest.Server {
+	t.Helper()
+	cfg := server.DefaultConfig()
+	cfg.DSN = dsn
+	if configure != nil {
+		configure(&cfg)
+	}
+	db, err := server.OpenDB(cfg)
 	if err != nil {
-		return nil, err
+		t.Fatalf("open database: %v", err)
 	}
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
-
-	if err := cmd.Start(); err != nil {
-		return nil, err
+	if _, err := server.Migrate(db); err != nil {
+		db.Close()
+		t.Fatalf("migrate database: %v", err)
 	}
-	// Wait for server to be ready (basic polling)
-	for i := 0; i < 20; i++ {
-		r, err := http.Get(baseURL + "/")
-		if err == nil && r.StatusCode == 200 {
-			return cmd, nil
-		}
-		time.Sleep(200 * time.Millisecond)
+	check, err := server.CheckDatabase(db)
+	if err != nil {
+		db.Close()
+		t.Fatalf("check database: %v", err)
 	}
-	cmd.Process.Kill()
-	// Dump server log if startup failed
-	logFile.Seek(0, 0)
-	logContent, _ := ioutil.ReadAll(logFile)
-	return nil, fmt.Errorf("server did not start in time. Backend log:\n%s", string(logContent))
-}
-
-func stopTestServer(cmd *exec.Cmd) {
-	if cmd != nil && cmd.Process != nil {
-		cmd.Process.Kill()
-		cmd.Wait()
+	srv := server.NewServer(cfg, db)
+	srv.SetDatabaseCheck(check)
+	if _, err := srv.Seed(context.Background()); err != nil {
+		db.Close()
+		t.Fatalf("seed database: %v", err)
 	}
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(func() {
+		// Event streams are ended first, as the test server waits for every request to finish
+		srv.Drain()
+		ts.Close()
+		srv.Close()
+		db.Close()
+	})
+	return ts
 }
 
 func TestMemoryAPI(t *testing.T) {
-	cmd, err := startTestServer()
-	if err != nil {
-		t.Fatalf("could not start test server: %v", err)
-	}
-	defer func() {
-		// Attempt graceful shutdown via /shutdown endpoint
-		http.Post(baseURL+"/shutdown", "application/json", nil)
-		stopTestServer(cmd)
-	}()
+	baseURL = newTestServer(t, ":memory:", nil).URL
 
 	memID := "test-memory-title"
 	content1 := "This is the first version."
@@ -160,6 +202,13 @@ func TestMemoryAPI(t *testing.T) {
 	if !bytes.Contains(body, []byte(content2)) {
 		t.Error("search-memories did not find updated content")
 	}
+	var searched SearchResponse
+	if err := json.Unmarshal(body, &searched); err != nil {
+		t.Fatalf("search-memories unmarshal: %v", err)
+	}
+	if searched.Total != len(searched.Memories) || searched.Limit != 50 || searched.Offset != 0 {
+		t.Errorf("search-memories pagination incorrect: total=%d returned=%d limit=%d offset=%d", searched.Total, len(searched.Memories), searched.Limit, searched.Offset)
+	}
 
 	// Delete memory (archive all)
 	resp = postJSON(t, "/delete-memory", map[string]string{"memory_id": memID})
@@ -242,34 +291,4327 @@ func TestMemoryAPI(t *testing.T) {
 		t.Errorf("list-memories did not return expected latest non-archived: foundA=%v foundB=%v foundC=%v", foundA, foundB, foundC)
 	}
 
-	t.Run("list-memories-by-tag", func(t *testing.T) {
-		// Should return only memA (tag: gamma) and not memB (archived) or memC (no gamma tag)
-		resp := getJSON(t, "/list-memories-by-tag?tag=gamma")
+	t.Run("search-memories-pagination", func(t *testing.T) {
+		// memA has 3 active versions matching "A", returned in version DESC order
+		resp := getJSON(t, "/search-memories?q=A&limit=2&offset=1")
+		if resp.StatusCode != 200 {
+			t.Fatalf("search-memories failed: %v", resp.Status)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var page SearchResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("search-memories unmarshal: %v", err)
+		}
+		if page.Total != 3 || page.Limit != 2 || page.Offset != 1 || len(page.Memories) != 2 {
+			t.Fatalf("unexpected page: total=%d limit=%d offset=%d returned=%d", page.Total, page.Limit, page.Offset, len(page.Memories))
+		}
+		if page.Memories[0].Content != "A2" || page.Memories[1].Content != "A1" {
+			t.Errorf("unexpected page contents: %q, %q", page.Memories[0].Content, page.Memories[1].Content)
+		}
+
+		// Out of range limits are clamped rather than rejected
+		resp = getJSON(t, "/search-memories?q=A&limit=100000&offset=-5")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("search-memories unmarshal: %v", err)
+		}
+		if page.Limit != 500 || page.Offset != 0 {
+			t.Errorf("limit/offset not clamped: limit=%d offset=%d", page.Limit, page.Offset)
+		}
+	})
+
+	t.Run("bulk-save", func(t *testing.T) {
+		items := []map[string]interface{}{
+			{"memory_id": "bulkA", "content": "bulk A1", "tags": []string{"bulk"}},
+			{"memory_id": "bulkA", "content": "bulk A2", "tags": []string{"bulk"}},
+			{"memory_id": "", "content": "no id"},
+			{"memory_id": "bulkB", "content": "bulk B1", "tags": []string{"bulk"}},
+		}
+
+		// Atomic mode rejects the whole batch because of the item without a memory_id
+		resp := postJSON(t, "/bulk-save?atomic=true", items)
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Fatalf("atomic bulk-save: expected 400, got %v", resp.Status)
+		}
+		resp = getJSON(t, "/get-memory-by-id/bulkA")
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("atomic bulk-save should have rolled back, but bulkA exists")
+		}
+
+		// Non-atomic mode reports the failure and saves the rest
+		resp = postJSON(t, "/bulk-save", items)
 		if resp.StatusCode != 200 {
+			t.Fatalf("bulk-save failed: %v", resp.Status)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var results []StatusResponse
+		if err := json.Unmarshal(body, &results); err != nil {
+			t.Fatalf("bulk-save unmarshal: %v", err)
+		}
+		if len(results) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(results))
+		}
+		if results[0].Status != "saved" || results[0].Version != 1 || results[1].Version != 2 {
+			t.Errorf("versions not assigned per memory_id: %+v", results[:2])
+		}
+		if results[2].Status != "failed" || results[2].Error == "" {
+			t.Errorf("invalid item not reported as failed: %+v", results[2])
+		}
+		if results[3].Status != "saved" || results[3].MemoryID != "bulkB" || results[3].Version != 1 {
+			t.Errorf("unexpected result for bulkB: %+v", results[3])
+		}
+	})
+
+	t.Run("created-at-preserved-across-versions", func(t *testing.T) {
+		getMemory := func(id string) Memory {
+			resp := getJSON(t, "/get-memory-by-id/"+id)
 			body, _ := ioutil.ReadAll(resp.Body)
 			resp.Body.Close()
-			t.Fatalf("list-memories-by-tag failed: %v\nBody: %s", resp.Status, string(body))
+			if resp.StatusCode != 200 {
+				t.Fatalf("get-memory-by-id %s failed: %v", id, resp.Status)
+			}
+			var m Memory
+			if err := json.Unmarshal(body, &m); err != nil {
+				t.Fatalf("get-memory-by-id unmarshal: %v", err)
+			}
+			return m
 		}
+
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "timestamps", "content": "v1", "tags": []string{"ts"}})
+		resp.Body.Close()
+		first := getMemory("timestamps")
+		time.Sleep(20 * time.Millisecond)
+		resp = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "timestamps", "content": "v2", "tags": []string{"ts"}})
 		body, _ := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
-		var filtered []Memory
-		if err := json.Unmarshal(body, &filtered); err != nil {
-			t.Fatalf("list-memories-by-tag unmarshal: %v", err)
+		second := getMemory("timestamps")
+
+		// The update response carries the stored record, so it should match a fresh read
+		var saved struct {
+			Status string `json:"status"`
+			Memory
 		}
-		foundMemA, foundMemB, foundMemC := false, false, false
-		for _, m := range filtered {
-			if m.MemoryID == "memA" && m.Content == "A3" && !m.Archived {
-				foundMemA = true
+		if err := json.Unmarshal(body, &saved); err != nil {
+			t.Fatalf("update-memory unmarshal: %v", err)
+		}
+		if saved.Status != "updated" || saved.ID != second.ID || saved.Version != second.Version || saved.Content != "v2" ||
+			len(saved.Tags) != 1 || !saved.CreatedAt.Equal(second.CreatedAt) || !saved.UpdatedAt.Equal(second.UpdatedAt) {
+			t.Errorf("update-memory response doesn't match the stored memory: got %+v, want %+v", saved, second)
+		}
+
+		if second.Version != first.Version+1 {
+			t.Fatalf("expected a new version, got %d after %d", second.Version, first.Version)
+		}
+		if !second.CreatedAt.Equal(first.CreatedAt) {
+			t.Errorf("created_at changed across versions: %v -> %v", first.CreatedAt, second.CreatedAt)
+		}
+		if !second.UpdatedAt.After(first.UpdatedAt) {
+			t.Errorf("updated_at did not advance: %v -> %v", first.UpdatedAt, second.UpdatedAt)
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		resp := getJSON(t, "/export")
+		if resp.StatusCode != 200 {
+			t.Fatalf("export failed: %v", resp.Status)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var doc struct {
+			SchemaVersion int       `json:"schema_version"`
+			ExportedAt    time.Time `json:"exported_at"`
+			Memories      []Memory  `json:"memories"`
+		}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			t.Fatalf("export unmarshal: %v\nBody: %s", err, string(body))
+		}
+		if doc.SchemaVersion != 1 || doc.ExportedAt.IsZero() {
+			t.Errorf("unexpected export header: schema_version=%d exported_at=%v", doc.SchemaVersion, doc.ExportedAt)
+		}
+		// memB was deleted, so its versions should be exported as archived rows
+		archivedB := 0
+		for _, m := range doc.Memories {
+			if m.MemoryID == "memB" && m.Archived {
+				archivedB++
 			}
-			if m.MemoryID == "memB" {
-				foundMemB = true
+		}
+		if archivedB != 2 {
+			t.Errorf("expected 2 archived memB rows in export, got %d", archivedB)
+		}
+
+		// Merging the export back in should skip every row, as they all exist already
+		resp = postJSON(t, "/import", doc)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("import (merge) failed: %v\nBody: %s", resp.Status, string(body))
+		}
+		var imported struct {
+			Mode     string `json:"mode"`
+			Imported int    `json:"imported"`
+			Skipped  int    `json:"skipped"`
+		}
+		if err := json.Unmarshal(body, &imported); err != nil {
+			t.Fatalf("import unmarshal: %v", err)
+		}
+		if imported.Mode != "merge" || imported.Imported != 0 || imported.Skipped != len(doc.Memories) {
+			t.Errorf("unexpected merge result: %+v (export had %d rows)", imported, len(doc.Memories))
+		}
+
+		// Replacing with a single archived row should leave only that row behind
+		single := doc
+		single.Memories = []Memory{{MemoryID: "imported", Version: 3, Content: "restored", Tags: []string{"restored"}, Archived: true, CreatedAt: doc.ExportedAt, UpdatedAt: doc.ExportedAt}}
+		resp = postJSON(t, "/import?mode=replace", single)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("import (replace) failed: %v\nBody: %s", resp.Status, string(body))
+		}
+		resp = getJSON(t, "/export")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var replaced struct {
+			Memories []Memory `json:"memories"`
+		}
+		if err := json.Unmarshal(body, &replaced); err != nil {
+			t.Fatalf("export unmarshal: %v", err)
+		}
+		if len(replaced.Memories) != 1 || replaced.Memories[0].Version != 3 || !replaced.Memories[0].Archived || !replaced.Memories[0].CreatedAt.Equal(single.Memories[0].CreatedAt) {
+			t.Errorf("replace import did not preserve the row: %+v", replaced.Memories)
+		}
+
+		// A mismatched schema version must be rejected
+		single.SchemaVersion = 99
+		resp = postJSON(t, "/import", single)
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("expected 400 for bad schema_version, got %v", resp.Status)
+		}
+
+		// Restore the original data for the remaining subtests
+		resp = postJSON(t, "/import?mode=replace", doc)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("restoring export failed: %v", resp.Status)
+		}
+	})
+
+	t.Run("save-memory-validation", func(t *testing.T) {
+		cases := []struct {
+			name  string
+			input map[string]interface{}
+		}{
+			{"missing memory_id", map[string]interface{}{"content": "x"}},
+			{"bad memory_id characters", map[string]interface{}{"memory_id": "has spaces/slash", "content": "x"}},
+			{"memory_id too long", map[string]interface{}{"memory_id": strings.Repeat("a", 129), "content": "x"}},
+			{"empty content", map[string]interface{}{"memory_id": "valid-id", "content": ""}},
+			{"content too large", map[string]interface{}{"memory_id": "valid-id", "content": strings.Repeat("x", 1<<20+1)}},
+			{"empty tag", map[string]interface{}{"memory_id": "valid-id", "content": "x", "tags": []string{"ok", ""}}},
+			{"tag with a tab", map[string]interface{}{"memory_id": "valid-id", "content": "x", "tags": []string{"ok", "a\tb"}}},
+			{"tag with a newline", map[string]interface{}{"memory_id": "valid-id", "content": "x", "tags": []string{"a\nb"}}},
+			{"tag with a comma", map[string]interface{}{"memory_id": "valid-id", "content": "x", "tags": []string{"a,b"}}},
+		}
+		for _, path := range []string{"/save-memory", "/update-memory"} {
+			for _, tc := range cases {
+				if path == "/save-memory" && tc.name == "missing memory_id" {
+					continue // save-memory generates one instead
+				}
+				resp := postJSON(t, path, tc.input)
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != 400 {
+					t.Errorf("%s %s: expected 400, got %v", path, tc.name, resp.Status)
+				}
+				if !bytes.Contains(body, []byte(`"code":"validation_failed"`)) {
+					t.Errorf("%s %s: expected a validation_failed code in the error body, got %s", path, tc.name, string(body))
+				}
 			}
-			if m.MemoryID == "memC" {
-				foundMemC = true
+		}
+
+		// The error names the offending tag, and add-tag checks the same way
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "valid-id", "content": "x", "tags": []string{"ok", "line\nbreak"}})
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		resp.Body.Close()
+		if !strings.Contains(apiErr.Message, `"line\nbreak"`) || !strings.Contains(apiErr.Message, "control character") {
+			t.Errorf("expected the error to name the tag and the problem, got %q", apiErr.Message)
+		}
+		postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "tag-chars", "content": "x"}).Body.Close()
+		for _, tag := range []string{"a\tb", "a,b"} {
+			resp := postJSON(t, "/add-tag", map[string]interface{}{"memory_id": "tag-chars", "tag": tag})
+			resp.Body.Close()
+			if resp.StatusCode != 400 {
+				t.Errorf("add-tag %q: expected 400, got %v", tag, resp.Status)
 			}
 		}
-		if !foundMemA || foundMemB || foundMemC {
-			t.Errorf("list-memories-by-tag did not return expected results: foundMemA=%v foundMemB=%v foundMemC=%v", foundMemA, foundMemB, foundMemC)
+
+		// Duplicate tags are removed rather than rejected
+		resp = postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "dedupe.tags_1", "content": "x", "tags": []string{"a", "b", "a"}})
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("save-memory with duplicate tags failed: %v", resp.Status)
+		}
+		resp = getJSON(t, "/get-memory-by-id/dedupe.tags_1")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var m Memory
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Fatalf("get-memory-by-id unmarshal: %v", err)
+		}
+		if len(m.Tags) != 2 || m.Tags[0] != "a" || m.Tags[1] != "b" {
+			t.Errorf("tags not de-duplicated: %v", m.Tags)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		resp := getJSON(t, "/stats")
+		if resp.StatusCode != 200 {
+			t.Fatalf("stats failed: %v", resp.Status)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var stats struct {
+			ActiveMemories    int `json:"active_memories"`
+			ArchivedRows      int `json:"archived_rows"`
+			DistinctMemoryIDs int `json:"distinct_memory_ids"`
+			DistinctTags      int `json:"distinct_tags"`
+			TotalRows         int `json:"total_rows"`
+			WriteQueueDepth   *int `json:"write_queue_depth"`
+		}
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatalf("stats unmarshal: %v", err)
+		}
+
+		// Cross-check the counts against a full export
+		resp = getJSON(t, "/export")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var doc struct {
+			Memories []Memory `json:"memories"`
+		}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			t.Fatalf("export unmarshal: %v", err)
+		}
+		active, ids, tags := map[string]bool{}, map[string]bool{}, map[string]bool{}
+		archived := 0
+		for _, m := range doc.Memories {
+			ids[m.MemoryID] = true
+			if m.Archived {
+				archived++
+				continue
+			}
+			active[m.MemoryID] = true
+			for _, tag := range m.Tags {
+				tags[tag] = true
+			}
+		}
+		if stats.TotalRows != len(doc.Memories) || stats.ArchivedRows != archived || stats.ActiveMemories != len(active) || stats.DistinctMemoryIDs != len(ids) || stats.DistinctTags != len(tags) {
+			t.Errorf("stats mismatch: got %+v, want total=%d archived=%d active=%d ids=%d tags=%d", stats, len(doc.Memories), archived, len(active), len(ids), len(tags))
+		}
+		// Nothing is being written, so the writer is idle
+		if stats.WriteQueueDepth == nil || *stats.WriteQueueDepth != 0 {
+			t.Errorf("expected write_queue_depth 0 while idle, got %v", stats.WriteQueueDepth)
+		}
+	})
+
+	t.Run("delete-version", func(t *testing.T) {
+		for _, content := range []string{"dv1", "dv2", "dv3"} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "delver", "content": content})
+			resp.Body.Close()
+		}
+
+		// Archive the bad middle version only
+		resp := postJSON(t, "/delete-version", map[string]interface{}{"memory_id": "delver", "version": 2})
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("delete-version failed: %v", resp.Status)
+		}
+		resp = getJSON(t, "/search-memories?q=dv")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var page SearchResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("search-memories unmarshal: %v", err)
+		}
+		if page.Total != 2 || page.Memories[0].Version != 3 || page.Memories[1].Version != 1 {
+			t.Errorf("expected versions 3 and 1 to remain active, got %+v", page.Memories)
+		}
+
+		// Already archived and missing versions are both 404
+		for _, version := range []int{2, 99} {
+			resp = postJSON(t, "/delete-version", map[string]interface{}{"memory_id": "delver", "version": version})
+			resp.Body.Close()
+			if resp.StatusCode != 404 {
+				t.Errorf("delete-version %d: expected 404, got %v", version, resp.Status)
+			}
+		}
+	})
+
+	t.Run("update-memory-expected-version", func(t *testing.T) {
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "cas", "content": "c1"})
+		resp.Body.Close()
+
+		// Matching expected_version succeeds
+		resp = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "cas", "content": "c2", "expected_version": 1})
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("update with matching expected_version failed: %v", resp.Status)
+		}
+
+		// A stale expected_version is rejected, and nothing is written
+		resp = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "cas", "content": "stale", "expected_version": 1})
+		resp.Body.Close()
+		if resp.StatusCode != 409 {
+			t.Errorf("update with stale expected_version: expected 409, got %v", resp.Status)
+		}
+		resp = getJSON(t, "/get-memory-by-id/cas")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var m Memory
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Fatalf("get-memory-by-id unmarshal: %v", err)
+		}
+		if m.Version != 2 || m.Content != "c2" {
+			t.Errorf("conflicting update modified the memory: version=%d content=%q", m.Version, m.Content)
+		}
+
+		// Without expected_version the last writer wins
+		resp = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "cas", "content": "c3"})
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("update without expected_version failed: %v", resp.Status)
+		}
+	})
+
+	t.Run("openapi", func(t *testing.T) {
+		resp := getJSON(t, "/openapi.json")
+		if resp.StatusCode != 200 {
+			t.Fatalf("openapi.json failed: %v", resp.Status)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var spec struct {
+			OpenAPI string                     `json:"openapi"`
+			Paths   map[string]json.RawMessage `json:"paths"`
+		}
+		if err := json.Unmarshal(body, &spec); err != nil {
+			t.Fatalf("openapi.json is not valid JSON: %v", err)
+		}
+		if spec.OpenAPI == "" || len(spec.Paths) == 0 {
+			t.Fatalf("openapi.json has no paths: %s", string(body))
+		}
+		for _, path := range []string{"/save-memory", "/update-memory", "/list-memories", "/get-memory-by-id/{memory_id}"} {
+			if _, ok := spec.Paths[path]; !ok {
+				t.Errorf("openapi.json is missing %s", path)
+			}
+		}
+		if !bytes.Contains(spec.Paths["/save-memory"], []byte("#/components/schemas/APIError")) {
+			t.Errorf("openapi.json doesn't document errors as APIError: %s", string(spec.Paths["/save-memory"]))
+		}
+	})
+
+	t.Run("healthz", func(t *testing.T) {
+		resp := getJSON(t, "/healthz")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("healthz failed: %v\nBody: %s", resp.Status, string(body))
+		}
+		var health struct {
+			Status   string `json:"status"`
+			Database struct {
+				Integrity string `json:"integrity"`
+				Schema    string `json:"schema"`
+			} `json:"database"`
+		}
+		if err := json.Unmarshal(body, &health); err != nil || health.Status != "ok" {
+			t.Errorf("unexpected healthz body: %s", string(body))
+		}
+		if health.Database.Integrity != "ok" || health.Database.Schema != "ok" {
+			t.Errorf("expected the startup database checks reported as ok, got %s", string(body))
+		}
+	})
+
+	t.Run("search-memories-modes", func(t *testing.T) {
+		for id, content := range map[string]string{"mode-word": "The cat sat.", "mode-inside": "Concatenate strings", "mode-exact": "cat"} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": id, "content": content})
+			resp.Body.Close()
+		}
+		search := func(query string) []string {
+			resp := getJSON(t, "/search-memories?"+query)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("search-memories?%s failed: %v", query, resp.Status)
+			}
+			var page SearchResponse
+			if err := json.Unmarshal(body, &page); err != nil {
+				t.Fatalf("search-memories unmarshal: %v", err)
+			}
+			var ids []string
+			for _, m := range page.Memories {
+				ids = append(ids, m.MemoryID)
+			}
+			return ids
+		}
+
+		if got := search("q=cat"); strings.Join(got, ",") != "mode-exact,mode-inside,mode-word" {
+			t.Errorf("substring mode: got %v", got)
+		}
+		if got := search("q=CAT&mode=word"); strings.Join(got, ",") != "mode-exact,mode-word" {
+			t.Errorf("word mode: got %v", got)
+		}
+		if got := search("q=cat&mode=exact"); strings.Join(got, ",") != "mode-exact" {
+			t.Errorf("exact mode: got %v", got)
+		}
+		resp := getJSON(t, "/search-memories?q=cat&mode=fuzzy-ish")
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("unknown mode: expected 400, got %v", resp.Status)
+		}
+	})
+
+	t.Run("purge-archived", func(t *testing.T) {
+		for _, content := range []string{"p1", "p2", "p3"} {
+			resp := postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "purge", "content": content})
+			resp.Body.Close()
+		}
+		purge := func(body map[string]interface{}) int {
+			resp := postJSON(t, "/purge-archived", body)
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("purge-archived failed: %v\nBody: %s", resp.Status, string(data))
+			}
+			var result struct {
+				Purged int `json:"purged"`
+			}
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatalf("purge-archived unmarshal: %v", err)
+			}
+			return result.Purged
+		}
+
+		// Everything was archived moments ago, so nothing is older than a day
+		if n := purge(map[string]interface{}{"older_than_days": 1}); n != 0 {
+			t.Errorf("older_than_days=1: expected 0 rows purged, got %d", n)
+		}
+		if n := purge(map[string]interface{}{"vacuum": true}); n == 0 {
+			t.Errorf("expected archived rows to be purged")
+		}
+		resp := getJSON(t, "/stats")
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var stats struct {
+			ArchivedRows int `json:"archived_rows"`
+		}
+		if err := json.Unmarshal(data, &stats); err != nil {
+			t.Fatalf("stats unmarshal: %v", err)
+		}
+		if stats.ArchivedRows != 0 {
+			t.Errorf("expected no archived rows after purge, got %d", stats.ArchivedRows)
+		}
+
+		// The active version is untouched
+		resp = getJSON(t, "/get-memory-by-id/purge")
+		data, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var m Memory
+		if err := json.Unmarshal(data, &m); err != nil || m.Version != 3 || m.Content != "p3" {
+			t.Errorf("active version damaged by purge: %s", string(data))
+		}
+
+		resp = postJSON(t, "/purge-archived", map[string]interface{}{"older_than_days": -1})
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("negative older_than_days: expected 400, got %v", resp.Status)
 		}
 	})
+
+	t.Run("list-memories-sorting", func(t *testing.T) {
+		list := func(query string) []Memory {
+			resp := getJSON(t, "/list-memories"+query)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("list-memories%s failed: %v", query, resp.Status)
+			}
+			var memories []Memory
+			if err := json.Unmarshal(body, &memories); err != nil {
+				t.Fatalf("list-memories unmarshal: %v", err)
+			}
+			return memories
+		}
+
+		// Touch the memory which sorts first by ID, so it becomes the most recently updated
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "0-sort-latest", "content": "newest"})
+		resp.Body.Close()
+
+		byID := list("")
+		for i := 1; i < len(byID); i++ {
+			if byID[i-1].MemoryID > byID[i].MemoryID {
+				t.Fatalf("default ordering is not by memory_id: %s before %s", byID[i-1].MemoryID, byID[i].MemoryID)
+			}
+		}
+		byIDDesc := list("?sort=memory_id&order=desc")
+		if byIDDesc[0].MemoryID != byID[len(byID)-1].MemoryID {
+			t.Errorf("sort=memory_id&order=desc: expected %s first, got %s", byID[len(byID)-1].MemoryID, byIDDesc[0].MemoryID)
+		}
+		recent := list("?sort=updated_at&order=desc")
+		if recent[0].MemoryID != "0-sort-latest" {
+			t.Errorf("sort=updated_at&order=desc: expected the latest save first, got %s", recent[0].MemoryID)
+		}
+		for i := 1; i < len(recent); i++ {
+			if recent[i-1].UpdatedAt.Before(recent[i].UpdatedAt) {
+				t.Fatalf("sort=updated_at&order=desc is out of order at %d", i)
+			}
+		}
+		oldest := list("?sort=created_at")
+		for i := 1; i < len(oldest); i++ {
+			if oldest[i-1].CreatedAt.After(oldest[i].CreatedAt) {
+				t.Fatalf("sort=created_at is out of order at %d", i)
+			}
+		}
+
+		// Anything outside the whitelist is rejected
+		for _, query := range []string{"?sort=content", "?sort=version%3BDROP%20TABLE%20memories", "?order=sideways"} {
+			resp := getJSON(t, "/list-memories"+query)
+			resp.Body.Close()
+			if resp.StatusCode != 400 {
+				t.Errorf("list-memories%s: expected 400, got %v", query, resp.Status)
+			}
+		}
+	})
+
+	t.Run("rename-memory", func(t *testing.T) {
+		for _, content := range []string{"r1", "r2"} {
+			resp := postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "rename-old", "content": content})
+			resp.Body.Close()
+		}
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "rename-taken", "content": "x"})
+		resp.Body.Close()
+
+		resp = postJSON(t, "/rename-memory", map[string]interface{}{"old_memory_id": "rename-old", "new_memory_id": "rename-taken"})
+		resp.Body.Close()
+		if resp.StatusCode != 409 {
+			t.Errorf("rename onto an existing memory: expected 409, got %v", resp.Status)
+		}
+		resp = postJSON(t, "/rename-memory", map[string]interface{}{"old_memory_id": "rename-missing", "new_memory_id": "rename-other"})
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("rename of a missing memory: expected 404, got %v", resp.Status)
+		}
+		resp = postJSON(t, "/rename-memory", map[string]interface{}{"old_memory_id": "rename-old", "new_memory_id": "bad id!"})
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("rename to an invalid memory_id: expected 400, got %v", resp.Status)
+		}
+
+		resp = postJSON(t, "/rename-memory", map[string]interface{}{"old_memory_id": "rename-old", "new_memory_id": "rename-new"})
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("rename-memory failed: %v", resp.Status)
+		}
+		resp = getJSON(t, "/get-memory-by-id/rename-old")
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("old memory_id still resolves after rename: %v", resp.Status)
+		}
+
+		// History moves with the rename, so the next version continues from 2
+		resp = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "rename-new", "content": "r3"})
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var m Memory
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Fatalf("update-memory unmarshal: %v", err)
+		}
+		if m.Version != 3 {
+			t.Errorf("expected version 3 after rename, got %d", m.Version)
+		}
+	})
+
+	t.Run("add-remove-tag", func(t *testing.T) {
+		retag := func(path, tag string) (int, map[string]interface{}) {
+			resp := postJSON(t, path, map[string]interface{}{"memory_id": "retag", "tag": tag})
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			var result map[string]interface{}
+			json.Unmarshal(body, &result)
+			return resp.StatusCode, result
+		}
+		if code, _ := retag("/add-tag", "x"); code != 404 {
+			t.Errorf("add-tag on a missing memory: expected 404, got %d", code)
+		}
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "retag", "content": "same content", "tags": []string{"a"}})
+		resp.Body.Close()
+
+		code, result := retag("/add-tag", "b")
+		if code != 200 || result["status"] != "updated" || result["version"] != float64(2) || fmt.Sprint(result["tags"]) != "[a b]" {
+			t.Errorf("add-tag: got %d %v", code, result)
+		}
+		code, result = retag("/add-tag", "b")
+		if code != 200 || result["status"] != "unchanged" || result["version"] != float64(2) {
+			t.Errorf("add-tag of an existing tag should not write a version: got %d %v", code, result)
+		}
+		code, result = retag("/remove-tag", "a")
+		if code != 200 || result["version"] != float64(3) || fmt.Sprint(result["tags"]) != "[b]" || result["content"] != "same content" {
+			t.Errorf("remove-tag: got %d %v", code, result)
+		}
+		if code, _ := retag("/remove-tag", ""); code != 400 {
+			t.Errorf("remove-tag with an empty tag: expected 400, got %d", code)
+		}
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		for id, tags := range map[string][]string{"tc-1": {"tc-common", "tc-rare"}, "tc-2": {"tc-common"}, "tc-3": {"tc-common", "tc-mid"}, "tc-4": {"tc-mid"}} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": id, "content": "tag counts", "tags": tags})
+			resp.Body.Close()
+		}
+		resp := getJSON(t, "/tags?prefix=tc-")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("tags failed: %v\nBody: %s", resp.Status, string(body))
+		}
+		var tags []struct {
+			Tag   string `json:"tag"`
+			Count int    `json:"count"`
+		}
+		if err := json.Unmarshal(body, &tags); err != nil {
+			t.Fatalf("tags unmarshal: %v", err)
+		}
+		if fmt.Sprint(tags) != "[{tc-common 3} {tc-mid 2} {tc-rare 1}]" {
+			t.Errorf("unexpected tag counts: %v", tags)
+		}
+
+		// Archived versions don't count
+		resp = postJSON(t, "/delete-memory", map[string]interface{}{"memory_id": "tc-1"})
+		resp.Body.Close()
+		resp = getJSON(t, "/tags?prefix=tc-")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		tags = nil
+		if err := json.Unmarshal(body, &tags); err != nil {
+			t.Fatalf("tags unmarshal: %v", err)
+		}
+		if fmt.Sprint(tags) != "[{tc-common 2} {tc-mid 2}]" {
+			t.Errorf("unexpected tag counts after delete: %v", tags)
+		}
+
+		// A tag repeated in one memory's tags still counts the memory once
+		now := time.Now().UTC()
+		resp = postJSON(t, "/import", map[string]interface{}{"schema_version": 1, "memories": []map[string]interface{}{
+			{"memory_id": "tc-5", "version": 1, "content": "repeated tag", "tags": []string{"tc-mid", "tc-mid"}, "created_at": now, "updated_at": now},
+		}})
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("import with a repeated tag failed: %v", resp.Status)
+		}
+		resp = getJSON(t, "/tags?prefix=tc-")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		tags = nil
+		if err := json.Unmarshal(body, &tags); err != nil {
+			t.Fatalf("tags unmarshal: %v", err)
+		}
+		if fmt.Sprint(tags) != "[{tc-mid 3} {tc-common 2}]" {
+			t.Errorf("unexpected tag counts with a repeated tag: %v", tags)
+		}
+
+		// A memory saved twice has two active versions, but is still one memory
+		for i := 0; i < 2; i++ {
+			resp = postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "tc-6", "content": "saved twice", "tags": []string{"tc-twice"}})
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("save %d of tc-6 failed: %v", i+1, resp.Status)
+			}
+		}
+		resp = getJSON(t, "/tags?prefix=tc-twice")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		tags = nil
+		if err := json.Unmarshal(body, &tags); err != nil {
+			t.Fatalf("tags unmarshal: %v", err)
+		}
+		if fmt.Sprint(tags) != "[{tc-twice 1}]" {
+			t.Errorf("unexpected tag counts for a memory saved twice: %v", tags)
+		}
+	})
+
+	t.Run("index", func(t *testing.T) {
+		resp := getJSON(t, "/")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !strings.Contains(string(body), "<title>Memory Server</title>") {
+			t.Errorf("/ did not serve the embedded index.html: %v\nBody: %.200s", resp.Status, string(body))
+		}
+	})
+
+	t.Run("date-range-filters", func(t *testing.T) {
+		save := func(id string) Memory {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": id, "content": "date range check"})
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			var m Memory
+			if err := json.Unmarshal(body, &m); err != nil {
+				t.Fatalf("save-memory unmarshal: %v", err)
+			}
+			return m
+		}
+		first := save("dr-1")
+		time.Sleep(20 * time.Millisecond)
+		second := save("dr-2")
+
+		resp := getJSON(t, "/list-memories?updated_after="+first.UpdatedAt.Format(time.RFC3339Nano))
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var memories []Memory
+		if err := json.Unmarshal(body, &memories); err != nil {
+			t.Fatalf("list-memories unmarshal: %v\nBody: %s", err, string(body))
+		}
+		if len(memories) != 1 || memories[0].MemoryID != "dr-2" {
+			t.Errorf("updated_after: expected only dr-2, got %+v", memories)
+		}
+
+		resp = getJSON(t, "/search-memories?q=date+range+check&created_before="+second.CreatedAt.Format(time.RFC3339Nano)+"&created_after=2000-01-01T00:00:00Z")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var page SearchResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("search-memories unmarshal: %v\nBody: %s", err, string(body))
+		}
+		if page.Total != 1 || page.Memories[0].MemoryID != "dr-1" {
+			t.Errorf("created_before: expected only dr-1, got %+v", page.Memories)
+		}
+
+		for _, path := range []string{"/list-memories?created_after=yesterday", "/search-memories?q=x&updated_before=2024-13-01"} {
+			resp := getJSON(t, path)
+			resp.Body.Close()
+			if resp.StatusCode != 400 {
+				t.Errorf("%s: expected 400, got %v", path, resp.Status)
+			}
+		}
+	})
+
+	t.Run("get-memory-by-id-conditional", func(t *testing.T) {
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "cached", "content": "v1"})
+		resp.Body.Close()
+		get := func(header, value string) *http.Response {
+			req, _ := http.NewRequest("GET", baseURL+"/get-memory-by-id/cached", nil)
+			if header != "" {
+				req.Header.Set(header, value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("get-memory-by-id failed: %v", err)
+			}
+			resp.Body.Close()
+			return resp
+		}
+
+		resp = get("", "")
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if resp.StatusCode != 200 || etag == "" || lastModified == "" {
+			t.Fatalf("expected ETag and Last-Modified headers, got %v %v", resp.Status, resp.Header)
+		}
+		if resp = get("If-None-Match", etag); resp.StatusCode != 304 {
+			t.Errorf("If-None-Match with the current ETag: expected 304, got %v", resp.Status)
+		}
+		if resp = get("If-Modified-Since", lastModified); resp.StatusCode != 304 {
+			t.Errorf("If-Modified-Since with Last-Modified: expected 304, got %v", resp.Status)
+		}
+
+		// A new version changes the ETag, so the old one no longer matches
+		resp = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "cached", "content": "v2"})
+		resp.Body.Close()
+		if resp = get("If-None-Match", etag); resp.StatusCode != 200 || resp.Header.Get("ETag") == etag {
+			t.Errorf("stale If-None-Match: expected 200 with a new ETag, got %v %s", resp.Status, resp.Header.Get("ETag"))
+		}
+		if resp = get("If-Modified-Since", "Mon, 01 Jan 2001 00:00:00 GMT"); resp.StatusCode != 200 {
+			t.Errorf("old If-Modified-Since: expected 200, got %v", resp.Status)
+		}
+	})
+
+	t.Run("get-memories", func(t *testing.T) {
+		for _, req := range []struct{ id, content string }{{"batch-1", "one"}, {"batch-2", "two"}, {"batch-2", "two again"}} {
+			resp := postJSON(t, "/update-memory", map[string]interface{}{"memory_id": req.id, "content": req.content})
+			resp.Body.Close()
+		}
+		resp := postJSON(t, "/get-memories", map[string]interface{}{"memory_ids": []string{"batch-1", "batch-2", "batch-missing"}})
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("get-memories failed: %v\nBody: %s", resp.Status, string(body))
+		}
+		var memories map[string]Memory
+		if err := json.Unmarshal(body, &memories); err != nil {
+			t.Fatalf("get-memories unmarshal: %v", err)
+		}
+		if len(memories) != 2 || memories["batch-1"].Content != "one" || memories["batch-2"].Content != "two again" || memories["batch-2"].Version != 2 {
+			t.Errorf("unexpected get-memories result: %+v", memories)
+		}
+
+		resp = postJSON(t, "/get-memories", map[string]interface{}{"memory_ids": []string{}})
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != "{}" {
+			t.Errorf("empty get-memories: got %v %s", resp.Status, string(body))
+		}
+	})
+
+	t.Run("tags-never-null", func(t *testing.T) {
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "no-tags", "content": "untagged"})
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), `"tags":[]`) {
+			t.Errorf("save-memory response should have empty tags: %s", string(body))
+		}
+		resp = postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "null-tags", "content": "untagged", "tags": nil})
+		resp.Body.Close()
+
+		resp = getJSON(t, "/list-memories")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var raw []map[string]json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			t.Fatalf("list-memories unmarshal: %v", err)
+		}
+		for _, m := range raw {
+			if string(m["tags"]) == "null" {
+				t.Errorf("memory %s listed with null tags", string(m["memory_id"]))
+			}
+			if id := string(m["memory_id"]); (id == `"no-tags"` || id == `"null-tags"`) && string(m["tags"]) != "[]" {
+				t.Errorf("memory %s: expected \"tags\":[], got %s", id, string(m["tags"]))
+			}
+		}
+	})
+
+	t.Run("search-memories-field-scoped", func(t *testing.T) {
+		for _, m := range []struct {
+			id, content string
+			tags        []string
+		}{
+			{"fs-1", "deploy the api server", []string{"api", "ops"}},
+			{"fs-2", "deploy the web app", []string{"web"}},
+			{"fs-3", "api docs", []string{"docs"}},
+			{"fs-4", "100% deploy_ready", []string{"two words"}},
+			{"fs-5", "1000 deployXready", nil},
+		} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": m.id, "content": m.content, "tags": m.tags})
+			resp.Body.Close()
+		}
+		for _, tc := range []struct{ query, want string }{
+			{`tag:api content:deploy`, "fs-1"},
+			{`fs- content:deploy`, "fs-1,fs-2,fs-4,fs-5"},
+			{`TAG:web`, "fs-2"},
+			{`tag:web content:api`, ""},
+			{`tag:"two words"`, "fs-4"},
+			{`content:"the web"`, "fs-2"},
+			{`content:100%`, "fs-4"},
+			{`content:deploy_ready`, "fs-4"},
+			{`fs- tag:api tag:ops`, "fs-1"},
+		} {
+			resp := getJSON(t, "/search-memories?q="+url.QueryEscape(tc.query))
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Errorf("search %q failed: %v\nBody: %s", tc.query, resp.Status, string(body))
+				continue
+			}
+			var page SearchResponse
+			if err := json.Unmarshal(body, &page); err != nil {
+				t.Fatalf("search-memories unmarshal: %v", err)
+			}
+			var ids []string
+			for _, m := range page.Memories {
+				ids = append(ids, m.MemoryID)
+			}
+			if got := strings.Join(ids, ","); got != tc.want {
+				t.Errorf("search %q: got %q, want %q", tc.query, got, tc.want)
+			}
+		}
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		saveOrUpdate := func(path string, body map[string]interface{}) (int, Memory) {
+			resp := postJSON(t, path, body)
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			var m Memory
+			json.Unmarshal(data, &m)
+			return resp.StatusCode, m
+		}
+		code, m := saveOrUpdate("/save-memory", map[string]interface{}{"memory_id": "meta", "content": "with metadata", "metadata": map[string]interface{}{"source": "agent", "confidence": 0.9}})
+		if code != 200 || string(m.Metadata) != `{"confidence":0.9,"source":"agent"}` {
+			t.Errorf("save-memory with metadata: got %d %s", code, string(m.Metadata))
+		}
+
+		// Retagging keeps the metadata, while a full update replaces it
+		code, m = saveOrUpdate("/add-tag", map[string]interface{}{"memory_id": "meta", "tag": "x"})
+		if code != 200 || string(m.Metadata) != `{"confidence":0.9,"source":"agent"}` {
+			t.Errorf("add-tag lost the metadata: got %d %s", code, string(m.Metadata))
+		}
+		code, m = saveOrUpdate("/update-memory", map[string]interface{}{"memory_id": "meta", "content": "no metadata now"})
+		if code != 200 || string(m.Metadata) != "{}" {
+			t.Errorf("update-memory without metadata: got %d %s", code, string(m.Metadata))
+		}
+
+		for _, bad := range []interface{}{[]int{1, 2}, "text", 42} {
+			code, _ = saveOrUpdate("/save-memory", map[string]interface{}{"memory_id": "meta-bad", "content": "x", "metadata": bad})
+			if code != 400 {
+				t.Errorf("metadata %v: expected 400, got %d", bad, code)
+			}
+		}
+	})
+
+	t.Run("compact-memory", func(t *testing.T) {
+		for i := 1; i <= 6; i++ {
+			resp := postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "compact", "content": fmt.Sprintf("c%d", i)})
+			resp.Body.Close()
+		}
+		compact := func(body map[string]interface{}) (int, int) {
+			resp := postJSON(t, "/compact-memory", body)
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			var result struct {
+				Removed int `json:"removed"`
+			}
+			json.Unmarshal(data, &result)
+			return resp.StatusCode, result.Removed
+		}
+		versions := func() []int {
+			resp := getJSON(t, "/export")
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			var doc struct {
+				Memories []Memory `json:"memories"`
+			}
+			if err := json.Unmarshal(data, &doc); err != nil {
+				t.Fatalf("export unmarshal: %v", err)
+			}
+			var vs []int
+			for _, m := range doc.Memories {
+				if m.MemoryID == "compact" {
+					vs = append(vs, m.Version)
+				}
+			}
+			return vs
+		}
+
+		// The older versions are already archived, so archiving them again changes nothing
+		if code, removed := compact(map[string]interface{}{"memory_id": "compact", "keep_last": 2}); code != 200 || removed != 0 {
+			t.Errorf("archive-only compact: got %d removed=%d", code, removed)
+		}
+		if code, removed := compact(map[string]interface{}{"memory_id": "compact", "keep_last": 2, "hard_delete": true}); code != 200 || removed != 4 {
+			t.Errorf("hard_delete compact: expected 4 removed, got %d removed=%d", code, removed)
+		}
+		if vs := versions(); fmt.Sprint(vs) != "[5 6]" {
+			t.Errorf("expected versions 5 and 6 to remain, got %v", vs)
+		}
+		resp := getJSON(t, "/get-memory-by-id/compact")
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("latest version lost by compaction: %v", resp.Status)
+		}
+
+		if code, _ := compact(map[string]interface{}{"memory_id": "compact", "keep_last": 0}); code != 400 {
+			t.Errorf("keep_last=0: expected 400, got %d", code)
+		}
+		if code, _ := compact(map[string]interface{}{"memory_id": "compact-missing", "keep_last": 1}); code != 404 {
+			t.Errorf("missing memory: expected 404, got %d", code)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		resp := getJSON(t, "/metrics")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("metrics failed: %v", resp.Status)
+		}
+		for _, want := range []string{
+			`memory_server_http_requests_total{method="POST",route="/save-memory",status="200"}`,
+			`memory_server_http_request_duration_seconds_count{method="GET",route="/get-memory-by-id/{memory_id}"}`,
+			`memory_server_memory_writes_total{operation="save"}`,
+			`memory_server_memory_writes_total{operation="update"}`,
+			`memory_server_memory_writes_total{operation="delete"}`,
+			`memory_server_memory_writes_total{operation="rename"}`,
+			`memory_server_db_errors_total 0`,
+		} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("metrics output is missing %s", want)
+			}
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", baseURL+"/events", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("events failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			t.Fatalf("unexpected events response: %v %s", resp.Status, resp.Header.Get("Content-Type"))
+		}
+
+		// Collect "event:" and "data:" pairs in the background
+		received := make(chan string, 10)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			var event string
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, "event: "):
+					event = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					received <- event + " " + strings.TrimPrefix(line, "data: ")
+				}
+			}
+		}()
+
+		r := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "evented", "content": "e1"})
+		r.Body.Close()
+		r = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "evented", "content": "e2"})
+		r.Body.Close()
+		r = postJSON(t, "/delete-memory", map[string]interface{}{"memory_id": "evented"})
+		r.Body.Close()
+		r = postJSON(t, "/rename-memory", map[string]interface{}{"old_memory_id": "evented", "new_memory_id": "evented-renamed"})
+		r.Body.Close()
+		for _, want := range []string{
+			`saved {"type":"saved","namespace":"default","memory_id":"evented","version":1}`,
+			`updated {"type":"updated","namespace":"default","memory_id":"evented","version":2}`,
+			`deleted {"type":"deleted","namespace":"default","memory_id":"evented"}`,
+			// A rename is a delete of the old memory_id and a save of the new one
+			`deleted {"type":"deleted","namespace":"default","memory_id":"evented"}`,
+			`saved {"type":"saved","namespace":"default","memory_id":"evented-renamed","version":2}`,
+		} {
+			select {
+			case got := <-received:
+				if got != want {
+					t.Errorf("event: got %s, want %s", got, want)
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for event %s", want)
+			}
+		}
+	})
+
+	t.Run("delete-memory-dry-run", func(t *testing.T) {
+		// Saves leave earlier versions active, so there are three active rows to archive
+		for _, content := range []string{"dry1", "dry2", "dry3"} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "dry-run", "content": content})
+			resp.Body.Close()
+		}
+		resp := postJSON(t, "/delete-memory", map[string]interface{}{"memory_id": "dry-run", "dry_run": true})
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var result StatusResponse
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatalf("delete-memory unmarshal: %v\nBody: %s", err, string(body))
+		}
+		if resp.StatusCode != 200 || result.Status != "dry_run" || result.WouldArchive == nil || *result.WouldArchive != 3 {
+			t.Fatalf("expected a dry run of 3 rows, got %v %s", resp.Status, string(body))
+		}
+
+		// Nothing was archived
+		resp = getJSON(t, "/get-memory-by-id/dry-run")
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("expected the memory still active after a dry run, got %v", resp.Status)
+		}
+
+		// A real delete doesn't report a count
+		resp = postJSON(t, "/delete-memory", map[string]interface{}{"memory_id": "dry-run"})
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(body), "would_archive") {
+			t.Errorf("unexpected would_archive in a real delete: %s", string(body))
+		}
+		resp = getJSON(t, "/get-memory-by-id/dry-run")
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("expected the memory archived, got %v", resp.Status)
+		}
+	})
+
+	t.Run("list-memories-archived-filter", func(t *testing.T) {
+		// trash-a has an archived first version under an active second one, trash-b has been deleted entirely
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "trash-a", "content": "a1"})
+		resp.Body.Close()
+		resp = postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "trash-a", "content": "a2"})
+		resp.Body.Close()
+		resp = postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "trash-b", "content": "b1"})
+		resp.Body.Close()
+		resp = postJSON(t, "/delete-memory", map[string]interface{}{"memory_id": "trash-b"})
+		resp.Body.Close()
+
+		// Returns the listed versions of the trash memories, keyed by memory_id
+		list := func(archived string) map[string][]Memory {
+			resp := getJSON(t, "/list-memories?archived="+archived)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("list-memories?archived=%s failed: %v", archived, resp.Status)
+			}
+			var memories []Memory
+			if err := json.Unmarshal(body, &memories); err != nil {
+				t.Fatalf("list-memories unmarshal: %v", err)
+			}
+			found := map[string][]Memory{}
+			for _, m := range memories {
+				if strings.HasPrefix(m.MemoryID, "trash-") {
+					found[m.MemoryID] = append(found[m.MemoryID], m)
+				}
+			}
+			return found
+		}
+
+		active := list("active")
+		if len(active) != 1 || len(active["trash-a"]) != 1 || active["trash-a"][0].Version != 2 {
+			t.Errorf("archived=active: expected only trash-a version 2, got %+v", active)
+		}
+		trash := list("archived")
+		if len(trash["trash-a"]) != 1 || trash["trash-a"][0].Version != 1 || len(trash["trash-b"]) != 1 || !trash["trash-b"][0].Archived {
+			t.Errorf("archived=archived: expected trash-a version 1 and trash-b, got %+v", trash)
+		}
+		all := list("all")
+		if len(all["trash-a"]) != 1 || all["trash-a"][0].Version != 2 || all["trash-a"][0].Archived {
+			t.Errorf("archived=all: expected only the active trash-a version 2, got %+v", all["trash-a"])
+		}
+		if len(all["trash-b"]) != 1 || !all["trash-b"][0].Archived {
+			t.Errorf("archived=all: expected trash-b once, archived, got %+v", all["trash-b"])
+		}
+
+		resp = getJSON(t, "/list-memories?archived=sometimes")
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("archived=sometimes: expected 400, got %v", resp.Status)
+		}
+	})
+
+	t.Run("search-memories-fuzzy", func(t *testing.T) {
+		for id, content := range map[string]string{"fuzzy-exact": "runs on kubernetes nodes", "fuzzy-typo": "runs on kubernets nodes"} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": id, "content": content})
+			resp.Body.Close()
+		}
+		search := func(query string) []string {
+			resp := getJSON(t, "/search-memories?"+query)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("search-memories?%s failed: %v %s", query, resp.Status, string(body))
+			}
+			var page SearchResponse
+			if err := json.Unmarshal(body, &page); err != nil {
+				t.Fatalf("search-memories unmarshal: %v", err)
+			}
+			var ids []string
+			for _, m := range page.Memories {
+				ids = append(ids, m.MemoryID)
+			}
+			return ids
+		}
+
+		// The exact spelling ranks ahead of the typo
+		if ids := search("q=kubernetes&fuzzy=true"); len(ids) != 2 || ids[0] != "fuzzy-exact" || ids[1] != "fuzzy-typo" {
+			t.Errorf("fuzzy=true: expected fuzzy-exact then fuzzy-typo, got %v", ids)
+		}
+		if ids := search("q=kubernetes&fuzzy=true&max_distance=0"); len(ids) != 1 || ids[0] != "fuzzy-exact" {
+			t.Errorf("max_distance=0: expected only fuzzy-exact, got %v", ids)
+		}
+		if ids := search("q=kubernetes"); len(ids) != 1 {
+			t.Errorf("without fuzzy: expected only the exact spelling, got %v", ids)
+		}
+		if ids := search("q=content:kubernetz%20rnus&fuzzy=true"); len(ids) != 2 {
+			t.Errorf("fuzzy content term: expected both memories, got %v", ids)
+		}
+
+		for _, query := range []string{"q=x&fuzzy=true&mode=word", "q=x&fuzzy=true&max_distance=9"} {
+			resp := getJSON(t, "/search-memories?"+query)
+			resp.Body.Close()
+			if resp.StatusCode != 400 {
+				t.Errorf("search-memories?%s: expected 400, got %v", query, resp.Status)
+			}
+		}
+	})
+
+	t.Run("request-id", func(t *testing.T) {
+		// Capture the server's log lines for this subtest
+		var logs bytes.Buffer
+		defer slog.SetDefault(slog.Default())
+		slog.SetDefault(slog.New(server.LogHandler(slog.NewTextHandler(&logs, nil))))
+
+		req, _ := http.NewRequest("GET", baseURL+"/get-memory-by-id/no-such-memory", nil)
+		req.Header.Set("X-Request-ID", "client-chosen-id")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get-memory-by-id failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Request-ID"); got != "client-chosen-id" {
+			t.Errorf("expected the client's request ID echoed, got %q", got)
+		}
+		var problem struct {
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(body, &problem); err != nil || problem.RequestID != "client-chosen-id" {
+			t.Errorf("expected the request ID in the error body, got %s", string(body))
+		}
+		if !strings.Contains(logs.String(), "request_id=client-chosen-id") {
+			t.Errorf("expected the request ID in the request log, got %s", logs.String())
+		}
+
+		// Otherwise a UUID is generated, and unusable IDs are replaced
+		for _, supplied := range []string{"", "has spaces in it"} {
+			req, _ := http.NewRequest("GET", baseURL+"/healthz", nil)
+			if supplied != "" {
+				req.Header.Set("X-Request-ID", supplied)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("healthz failed: %v", err)
+			}
+			resp.Body.Close()
+			if id := resp.Header.Get("X-Request-ID"); len(id) != 36 || strings.Count(id, "-") != 4 {
+				t.Errorf("X-Request-ID %q: expected a generated UUID, got %q", supplied, id)
+			}
+		}
+	})
+
+	t.Run("get-memory-version", func(t *testing.T) {
+		for _, content := range []string{"first draft", "second draft"} {
+			resp := postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "versioned", "content": content})
+			resp.Body.Close()
+		}
+
+		// Version 1 was archived by the update, but can still be fetched
+		resp := getJSON(t, "/get-memory-by-id/versioned/version/1")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var m Memory
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Fatalf("get-memory-by-id version unmarshal: %v\nBody: %s", err, string(body))
+		}
+		if resp.StatusCode != 200 || m.Version != 1 || m.Content != "first draft" || !m.Archived {
+			t.Errorf("expected archived version 1, got %v %s", resp.Status, string(body))
+		}
+
+		for path, status := range map[string]int{
+			"/get-memory-by-id/versioned/version/3":    404,
+			"/get-memory-by-id/no-such-memory/version/1": 404,
+			"/get-memory-by-id/versioned/version/zero": 400,
+		} {
+			resp := getJSON(t, path)
+			resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Errorf("%s: expected %d, got %v", path, status, resp.Status)
+			}
+		}
+	})
+
+	t.Run("tag-limits", func(t *testing.T) {
+		numbered := func(n int) []string {
+			tags := make([]string, n)
+			for i := range tags {
+				tags[i] = fmt.Sprintf("limit-%d", i)
+			}
+			return tags
+		}
+		save := func(tags []string) int {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "tag-limits", "content": "tagged", "tags": tags})
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		for _, tc := range []struct {
+			name   string
+			tags   []string
+			status int
+		}{
+			{"50 tags", numbered(50), 200},
+			{"51 tags", numbered(51), 400},
+			{"51 tags with a duplicate", append(numbered(50), "limit-0"), 200},
+			{"64 character tag", []string{strings.Repeat("x", 64)}, 200},
+			{"65 character tag", []string{strings.Repeat("x", 65)}, 400},
+			{"64 multibyte characters", []string{strings.Repeat("é", 64)}, 200},
+		} {
+			if status := save(tc.tags); status != tc.status {
+				t.Errorf("%s: expected %d, got %d", tc.name, tc.status, status)
+			}
+		}
+
+		// Adding a tag can't take a memory over the limit either
+		if status := save(numbered(50)); status != 200 {
+			t.Fatalf("save with 50 tags: got %d", status)
+		}
+		resp := postJSON(t, "/add-tag", map[string]interface{}{"memory_id": "tag-limits", "tag": "one-too-many"})
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("add-tag past the limit: expected 400, got %v", resp.Status)
+		}
+		resp = postJSON(t, "/add-tag", map[string]interface{}{"memory_id": "tag-limits", "tag": strings.Repeat("x", 65)})
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("add-tag with a 65 character tag: expected 400, got %v", resp.Status)
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		// Setting Accept-Encoding ourselves stops the client from transparently decompressing
+		fetch := func(path string, gzipped bool) *http.Response {
+			req, _ := http.NewRequest("GET", baseURL+path, nil)
+			if gzipped {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", path, err)
+			}
+			return resp
+		}
+
+		resp := fetch("/export", false)
+		plain, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp = fetch("/export", true)
+		compressed, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Any Content-Length must be the compressed size
+		if cl := resp.Header.Get("Content-Length"); resp.Header.Get("Content-Encoding") != "gzip" || (cl != "" && cl != strconv.Itoa(len(compressed))) {
+			t.Fatalf("expected a gzipped export of %d bytes, got headers %v", len(compressed), resp.Header)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("export isn't valid gzip: %v", err)
+		}
+		decompressed, _ := ioutil.ReadAll(zr)
+		// exported_at differs between the two requests, so only the sizes are compared
+		if len(decompressed) == 0 || len(compressed) >= len(plain) {
+			t.Errorf("expected gzip to shrink the export, got %d bytes from %d", len(compressed), len(plain))
+		}
+		t.Logf("/export: %d bytes uncompressed, %d gzipped (%.0f%% smaller)", len(plain), len(compressed), 100*(1-float64(len(compressed))/float64(len(plain))))
+
+		// Small responses aren't worth compressing
+		resp = fetch("/healthz", true)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != "" || !strings.Contains(string(body), "ok") {
+			t.Errorf("expected /healthz uncompressed, got %v %s", resp.Header.Get("Content-Encoding"), string(body))
+		}
+
+		// /metrics compresses itself, and mustn't be compressed a second time
+		resp = fetch("/metrics", true)
+		compressed, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		zr, err = gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("metrics isn't valid gzip: %v", err)
+		}
+		decompressed, _ = ioutil.ReadAll(zr)
+		if !strings.Contains(string(decompressed), "memory_server_http_requests_total") {
+			t.Errorf("expected metrics after decompressing once, got %.100q", decompressed)
+		}
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		for _, m := range []map[string]interface{}{
+			{"memory_id": "diffed", "content": "line one\nline two\nline three", "tags": []string{"keep", "old"}},
+			{"memory_id": "diffed", "content": "line one\nline 2\nline three", "tags": []string{"keep", "new"}},
+		} {
+			resp := postJSON(t, "/update-memory", m)
+			resp.Body.Close()
+		}
+		resp := getJSON(t, "/diff/diffed?from=1&to=2")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var d struct {
+			Diff        string   `json:"diff"`
+			TagsAdded   []string `json:"tags_added"`
+			TagsRemoved []string `json:"tags_removed"`
+		}
+		if err := json.Unmarshal(body, &d); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("diff: %v %v\nBody: %s", resp.Status, err, string(body))
+		}
+		if !strings.Contains(d.Diff, "-line two\n") || !strings.Contains(d.Diff, "+line 2\n") || !strings.Contains(d.Diff, " line one\n") {
+			t.Errorf("unexpected diff:\n%s", d.Diff)
+		}
+		if !reflect.DeepEqual(d.TagsAdded, []string{"new"}) || !reflect.DeepEqual(d.TagsRemoved, []string{"old"}) {
+			t.Errorf("expected tag changes +[new] -[old], got +%v -%v", d.TagsAdded, d.TagsRemoved)
+		}
+
+		for path, status := range map[string]int{
+			"/diff/diffed?from=1&to=3":         404,
+			"/diff/no-such-memory?from=1&to=2": 404,
+			"/diff/diffed?from=1":              400,
+			"/diff/diffed?from=one&to=2":       400,
+		} {
+			resp := getJSON(t, path)
+			resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Errorf("%s: expected %d, got %v", path, status, resp.Status)
+			}
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		for _, id := range []string{"ndjson-a", "ndjson-b"} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": id, "content": "streamed"})
+			resp.Body.Close()
+		}
+		for _, path := range []string{"/list-memories", "/export"} {
+			req, _ := http.NewRequest("GET", baseURL+path, nil)
+			req.Header.Set("Accept", "application/x-ndjson")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "application/x-ndjson" {
+				t.Errorf("%s: expected 200 application/x-ndjson, got %v %q", path, resp.Status, ct)
+			}
+			seen := map[string]bool{}
+			lines := 0
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				var m Memory
+				if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+					t.Fatalf("%s: line %d isn't a memory: %v\n%s", path, lines+1, err, scanner.Text())
+				}
+				seen[m.MemoryID] = true
+				lines++
+			}
+			resp.Body.Close()
+			if !seen["ndjson-a"] || !seen["ndjson-b"] {
+				t.Errorf("%s: expected both memories among the %d lines streamed", path, lines)
+			}
+		}
+
+		// Without the header the usual JSON array comes back
+		resp := getJSON(t, "/list-memories")
+		var memories []Memory
+		if err := json.NewDecoder(resp.Body).Decode(&memories); err != nil {
+			t.Errorf("list-memories without NDJSON: expected a JSON array: %v", err)
+		}
+		resp.Body.Close()
+	})
+
+	t.Run("append-prepend", func(t *testing.T) {
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "log", "content": "middle\n", "tags": []string{"log"}})
+		resp.Body.Close()
+		edit := func(path, text string) (int, Memory) {
+			resp := postJSON(t, path, map[string]interface{}{"memory_id": "log", "text": text})
+			defer resp.Body.Close()
+			var m Memory
+			json.NewDecoder(resp.Body).Decode(&m)
+			return resp.StatusCode, m
+		}
+		if status, m := edit("/append-memory", "end\n"); status != 200 || m.Content != "middle\nend\n" || m.Version != 2 {
+			t.Errorf("append-memory: expected version 2 ending with the text, got %d %+v", status, m)
+		}
+		status, m := edit("/prepend-memory", "start\n")
+		if status != 200 || m.Content != "start\nmiddle\nend\n" || m.Version != 3 {
+			t.Errorf("prepend-memory: expected version 3 starting with the text, got %d %+v", status, m)
+		}
+		if !reflect.DeepEqual(m.Tags, []string{"log"}) {
+			t.Errorf("prepend-memory: expected the tags to be kept, got %v", m.Tags)
+		}
+
+		// The previous version is archived, as with /update-memory
+		resp = getJSON(t, "/get-memory-by-id/log/version/2")
+		var prev Memory
+		json.NewDecoder(resp.Body).Decode(&prev)
+		resp.Body.Close()
+		if !prev.Archived {
+			t.Errorf("expected version 2 to be archived after prepending")
+		}
+
+		for _, tc := range []struct {
+			body   map[string]interface{}
+			status int
+		}{
+			{map[string]interface{}{"memory_id": "no-such-log", "text": "x"}, 404},
+			{map[string]interface{}{"memory_id": "log", "text": ""}, 400},
+			{map[string]interface{}{"memory_id": "", "text": "x"}, 400},
+		} {
+			resp := postJSON(t, "/append-memory", tc.body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("append-memory %v: expected %d, got %v", tc.body, tc.status, resp.Status)
+			}
+		}
+	})
+
+	t.Run("update-unchanged", func(t *testing.T) {
+		update := func(body map[string]interface{}) (string, int) {
+			resp := postJSON(t, "/update-memory", body)
+			defer resp.Body.Close()
+			var r struct {
+				Status  string `json:"status"`
+				Version int    `json:"version"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || resp.StatusCode != 200 {
+				t.Fatalf("update-memory %v: %v %v", body, resp.Status, err)
+			}
+			return r.Status, r.Version
+		}
+		same := map[string]interface{}{"memory_id": "dedupe", "content": "same", "tags": []string{"a", "b"}}
+		if status, version := update(same); status != "updated" || version != 1 {
+			t.Errorf("first update: expected updated version 1, got %s %d", status, version)
+		}
+		if status, version := update(map[string]interface{}{"memory_id": "dedupe", "content": "same", "tags": []string{"b", "a"}}); status != "unchanged" || version != 1 {
+			t.Errorf("identical update: expected unchanged version 1, got %s %d", status, version)
+		}
+		if status, version := update(map[string]interface{}{"memory_id": "dedupe", "content": "same", "tags": []string{"a", "b"}, "force": true}); status != "updated" || version != 2 {
+			t.Errorf("forced update: expected updated version 2, got %s %d", status, version)
+		}
+		if status, version := update(map[string]interface{}{"memory_id": "dedupe", "content": "same", "tags": []string{"a"}}); status != "updated" || version != 3 {
+			t.Errorf("update with different tags: expected updated version 3, got %s %d", status, version)
+		}
+	})
+
+	t.Run("search-highlight", func(t *testing.T) {
+		long := strings.Repeat("padding ", 50) + "the Needle <here> " + strings.Repeat("filler ", 50)
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "highlight", "content": long})
+		resp.Body.Close()
+		search := func(query string) Memory {
+			resp := getJSON(t, "/search-memories?"+query)
+			defer resp.Body.Close()
+			var sr struct {
+				Memories []Memory `json:"memories"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil || len(sr.Memories) != 1 {
+				t.Fatalf("search %s: expected one result, got %v %v", query, resp.Status, err)
+			}
+			return sr.Memories[0]
+		}
+
+		m := search("q=needle&highlight=true")
+		if !strings.Contains(m.Snippet, "<mark>Needle</mark> &lt;here&gt;") {
+			t.Errorf("expected the match marked and the rest escaped, got %q", m.Snippet)
+		}
+		if !strings.HasPrefix(m.Snippet, "…") || !strings.HasSuffix(m.Snippet, "…") || utf8.RuneCountInString(m.Snippet) > 250 {
+			t.Errorf("expected a trimmed snippet around the match, got %d chars: %q", utf8.RuneCountInString(m.Snippet), m.Snippet)
+		}
+
+		m = search("q=needle&highlight=true&highlight_start=%5B&highlight_end=%5D")
+		if !strings.Contains(m.Snippet, "[Needle] <here>") {
+			t.Errorf("expected custom delimiters without escaping, got %q", m.Snippet)
+		}
+
+		if m = search("q=needle"); m.Snippet != "" {
+			t.Errorf("expected no snippet without highlight, got %q", m.Snippet)
+		}
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		changes := func(since string) (time.Time, []Memory) {
+			resp := getJSON(t, "/changes?since="+url.QueryEscape(since))
+			defer resp.Body.Close()
+			var cr struct {
+				ServerTime time.Time `json:"server_time"`
+				Memories   []Memory  `json:"memories"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil || resp.StatusCode != 200 {
+				t.Fatalf("changes since %s: %v %v", since, resp.Status, err)
+			}
+			return cr.ServerTime, cr.Memories
+		}
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "sync-a", "content": "before"})
+		resp.Body.Close()
+		cursor, all := changes("2000-01-01T00:00:00Z")
+		if len(all) == 0 {
+			t.Fatalf("expected every row since 2000")
+		}
+		for i := 1; i < len(all); i++ {
+			if all[i].UpdatedAt.Before(all[i-1].UpdatedAt) {
+				t.Fatalf("changes not ordered by updated_at: %v before %v", all[i-1].UpdatedAt, all[i].UpdatedAt)
+			}
+		}
+
+		// Only versions written after the cursor come back
+		for _, req := range []struct{ path, id string }{{"/save-memory", "sync-b"}, {"/update-memory", "sync-a"}} {
+			resp := postJSON(t, req.path, map[string]interface{}{"memory_id": req.id, "content": "after"})
+			resp.Body.Close()
+		}
+		_, delta := changes(cursor.Format(time.RFC3339Nano))
+		var got []string
+		for _, m := range delta {
+			got = append(got, fmt.Sprintf("%s@%d", m.MemoryID, m.Version))
+		}
+		if want := []string{"sync-b@1", "sync-a@2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected changes %v since the cursor, got %v", want, got)
+		}
+
+		for _, since := range []string{"", "yesterday"} {
+			resp := getJSON(t, "/changes?since="+since)
+			resp.Body.Close()
+			if resp.StatusCode != 400 {
+				t.Errorf("changes since %q: expected 400, got %v", since, resp.Status)
+			}
+		}
+	})
+
+	t.Run("malformed-params", func(t *testing.T) {
+		// Each malformed parameter is a 400 whose detail names it
+		for _, tc := range []struct{ path, param string }{
+			{"/search-memories?q=a&limit=ten", "limit"},
+			{"/search-memories?q=a&offset=first", "offset"},
+			{"/search-memories?q=a&fuzzy=maybe", "fuzzy"},
+			{"/search-memories?q=a&fuzzy=true&max_distance=far", "max_distance"},
+			{"/search-memories?q=a&highlight=yes", "highlight"},
+			{"/search-memories?q=a&mode=sideways", "mode"},
+			{"/search-memories?q=a&created_after=yesterday", "created_after"},
+			{"/list-memories?updated_before=soon", "updated_before"},
+			{"/list-memories?sort=colour", "sort"},
+			{"/list-memories?order=sideways", "order"},
+			{"/list-memories?archived=maybe", "archived"},
+			{"/changes?since=yesterday", "since"},
+			{"/diff/any?from=first&to=2", "from"},
+		} {
+			resp := getJSON(t, tc.path)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 400 || !strings.Contains(string(body), tc.param) {
+				t.Errorf("%s: expected 400 mentioning %s, got %v %s", tc.path, tc.param, resp.Status, string(body))
+			}
+		}
+		resp := postJSON(t, "/bulk-save?atomic=perhaps", []map[string]interface{}{{"memory_id": "never", "content": "saved"}})
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 400 || !strings.Contains(string(body), "atomic") {
+			t.Errorf("bulk-save with a malformed atomic: expected 400 mentioning atomic, got %v %s", resp.Status, string(body))
+		}
+	})
+
+	t.Run("namespaces", func(t *testing.T) {
+		// The same memory_id in two namespaces is two separate memories, each with its own versions
+		for _, ns := range []string{"", "project-a"} {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"namespace": ns, "memory_id": "shared-id", "content": "in " + ns})
+			var m Memory
+			json.NewDecoder(resp.Body).Decode(&m)
+			resp.Body.Close()
+			want := ns
+			if want == "" {
+				want = "default"
+			}
+			if resp.StatusCode != 200 || m.Namespace != want || m.Version != 1 {
+				t.Fatalf("save-memory in namespace %q: got %v, namespace %q version %d", ns, resp.Status, m.Namespace, m.Version)
+			}
+		}
+		get := func(path string) Memory {
+			resp := getJSON(t, path)
+			defer resp.Body.Close()
+			var m Memory
+			if resp.StatusCode != 200 {
+				t.Fatalf("GET %s: expected 200, got %v", path, resp.Status)
+			}
+			json.NewDecoder(resp.Body).Decode(&m)
+			return m
+		}
+		if m := get("/get-memory-by-id/shared-id"); m.Content != "in " {
+			t.Errorf("get-memory-by-id without a namespace: expected the default namespace's memory, got %q", m.Content)
+		}
+		if m := get("/get-memory-by-id/shared-id?namespace=project-a"); m.Content != "in project-a" {
+			t.Errorf("get-memory-by-id in project-a: got %q", m.Content)
+		}
+
+		// Deleting in one namespace leaves the other alone
+		resp := postJSON(t, "/delete-memory", map[string]interface{}{"namespace": "project-a", "memory_id": "shared-id"})
+		resp.Body.Close()
+		resp = getJSON(t, "/get-memory-by-id/shared-id?namespace=project-a")
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("get-memory-by-id after deleting in project-a: expected 404, got %v", resp.Status)
+		}
+		get("/get-memory-by-id/shared-id")
+
+		// Listing and searching only see the requested namespace
+		resp = postJSON(t, "/save-memory", map[string]interface{}{"namespace": "project-b", "memory_id": "only-in-b", "content": "namespaced needle"})
+		resp.Body.Close()
+		resp = getJSON(t, "/list-memories?namespace=project-b")
+		var listed []Memory
+		json.NewDecoder(resp.Body).Decode(&listed)
+		resp.Body.Close()
+		if len(listed) != 1 || listed[0].MemoryID != "only-in-b" {
+			t.Errorf("list-memories in project-b: expected just only-in-b, got %v", listed)
+		}
+		for _, tc := range []struct {
+			namespace string
+			want      int
+		}{{"project-b", 1}, {"", 0}} {
+			resp = getJSON(t, "/search-memories?q=namespaced+needle&namespace="+tc.namespace)
+			var sr SearchResponse
+			json.NewDecoder(resp.Body).Decode(&sr)
+			resp.Body.Close()
+			if sr.Total != tc.want {
+				t.Errorf("search in namespace %q: expected %d results, got %d", tc.namespace, tc.want, sr.Total)
+			}
+		}
+
+		resp = getJSON(t, "/list-memories?namespace=bad%20namespace")
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("list-memories with an invalid namespace: expected 400, got %v", resp.Status)
+		}
+	})
+
+	t.Run("undo-memory", func(t *testing.T) {
+		for _, req := range []struct{ path, content string }{{"/save-memory", "good"}, {"/update-memory", "bad edit"}} {
+			resp := postJSON(t, req.path, map[string]interface{}{"memory_id": "undoable", "content": req.content})
+			resp.Body.Close()
+		}
+		resp := postJSON(t, "/undo-memory", map[string]interface{}{"memory_id": "undoable"})
+		var m Memory
+		json.NewDecoder(resp.Body).Decode(&m)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || m.Version != 1 || m.Content != "good" || m.Archived {
+			t.Fatalf("undo-memory: expected active version 1 with the original content, got %v %+v", resp.Status, m)
+		}
+		resp = getJSON(t, "/get-memory-by-id/undoable")
+		json.NewDecoder(resp.Body).Decode(&m)
+		resp.Body.Close()
+		if m.Version != 1 || m.Content != "good" {
+			t.Errorf("get-memory-by-id after undo: expected version 1, got version %d %q", m.Version, m.Content)
+		}
+
+		// There's nothing before the first version, nor any version of an unknown memory
+		for _, id := range []string{"undoable", "never-saved"} {
+			resp = postJSON(t, "/undo-memory", map[string]interface{}{"memory_id": id})
+			resp.Body.Close()
+			if resp.StatusCode != 404 {
+				t.Errorf("undo-memory of %s: expected 404, got %v", id, resp.Status)
+			}
+		}
+	})
+
+	t.Run("list-memories-by-tag-case", func(t *testing.T) {
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "upper-tagged", "content": "tagged API", "tags": []string{"API"}})
+		resp.Body.Close()
+		for _, tc := range []struct {
+			query string
+			want  bool
+		}{
+			{"tag=api", false},
+			{"tag=API", true},
+			{"tag=api&case_insensitive=true", true},
+			{"tag=Api&case_insensitive=true", true},
+			{"tag=api&case_insensitive=false", false},
+		} {
+			resp := getJSON(t, "/list-memories-by-tag?"+tc.query)
+			var memories []Memory
+			json.NewDecoder(resp.Body).Decode(&memories)
+			resp.Body.Close()
+			found := false
+			for _, m := range memories {
+				found = found || m.MemoryID == "upper-tagged"
+			}
+			if resp.StatusCode != 200 || found != tc.want {
+				t.Errorf("list-memories-by-tag?%s: expected found=%v, got %v found=%v", tc.query, tc.want, resp.Status, found)
+			}
+		}
+	})
+
+	t.Run("docs", func(t *testing.T) {
+		// /docs redirects to /docs/, which serves the Swagger UI page pointing at the spec
+		resp := getJSON(t, "/docs")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("docs: expected a 200 HTML page, got %v %s", resp.Status, resp.Header.Get("Content-Type"))
+		}
+		if resp.Request.URL.Path != "/docs/" || !strings.Contains(string(body), "openapi.json") {
+			t.Errorf("docs: expected the page at /docs/ to load openapi.json, got %s", resp.Request.URL.Path)
+		}
+
+		// Swagger UI's own files are embedded, so the page works offline
+		for file, contentType := range map[string]string{"swagger-ui-bundle.js": "javascript", "swagger-ui.css": "text/css"} {
+			resp := getJSON(t, "/docs/"+file)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 || !strings.Contains(resp.Header.Get("Content-Type"), contentType) || len(body) == 0 {
+				t.Errorf("docs: expected %s served as %s, got %v %s with %d bytes", file, contentType, resp.Status, resp.Header.Get("Content-Type"), len(body))
+			}
+			if file == "swagger-ui-bundle.js" && !bytes.Contains(body, []byte("SwaggerUIBundle")) {
+				t.Errorf("docs: %s doesn't define SwaggerUIBundle", file)
+			}
+		}
+	})
+
+	t.Run("memory-stats", func(t *testing.T) {
+		for _, req := range []struct{ path, content string }{{"/save-memory", "12345"}, {"/update-memory", "1234567890"}, {"/update-memory", "héllo"}} {
+			resp := postJSON(t, req.path, map[string]interface{}{"memory_id": "footprint", "content": req.content})
+			resp.Body.Close()
+		}
+		resp := getJSON(t, "/memory-stats/footprint")
+		var stats struct {
+			Versions       int       `json:"versions"`
+			TotalBytes     int64     `json:"total_bytes"`
+			LargestBytes   int64     `json:"largest_bytes"`
+			FirstCreatedAt time.Time `json:"first_created_at"`
+			LastUpdatedAt  time.Time `json:"last_updated_at"`
+		}
+		json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("memory-stats: expected 200, got %v", resp.Status)
+		}
+		// "héllo" is 5 characters but 6 bytes
+		if stats.Versions != 3 || stats.TotalBytes != 5+10+6 || stats.LargestBytes != 10 {
+			t.Errorf("memory-stats: expected 3 versions, 21 bytes, largest 10, got %+v", stats)
+		}
+		if stats.FirstCreatedAt.IsZero() || stats.LastUpdatedAt.Before(stats.FirstCreatedAt) {
+			t.Errorf("memory-stats: expected first_created_at <= last_updated_at, got %v and %v", stats.FirstCreatedAt, stats.LastUpdatedAt)
+		}
+
+		resp = getJSON(t, "/memory-stats/never-saved")
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("memory-stats of an unknown memory: expected 404, got %v", resp.Status)
+		}
+	})
+
+	t.Run("error-codes", func(t *testing.T) {
+		postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "coded", "content": "v1"}).Body.Close()
+		postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "coded-other", "content": "v1"}).Body.Close()
+
+		for _, tc := range []struct {
+			name   string
+			resp   func() *http.Response
+			status int
+			code   string
+		}{
+			{"invalid input", func() *http.Response {
+				return postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "bad id!", "content": "x"})
+			}, 400, "validation_failed"},
+			{"malformed parameter", func() *http.Response { return getJSON(t, "/search-memories?q=a&limit=ten") }, 400, "validation_failed"},
+			{"unknown memory", func() *http.Response { return getJSON(t, "/get-memory-by-id/no-such-memory") }, 404, "memory_not_found"},
+			{"unknown version", func() *http.Response { return getJSON(t, "/get-memory-by-id/coded/version/9") }, 404, "version_not_found"},
+			{"unknown diff version", func() *http.Response { return getJSON(t, "/diff/coded?from=1&to=9") }, 404, "version_not_found"},
+			{"nothing to undo", func() *http.Response {
+				return postJSON(t, "/undo-memory", map[string]interface{}{"memory_id": "coded"})
+			}, 404, "version_not_found"},
+			{"stale expected_version", func() *http.Response {
+				return postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "coded", "content": "v2", "expected_version": 7})
+			}, 409, "version_conflict"},
+			{"rename onto an existing memory", func() *http.Response {
+				return postJSON(t, "/rename-memory", map[string]interface{}{"old_memory_id": "coded", "new_memory_id": "coded-other"})
+			}, 409, "memory_exists"},
+		} {
+			resp := tc.resp()
+			var apiErr struct {
+				Code      string `json:"code"`
+				Message   string `json:"message"`
+				RequestID string `json:"request_id"`
+			}
+			err := json.NewDecoder(resp.Body).Decode(&apiErr)
+			resp.Body.Close()
+			if err != nil {
+				t.Errorf("%s: decoding the error body: %v", tc.name, err)
+				continue
+			}
+			if resp.StatusCode != tc.status || apiErr.Code != tc.code {
+				t.Errorf("%s: expected %d %s, got %d %s", tc.name, tc.status, tc.code, resp.StatusCode, apiErr.Code)
+			}
+			if apiErr.Message == "" || apiErr.RequestID == "" {
+				t.Errorf("%s: expected a message and request ID, got %+v", tc.name, apiErr)
+			}
+		}
+	})
+
+	t.Run("list-memory-ids", func(t *testing.T) {
+		postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "ids-only", "content": "not listed", "tags": []string{"a", "b"}}).Body.Close()
+		postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "ids-only", "content": "still not listed", "tags": []string{"a", "b", "c"}}).Body.Close()
+		postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "ids-deleted", "content": "gone"}).Body.Close()
+		postJSON(t, "/delete-memory", map[string]interface{}{"memory_id": "ids-deleted"}).Body.Close()
+
+		resp := getJSON(t, "/list-memory-ids")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("list-memory-ids failed: %v %s", resp.Status, string(body))
+		}
+		if bytes.Contains(body, []byte("content")) || bytes.Contains(body, []byte("not listed")) {
+			t.Errorf("expected no content in list-memory-ids, got %s", string(body))
+		}
+		var entries []struct {
+			MemoryID      string    `json:"memory_id"`
+			LatestVersion int       `json:"latest_version"`
+			UpdatedAt     time.Time `json:"updated_at"`
+			TagCount      int       `json:"tag_count"`
+		}
+		if err := json.Unmarshal(body, &entries); err != nil {
+			t.Fatalf("list-memory-ids returned invalid JSON: %v", err)
+		}
+		found := false
+		for i, e := range entries {
+			if i > 0 && entries[i-1].MemoryID >= e.MemoryID {
+				t.Errorf("expected memory_ids listed once each in order, got %q then %q", entries[i-1].MemoryID, e.MemoryID)
+			}
+			switch e.MemoryID {
+			case "ids-only":
+				found = true
+				if e.LatestVersion != 2 || e.TagCount != 3 || e.UpdatedAt.IsZero() {
+					t.Errorf("expected version 2 with 3 tags, got %+v", e)
+				}
+			case "ids-deleted":
+				t.Errorf("expected deleted memories left out, got %+v", e)
+			}
+		}
+		if !found {
+			t.Errorf("expected ids-only in list-memory-ids, got %s", string(body))
+		}
+	})
+
+	t.Run("conditional-save", func(t *testing.T) {
+		save := func(header, content string) (int, string) {
+			data, _ := json.Marshal(map[string]interface{}{"memory_id": "conditional", "content": content})
+			req, _ := http.NewRequest("POST", baseURL+"/save-memory", bytes.NewReader(data))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(header, "*")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("save-memory with %s: %v", header, err)
+			}
+			defer resp.Body.Close()
+			var apiErr struct {
+				Code string `json:"code"`
+			}
+			json.NewDecoder(resp.Body).Decode(&apiErr)
+			return resp.StatusCode, apiErr.Code
+		}
+
+		// Update-if-exists fails while there's nothing to update, create-if-absent then succeeds once
+		if status, code := save("If-Match", "too early"); status != 412 || code != "precondition_failed" {
+			t.Errorf("If-Match on a missing memory: expected 412 precondition_failed, got %d %s", status, code)
+		}
+		if status, _ := save("If-None-Match", "created"); status != 200 {
+			t.Errorf("If-None-Match on a missing memory: expected 200, got %d", status)
+		}
+		if status, code := save("If-None-Match", "created again"); status != 412 || code != "precondition_failed" {
+			t.Errorf("If-None-Match on an existing memory: expected 412 precondition_failed, got %d %s", status, code)
+		}
+		if status, _ := save("If-Match", "saved over"); status != 200 {
+			t.Errorf("If-Match on an existing memory: expected 200, got %d", status)
+		}
+		resp := getJSON(t, "/memory-stats/conditional")
+		var stats struct {
+			Versions int `json:"versions"`
+		}
+		json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if stats.Versions != 2 {
+			t.Errorf("expected only the 2 successful saves stored, got %d versions", stats.Versions)
+		}
+
+		// Only * is supported
+		data, _ := json.Marshal(map[string]interface{}{"memory_id": "conditional", "content": "etag"})
+		req, _ := http.NewRequest("POST", baseURL+"/save-memory", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", `"conditional-v1"`)
+		if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 400 {
+			t.Errorf("If-Match with an ETag: expected 400, got %v %v", resp, err)
+		} else {
+			resp.Body.Close()
+		}
+	})
+
+	t.Run("pagination-links", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"namespace": "paging", "memory_id": fmt.Sprintf("page-%d", i), "content": "pageable"})
+			resp.Body.Close()
+		}
+		// The middle page links everywhere, keeping the other query parameters
+		for _, path := range []string{"/list-memories?namespace=paging&limit=2&offset=2", "/search-memories?namespace=paging&q=pageable&limit=2&offset=2"} {
+			resp := getJSON(t, path)
+			resp.Body.Close()
+			links := map[string]*url.URL{}
+			for _, l := range strings.Split(resp.Header.Get("Link"), ", ") {
+				var target, rel string
+				fmt.Sscanf(l, "<%s rel=%q", &target, &rel)
+				links[rel], _ = url.Parse(strings.TrimSuffix(target, ">;"))
+			}
+			endpoint := strings.SplitN(path, "?", 2)[0]
+			for rel, offset := range map[string]string{"first": "0", "prev": "0", "next": "4", "last": "4"} {
+				u := links[rel]
+				if u == nil || u.Path != endpoint || u.Query().Get("offset") != offset || u.Query().Get("namespace") != "paging" {
+					t.Errorf("%s: expected rel=%q to %s at offset %s, got Link %q", path, rel, endpoint, offset, resp.Header.Get("Link"))
+				}
+			}
+		}
+
+		// The last page has no next, and the first no prev
+		resp := getJSON(t, "/list-memories?namespace=paging&limit=2&offset=4")
+		var page []Memory
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if len(page) != 1 || strings.Contains(resp.Header.Get("Link"), `rel="next"`) {
+			t.Errorf("last page: expected 1 memory and no next link, got %d and %q", len(page), resp.Header.Get("Link"))
+		}
+		resp = getJSON(t, "/search-memories?namespace=paging&q=pageable&limit=2")
+		resp.Body.Close()
+		if strings.Contains(resp.Header.Get("Link"), `rel="prev"`) {
+			t.Errorf("first page: expected no prev link, got %q", resp.Header.Get("Link"))
+		}
+
+		// Without limit or offset everything is listed as before
+		resp = getJSON(t, "/list-memories?namespace=paging")
+		page = nil
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if len(page) != 5 || resp.Header.Get("Link") != "" {
+			t.Errorf("unpaginated list: expected 5 memories and no Link, got %d and %q", len(page), resp.Header.Get("Link"))
+		}
+	})
+
+	t.Run("truncate-content", func(t *testing.T) {
+		long := strings.Repeat("ab", 10) + "é" + strings.Repeat("z", 20)
+		resp := postJSON(t, "/save-memory", map[string]interface{}{"namespace": "truncating", "memory_id": "long", "content": long})
+		resp.Body.Close()
+		resp = postJSON(t, "/save-memory", map[string]interface{}{"namespace": "truncating", "memory_id": "short", "content": "tiny"})
+		resp.Body.Close()
+
+		type truncatedMemory struct {
+			MemoryID      string `json:"memory_id"`
+			Content       string `json:"content"`
+			Truncated     bool   `json:"truncated"`
+			ContentLength int    `json:"content_length"`
+		}
+		var listed []truncatedMemory
+		resp = getJSON(t, "/list-memories?namespace=truncating&truncate=21")
+		json.NewDecoder(resp.Body).Decode(&listed)
+		resp.Body.Close()
+		// The cut lands inside the two byte é, so it backs off to before it
+		if len(listed) != 2 || listed[0].Content != strings.Repeat("ab", 10) || !listed[0].Truncated || listed[0].ContentLength != len(long) {
+			t.Fatalf("list-memories?truncate=21: unexpected %+v", listed)
+		}
+		if listed[1].Content != "tiny" || listed[1].Truncated || listed[1].ContentLength != 4 {
+			t.Errorf("list-memories?truncate=21: expected short content untouched, got %+v", listed[1])
+		}
+
+		var search struct {
+			Memories []truncatedMemory `json:"memories"`
+		}
+		resp = getJSON(t, "/search-memories?namespace=truncating&q=long&truncate=4")
+		json.NewDecoder(resp.Body).Decode(&search)
+		resp.Body.Close()
+		if len(search.Memories) != 1 || search.Memories[0].Content != "abab" || !search.Memories[0].Truncated {
+			t.Errorf("search-memories?truncate=4: unexpected %+v", search.Memories)
+		}
+
+		// By default content is returned in full, without the extra fields
+		resp = getJSON(t, "/list-memories?namespace=truncating")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), long) || strings.Contains(string(body), "content_length") {
+			t.Errorf("list-memories: expected full content without content_length, got %s", string(body))
+		}
+		resp = getJSON(t, "/list-memories?truncate=-1")
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("list-memories?truncate=-1: expected 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("delete-by-tag", func(t *testing.T) {
+		save := func(id string, tags ...string) {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"namespace": "tag-cleanup", "memory_id": id, "content": id, "tags": tags})
+			resp.Body.Close()
+		}
+		save("old-a", "stale", "shared")
+		save("old-b", "stale")
+		save("keep", "shared", "fresh")
+		// A memory only counts if its latest version still has the tag
+		save("retagged", "stale")
+		resp := postJSON(t, "/update-memory", map[string]interface{}{"namespace": "tag-cleanup", "memory_id": "retagged", "content": "retagged", "tags": []string{"fresh"}})
+		resp.Body.Close()
+
+		deleteByTag := func(body map[string]interface{}) (result struct {
+			Status    string   `json:"status"`
+			MemoryIDs []string `json:"memory_ids"`
+			Count     int      `json:"count"`
+		}) {
+			body["namespace"] = "tag-cleanup"
+			resp := postJSON(t, "/delete-by-tag", body)
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("delete-by-tag %v: %v", body, resp.Status)
+			}
+			json.NewDecoder(resp.Body).Decode(&result)
+			return result
+		}
+		listed := func() string {
+			resp := getJSON(t, "/list-memories?namespace=tag-cleanup")
+			defer resp.Body.Close()
+			var ids []string
+			var memories []Memory
+			json.NewDecoder(resp.Body).Decode(&memories)
+			for _, m := range memories {
+				ids = append(ids, m.MemoryID)
+			}
+			return fmt.Sprint(ids)
+		}
+
+		if r := deleteByTag(map[string]interface{}{"tag": "stale", "dry_run": true}); r.Status != "dry_run" || fmt.Sprint(r.MemoryIDs) != "[old-a old-b]" || r.Count != 2 {
+			t.Errorf("dry run: expected [old-a old-b], got %+v", r)
+		}
+		if ids := listed(); ids != "[keep old-a old-b retagged]" {
+			t.Errorf("dry run archived memories, left %s", ids)
+		}
+		if r := deleteByTag(map[string]interface{}{"tag": "stale"}); r.Status != "archived" || fmt.Sprint(r.MemoryIDs) != "[old-a old-b]" || r.Count != 2 {
+			t.Errorf("delete-by-tag: expected [old-a old-b] archived, got %+v", r)
+		}
+		// old-a's other tag doesn't save it, and keep, which shares that tag, is untouched
+		if ids := listed(); ids != "[keep retagged]" {
+			t.Errorf("expected [keep retagged] left, got %s", ids)
+		}
+		if r := deleteByTag(map[string]interface{}{"tag": "shared"}); r.Count != 1 || fmt.Sprint(r.MemoryIDs) != "[keep]" {
+			t.Errorf("delete-by-tag shared: expected just [keep] as old-a is already archived, got %+v", r)
+		}
+		if r := deleteByTag(map[string]interface{}{"tag": "nothing-has-this"}); r.Count != 0 || r.MemoryIDs == nil {
+			t.Errorf("delete-by-tag with no matches: expected an empty list, got %+v", r)
+		}
+	})
+
+	t.Run("related", func(t *testing.T) {
+		save := func(path, id string, tags ...string) {
+			resp := postJSON(t, path, map[string]interface{}{"namespace": "related", "memory_id": id, "content": id, "tags": tags})
+			resp.Body.Close()
+		}
+		save("/save-memory", "subject", "go", "api", "sqlite")
+		save("/save-memory", "two-shared", "go", "api", "other")
+		save("/save-memory", "all-shared", "sqlite", "api", "go")
+		save("/save-memory", "one-shared", "go")
+		save("/save-memory", "none-shared", "python")
+		// Only the latest version's tags count, and archived memories are left out
+		save("/save-memory", "was-shared", "go", "api")
+		save("/update-memory", "was-shared", "rust")
+		save("/save-memory", "deleted", "go", "api", "sqlite")
+		resp := postJSON(t, "/delete-memory", map[string]interface{}{"namespace": "related", "memory_id": "deleted"})
+		resp.Body.Close()
+
+		related := func(path string) string {
+			resp := getJSON(t, path)
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("%s: %v", path, resp.Status)
+			}
+			var memories []struct {
+				MemoryID   string `json:"memory_id"`
+				SharedTags int    `json:"shared_tags"`
+			}
+			json.NewDecoder(resp.Body).Decode(&memories)
+			var got []string
+			for _, m := range memories {
+				got = append(got, fmt.Sprintf("%s:%d", m.MemoryID, m.SharedTags))
+			}
+			return fmt.Sprint(got)
+		}
+		if got := related("/related/subject?namespace=related"); got != "[all-shared:3 two-shared:2 one-shared:1]" {
+			t.Errorf("related: got %s", got)
+		}
+		if got := related("/related/subject?namespace=related&limit=1"); got != "[all-shared:3]" {
+			t.Errorf("related with limit=1: got %s", got)
+		}
+		resp = getJSON(t, "/related/no-such-memory?namespace=related")
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("related for a missing memory: expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("search-history", func(t *testing.T) {
+		for i, content := range []string{"first draft", "added the Deploy steps", "rewrote everything", "deploy steps are back"} {
+			path := "/update-memory"
+			if i == 0 {
+				path = "/save-memory"
+			}
+			resp := postJSON(t, path, map[string]interface{}{"namespace": "history", "memory_id": "evolving", "content": content})
+			resp.Body.Close()
+		}
+		search := func(query string) []Memory {
+			resp := getJSON(t, "/search-history/evolving?namespace=history&"+query)
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("search-history?%s: %v", query, resp.Status)
+			}
+			var matches []Memory
+			json.NewDecoder(resp.Body).Decode(&matches)
+			return matches
+		}
+
+		// Archived versions match too, oldest first, so the first result introduced the phrase
+		matches := search("q=deploy+steps")
+		if len(matches) != 2 || matches[0].Version != 2 || matches[1].Version != 4 || !matches[0].Archived {
+			t.Fatalf("search-history for 'deploy steps': expected versions 2 (archived) and 4, got %+v", matches)
+		}
+		if matches[0].Snippet != "added the <mark>Deploy steps</mark>" {
+			t.Errorf("expected the match highlighted, got %q", matches[0].Snippet)
+		}
+
+		resp := getJSON(t, "/search-history/evolving?namespace=history&q=nowhere")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.TrimSpace(string(body)) != "[]" {
+			t.Errorf("search-history without matches: expected [], got %s", string(body))
+		}
+		resp = getJSON(t, "/search-history/evolving?namespace=history")
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("search-history without q: expected 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("generated-memory-id", func(t *testing.T) {
+		save := func() Memory {
+			resp := postJSON(t, "/save-memory", map[string]interface{}{"namespace": "generated", "content": "no id chosen"})
+			defer resp.Body.Close()
+			var m Memory
+			if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&m) != nil {
+				t.Fatalf("save-memory without memory_id: %v", resp.Status)
+			}
+			return m
+		}
+		first := save()
+		time.Sleep(2 * time.Millisecond)
+		second := save()
+		ulid := regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+		if !ulid.MatchString(first.MemoryID) || !ulid.MatchString(second.MemoryID) {
+			t.Fatalf("expected generated ULIDs, got %q and %q", first.MemoryID, second.MemoryID)
+		}
+		if first.MemoryID >= second.MemoryID {
+			t.Errorf("expected ULIDs to sort by creation time, got %q then %q", first.MemoryID, second.MemoryID)
+		}
+		resp := getJSON(t, "/get-memory-by-id/"+first.MemoryID+"?namespace=generated")
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("get-memory-by-id with the generated ID: expected 200, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("unsupported-media-type", func(t *testing.T) {
+		resp, err := http.Post(baseURL+"/save-memory", "text/plain", strings.NewReader(`{"memory_id": "plain-text", "content": "x"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var apiErr server.APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType || apiErr.Code != server.CodeUnsupportedMedia {
+			t.Fatalf("expected a 415 %s, got %v %+v", server.CodeUnsupportedMedia, resp.Status, apiErr)
+		}
+
+		// A charset parameter is still JSON
+		resp2, err := http.Post(baseURL+"/save-memory", "application/json; charset=utf-8", strings.NewReader(`{"memory_id": "charset-json", "content": "x"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp2.Body.Close()
+		if resp2.StatusCode != 200 {
+			t.Errorf("application/json with a charset: expected 200, got %d", resp2.StatusCode)
+		}
+	})
+
+	t.Run("autocomplete", func(t *testing.T) {
+		for _, id := range []string{"complete-b", "complete-a", "complete-c", "Complete-upper", "incomplete"} {
+			postJSON(t, "/save-memory", map[string]interface{}{"namespace": "autocomplete", "memory_id": id, "content": "x"}).Body.Close()
+		}
+		// A second version mustn't suggest the ID twice
+		postJSON(t, "/save-memory", map[string]interface{}{"namespace": "autocomplete", "memory_id": "complete-a", "content": "y"}).Body.Close()
+		postJSON(t, "/delete-memory", map[string]interface{}{"namespace": "autocomplete", "memory_id": "complete-c"}).Body.Close()
+
+		suggest := func(query string) []string {
+			resp := getJSON(t, "/autocomplete?namespace=autocomplete&"+query)
+			defer resp.Body.Close()
+			var ids []string
+			if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&ids) != nil {
+				t.Fatalf("autocomplete?%s: %v", query, resp.Status)
+			}
+			return ids
+		}
+		if got := suggest("prefix=complete"); !reflect.DeepEqual(got, []string{"complete-a", "complete-b"}) {
+			t.Errorf("expected complete-a and complete-b, got %v", got)
+		}
+		if got := suggest("prefix=complete&limit=1"); !reflect.DeepEqual(got, []string{"complete-a"}) {
+			t.Errorf("limit=1: expected only complete-a, got %v", got)
+		}
+		if got := suggest("prefix=nothing"); got == nil || len(got) != 0 {
+			t.Errorf("expected an empty array for no matches, got %v", got)
+		}
+		if got := suggest("prefix=" + url.QueryEscape("complete*")); len(got) != 0 {
+			t.Errorf("expected a wildcard to match literally, got %v", got)
+		}
+	})
+
+	t.Run("pin-memory", func(t *testing.T) {
+		for _, id := range []string{"pin-a", "pin-b", "pin-c"} {
+			postJSON(t, "/save-memory", map[string]interface{}{"namespace": "pinning", "memory_id": id, "content": "x"}).Body.Close()
+		}
+		pin := func(path, id, wantStatus string) {
+			resp := postJSON(t, path, map[string]interface{}{"namespace": "pinning", "memory_id": id})
+			defer resp.Body.Close()
+			var got struct {
+				Status string `json:"status"`
+				Pinned bool   `json:"pinned"`
+			}
+			if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&got) != nil || got.Status != wantStatus || got.Pinned != (path == "/pin-memory") {
+				t.Fatalf("%s %s: expected status %s, got %v %+v", path, id, wantStatus, resp.Status, got)
+			}
+		}
+		listed := func() []string {
+			resp := getJSON(t, "/list-memories?namespace=pinning")
+			defer resp.Body.Close()
+			var memories []Memory
+			if err := json.NewDecoder(resp.Body).Decode(&memories); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, m := range memories {
+				ids = append(ids, m.MemoryID)
+			}
+			return ids
+		}
+
+		pin("/pin-memory", "pin-c", "pinned")
+		pin("/pin-memory", "pin-c", "unchanged")
+		if got := listed(); !reflect.DeepEqual(got, []string{"pin-c", "pin-a", "pin-b"}) {
+			t.Errorf("expected the pinned memory first, got %v", got)
+		}
+
+		// A new version stays pinned
+		resp := postJSON(t, "/update-memory", map[string]interface{}{"namespace": "pinning", "memory_id": "pin-c", "content": "y"})
+		var updated struct {
+			Pinned  bool `json:"pinned"`
+			Version int  `json:"version"`
+		}
+		json.NewDecoder(resp.Body).Decode(&updated)
+		resp.Body.Close()
+		if !updated.Pinned || updated.Version != 2 {
+			t.Errorf("expected version 2 to stay pinned, got %+v", updated)
+		}
+
+		pin("/unpin-memory", "pin-c", "unpinned")
+		if got := listed(); !reflect.DeepEqual(got, []string{"pin-a", "pin-b", "pin-c"}) {
+			t.Errorf("expected the usual order once unpinned, got %v", got)
+		}
+
+		resp = postJSON(t, "/pin-memory", map[string]interface{}{"namespace": "pinning", "memory_id": "pin-missing"})
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("pinning a missing memory: expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("head-memory", func(t *testing.T) {
+		postJSON(t, "/save-memory", map[string]interface{}{"namespace": "head", "memory_id": "head-check", "content": "not downloaded"}).Body.Close()
+		get := getJSON(t, "/get-memory-by-id/head-check?namespace=head")
+		get.Body.Close()
+
+		resp, err := http.Head(baseURL + "/get-memory-by-id/head-check?namespace=head")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || len(body) != 0 {
+			t.Fatalf("expected a 200 without a body, got %v with %d bytes", resp.Status, len(body))
+		}
+		for _, h := range []string{"ETag", "Last-Modified"} {
+			if got, want := resp.Header.Get(h), get.Header.Get(h); got == "" || got != want {
+				t.Errorf("expected %s %q to match the GET's %q", h, got, want)
+			}
+		}
+
+		req, _ := http.NewRequest(http.MethodHead, baseURL+"/get-memory-by-id/head-check?namespace=head", nil)
+		req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("HEAD with a matching If-None-Match: expected 304, got %d", resp.StatusCode)
+		}
+
+		resp, err = http.Head(baseURL + "/get-memory-by-id/head-missing?namespace=head")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("HEAD for a missing memory: expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("concurrent-add-tag", func(t *testing.T) {
+		postJSON(t, "/save-memory", map[string]interface{}{"namespace": "tag-merge", "memory_id": "shared", "content": "x", "tags": []string{"start"}}).Body.Close()
+		tags := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta"}
+		var wg sync.WaitGroup
+		for _, tag := range tags {
+			wg.Add(1)
+			go func(tag string) {
+				defer wg.Done()
+				data, _ := json.Marshal(map[string]interface{}{"namespace": "tag-merge", "memory_id": "shared", "tag": tag})
+				resp, err := http.Post(baseURL+"/add-tag", "application/json", bytes.NewReader(data))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != 200 {
+					t.Errorf("add-tag %s: %v", tag, resp.Status)
+				}
+			}(tag)
+		}
+		wg.Wait()
+
+		resp := getJSON(t, "/get-memory-by-id/shared?namespace=tag-merge")
+		defer resp.Body.Close()
+		var m Memory
+		json.NewDecoder(resp.Body).Decode(&m)
+		got := slices.Clone(m.Tags)
+		want := append([]string{"start"}, tags...)
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) || m.Version != len(tags)+1 {
+			t.Errorf("expected every concurrently added tag to persist over %d versions, got %v at version %d", len(tags)+1, m.Tags, m.Version)
+		}
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		postJSON(t, "/save-memory", map[string]interface{}{"namespace": "markdown", "memory_id": "release-notes", "content": "Shipped *fast* search.\n", "tags": []string{"docs", "release"}}).Body.Close()
+		resp := getJSON(t, "/get-memory-by-id/release-notes?namespace=markdown&format=markdown")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/markdown") {
+			t.Fatalf("expected a 200 Markdown response, got %v %s", resp.Status, resp.Header.Get("Content-Type"))
+		}
+		want := "# release-notes\n\nShipped *fast* search.\n\n---\n\nTags: `docs`, `release`\n"
+		if string(body) != want {
+			t.Errorf("expected Markdown:\n%s\ngot:\n%s", want, body)
+		}
+
+		// JSON stays the default
+		resp = getJSON(t, "/get-memory-by-id/release-notes?namespace=markdown")
+		resp.Body.Close()
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("expected JSON without a format, got %s", resp.Header.Get("Content-Type"))
+		}
+		resp = getJSON(t, "/get-memory-by-id/release-notes?namespace=markdown&format=pdf")
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("format=pdf: expected 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("sparse-fields", func(t *testing.T) {
+		postJSON(t, "/save-memory", map[string]interface{}{"namespace": "sparse", "memory_id": "sparse-one", "content": "only what's needed", "tags": []string{"t"}}).Body.Close()
+		keys := func(path string, pick func(body []byte) []map[string]json.RawMessage) {
+			t.Helper()
+			resp := getJSON(t, path)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("%s: %v", path, resp.Status)
+			}
+			objects := pick(body)
+			if len(objects) == 0 {
+				t.Fatalf("%s: no memories in %s", path, body)
+			}
+			for _, obj := range objects {
+				var got []string
+				for k := range obj {
+					got = append(got, k)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, []string{"content", "memory_id"}) {
+					t.Errorf("%s: expected only content and memory_id, got %v", path, got)
+				}
+			}
+		}
+		// "bogus" isn't a field, so is ignored
+		keys("/get-memory-by-id/sparse-one?namespace=sparse&fields=memory_id,content,bogus", func(body []byte) []map[string]json.RawMessage {
+			var obj map[string]json.RawMessage
+			json.Unmarshal(body, &obj)
+			return []map[string]json.RawMessage{obj}
+		})
+		keys("/list-memories?namespace=sparse&fields=memory_id,%20content", func(body []byte) []map[string]json.RawMessage {
+			var list []map[string]json.RawMessage
+			json.Unmarshal(body, &list)
+			return list
+		})
+		keys("/search-memories?namespace=sparse&q=needed&fields=content,memory_id", func(body []byte) []map[string]json.RawMessage {
+			var results struct {
+				Total    int                          `json:"total"`
+				Memories []map[string]json.RawMessage `json:"memories"`
+			}
+			json.Unmarshal(body, &results)
+			if results.Total != 1 {
+				t.Errorf("expected the search total to be kept, got %d", results.Total)
+			}
+			return results.Memories
+		})
+
+		// Only unknown fields means every field
+		resp := getJSON(t, "/get-memory-by-id/sparse-one?namespace=sparse&fields=bogus")
+		var m Memory
+		json.NewDecoder(resp.Body).Decode(&m)
+		resp.Body.Close()
+		if m.Version != 1 || len(m.Tags) != 1 {
+			t.Errorf("expected the full memory for only unknown fields, got %+v", m)
+		}
+	})
+
+	t.Run("tag-report", func(t *testing.T) {
+		for id, tags := range map[string][]string{
+			"report-1": {"common", "rare"},
+			"report-2": {"common", "usual"},
+			"report-3": {"common", "usual"},
+		} {
+			postJSON(t, "/save-memory", map[string]interface{}{"namespace": "tag-report", "memory_id": id, "content": "x", "tags": tags}).Body.Close()
+		}
+		// Older versions don't count
+		postJSON(t, "/update-memory", map[string]interface{}{"namespace": "tag-report", "memory_id": "report-3", "content": "y", "tags": []string{"common", "usual"}}).Body.Close()
+
+		report := func(query string) []map[string]interface{} {
+			resp := getJSON(t, "/tag-report?namespace=tag-report"+query)
+			defer resp.Body.Close()
+			var entries []map[string]interface{}
+			if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&entries) != nil {
+				t.Fatalf("tag-report%s: %v", query, resp.Status)
+			}
+			return entries
+		}
+		got := fmt.Sprint(report(""))
+		if want := "[map[memory_count:3 tag:common] map[memory_count:2 tag:usual] map[memory_count:1 tag:rare]]"; got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+		got = fmt.Sprint(report("&min=2"))
+		if want := "[map[memory_count:3 tag:common] map[memory_count:2 tag:usual]]"; got != want {
+			t.Errorf("min=2: expected %s, got %s", want, got)
+		}
+		if entries := report("&min=10"); entries == nil || len(entries) != 0 {
+			t.Errorf("min=10: expected an empty array, got %v", entries)
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		resp := getJSON(t, "/ping")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var ping struct {
+			Pong          bool   `json:"pong"`
+			Version       string `json:"version"`
+			GoVersion     string `json:"go_version"`
+			UptimeSeconds *int64 `json:"uptime_seconds"`
+		}
+		if resp.StatusCode != 200 || json.Unmarshal(body, &ping) != nil {
+			t.Fatalf("ping failed: %v\nBody: %s", resp.Status, string(body))
+		}
+		if !ping.Pong || ping.Version != server.Version || ping.GoVersion != runtime.Version() || ping.UptimeSeconds == nil || *ping.UptimeSeconds < 0 {
+			t.Errorf("unexpected ping body: %s", string(body))
+		}
+	})
+
+	t.Run("idempotency-key", func(t *testing.T) {
+		type saved struct {
+			MemoryID string `json:"memory_id"`
+			Version  int    `json:"version"`
+			Code     string `json:"code"`
+		}
+		save := func(key string, body map[string]interface{}) (*http.Response, saved) {
+			data, _ := json.Marshal(body)
+			req, _ := http.NewRequest("POST", baseURL+"/save-memory", bytes.NewReader(data))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", key)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("save-memory with Idempotency-Key %s: %v", key, err)
+			}
+			defer resp.Body.Close()
+			var s saved
+			json.NewDecoder(resp.Body).Decode(&s)
+			return resp, s
+		}
+
+		body := map[string]interface{}{"memory_id": "idempotent", "content": "only once"}
+		first, want := save("retry-1", body)
+		if first.StatusCode != 200 || want.Version == 0 || first.Header.Get("Idempotent-Replayed") != "" {
+			t.Fatalf("first save: expected 200, got %v %+v", first.Status, want)
+		}
+		// A double submit gets the first save's version back, without saving another
+		retry, got := save("retry-1", body)
+		if retry.StatusCode != 200 || got.Version != want.Version || retry.Header.Get("Idempotent-Replayed") != "true" {
+			t.Errorf("retry: expected version %d replayed, got %v %+v", want.Version, retry.Status, got)
+		}
+		resp := getJSON(t, "/memory-stats/idempotent")
+		var stats struct {
+			Versions int `json:"versions"`
+		}
+		json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if stats.Versions != 1 {
+			t.Errorf("expected the retry not to save again, got %d versions", stats.Versions)
+		}
+
+		// A generated memory_id is replayed too, rather than generating another
+		_, generated := save("retry-2", map[string]interface{}{"content": "server named"})
+		if _, again := save("retry-2", map[string]interface{}{"content": "server named"}); generated.MemoryID == "" || again.MemoryID != generated.MemoryID {
+			t.Errorf("expected the generated memory_id %q replayed, got %q", generated.MemoryID, again.MemoryID)
+		}
+
+		if resp, s := save("retry-1", map[string]interface{}{"memory_id": "idempotent", "content": "something else"}); resp.StatusCode != 422 || s.Code != "idempotency_key_reused" {
+			t.Errorf("reused key: expected 422 idempotency_key_reused, got %v %s", resp.Status, s.Code)
+		}
+		// A failed save doesn't use up its key, so it can be retried once whatever stopped it is fixed
+		ifMatch := func() *http.Response {
+			req, _ := http.NewRequest("POST", baseURL+"/save-memory", strings.NewReader(`{"memory_id": "idempotent-later", "content": "waits for the memory"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", "retry-3")
+			req.Header.Set("If-Match", "*")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp
+		}
+		if resp := ifMatch(); resp.StatusCode != 412 {
+			t.Fatalf("If-Match on a missing memory: expected 412, got %v", resp.Status)
+		}
+		postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "idempotent-later", "content": "now it exists"}).Body.Close()
+		if resp := ifMatch(); resp.StatusCode != 200 || resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Errorf("retry after a failed save: expected a fresh 200, got %v %q", resp.Status, resp.Header.Get("Idempotent-Replayed"))
+		}
+	})
+
+	t.Run("returned-row-matches-stored", func(t *testing.T) {
+		// Saves and updates answer with the row the INSERT stored, which must match reading it back, including when
+		// the memory's earlier versions are archived
+		decode := func(resp *http.Response) Memory {
+			defer resp.Body.Close()
+			var m Memory
+			if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&m) != nil {
+				t.Fatalf("unexpected response: %v", resp.Status)
+			}
+			return m
+		}
+		var returned []Memory
+		returned = append(returned, decode(postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "returned-row", "content": "first", "tags": []string{"r"}})))
+		returned = append(returned, decode(postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "returned-row", "content": "second"})))
+		postJSON(t, "/delete-memory", map[string]interface{}{"memory_id": "returned-row"}).Body.Close()
+		returned = append(returned, decode(postJSON(t, "/save-memory", map[string]interface{}{"memory_id": "returned-row", "content": "after archiving"})))
+		returned = append(returned, decode(postJSON(t, "/update-memory", map[string]interface{}{"memory_id": "returned-row", "content": "last"})))
+		for i, m := range returned {
+			if m.Version != i+1 {
+				t.Errorf("save %d: expected version %d, got %d", i+1, i+1, m.Version)
+			}
+			stored := decode(getJSON(t, fmt.Sprintf("/get-memory-by-id/returned-row/version/%d", m.Version)))
+			// Later saves archive this version, so only the fields a save sets are compared
+			if stored.ID != m.ID || stored.Content != m.Content || fmt.Sprint(stored.Tags) != fmt.Sprint(m.Tags) || !stored.CreatedAt.Equal(m.CreatedAt) || !stored.UpdatedAt.Equal(m.UpdatedAt) {
+				t.Errorf("version %d: returned %+v, stored %+v", m.Version, m, stored)
+			}
+		}
+	})
+
+	t.Run("list-memories-by-tag", func(t *testing.T) {
+		// Should return only memA (tag: gamma) and not memB (archived) or memC (no gamma tag)
+		resp := getJSON(t, "/list-memories-by-tag?tag=gamma")
+		if resp.StatusCode != 200 {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			t.Fatalf("list-memories-by-tag failed: %v\nBody: %s", resp.Status, string(body))
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var filtered []Memory
+		if err := json.Unmarshal(body, &filtered); err != nil {
+			t.Fatalf("list-memories-by-tag unmarshal: %v", err)
+		}
+		foundMemA, foundMemB, foundMemC := false, false, false
+		for _, m := range filtered {
+			if m.MemoryID == "memA" && m.Content == "A3" && !m.Archived {
+				foundMemA = true
+			}
+			if m.MemoryID == "memB" {
+				foundMemB = true
+			}
+			if m.MemoryID == "memC" {
+				foundMemC = true
+			}
+		}
+		if !foundMemA || foundMemB || foundMemC {
+			t.Errorf("list-memories-by-tag did not return expected results: foundMemA=%v foundMemB=%v foundMemC=%v", foundMemA, foundMemB, foundMemC)
+		}
+	})
+}
+
+// TestConcurrentWrites hammers a file backed database with simultaneous writes, which used to fail with
+// "database is locked" before WAL mode and the busy timeout were configured
+func TestConcurrentWrites(t *testing.T) {
+	url := newTestServer(t, t.TempDir()+"/concurrent.sqlite", nil).URL
+
+	const writers = 25
+	var wg sync.WaitGroup
+	errs := make(chan string, writers*2)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// One new memory per writer, plus an update to a memory shared by every writer
+			for _, req := range []struct{ path, id string }{{"/save-memory", fmt.Sprintf("writer-%d", i)}, {"/update-memory", "shared"}} {
+				data, _ := json.Marshal(map[string]interface{}{"memory_id": req.id, "content": fmt.Sprintf("content from writer %d", i)})
+				r, err := http.Post(url+req.path, "application/json", bytes.NewReader(data))
+				if err != nil {
+					errs <- err.Error()
+					continue
+				}
+				body, _ := ioutil.ReadAll(r.Body)
+				r.Body.Close()
+				if r.StatusCode != 200 {
+					errs <- fmt.Sprintf("%s %s: %v %s", req.path, req.id, r.Status, string(body))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+
+	// Updates to the shared memory are serialized, so every one gets its own version
+	r, err := http.Get(url + "/get-memory-by-id/shared")
+	if err != nil {
+		t.Fatalf("get-memory-by-id failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	var m Memory
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("get-memory-by-id unmarshal: %v", err)
+	}
+	if m.Version != writers {
+		t.Errorf("expected shared memory at version %d, got %d", writers, m.Version)
+	}
+
+	// Every writer creating the same new memory at once must get its own version, rather than all saving version 1
+	versions := make(chan int, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, _ := json.Marshal(map[string]interface{}{"memory_id": "racing-create", "content": fmt.Sprintf("content from writer %d", i)})
+			r, err := http.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if r.StatusCode == http.StatusConflict {
+				return
+			}
+			var saved Memory
+			if r.StatusCode != 200 || json.Unmarshal(body, &saved) != nil {
+				t.Errorf("racing save-memory: %v %s", r.Status, string(body))
+				return
+			}
+			versions <- saved.Version
+		}(i)
+	}
+	wg.Wait()
+	close(versions)
+	seen := map[int]bool{}
+	for v := range versions {
+		if seen[v] {
+			t.Errorf("version %d of racing-create was saved more than once", v)
+		}
+		seen[v] = true
+	}
+	if !seen[1] {
+		t.Errorf("expected one racing save to create version 1, got %v", seen)
+	}
+}
+
+// BenchmarkConcurrentSaves measures save throughput with 100 clients writing at once, all funnelled through the
+// single database writer.  Compare ns/op across -benchtime values or runs to check it stays stable under load.
+func BenchmarkConcurrentSaves(b *testing.B) {
+	const clients = 100
+	url := newTestServer(b, b.TempDir()+"/bench.sqlite", nil).URL
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: clients}}
+	var next atomic.Int64
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for next.Add(1) <= int64(b.N) {
+				data, _ := json.Marshal(map[string]interface{}{"memory_id": fmt.Sprintf("bench-%d", c), "content": "benchmark content"})
+				r, err := client.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+				if err != nil {
+					failed.Add(1)
+					continue
+				}
+				io.Copy(io.Discard, r.Body)
+				r.Body.Close()
+				if r.StatusCode != 200 {
+					failed.Add(1)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	b.StopTimer()
+	if n := failed.Load(); n > 0 {
+		b.Fatalf("%d of %d saves failed", n, b.N)
+	}
+}
+
+func TestQueryCancelledOnDisconnect(t *testing.T) {
+	dsn := t.TempDir() + "/cancel.sqlite"
+	// A long busy timeout means the write below would wait for the lock rather than fail quickly by itself
+	url := newTestServer(t, dsn, func(cfg *server.Config) { cfg.BusyTimeout = 10 * time.Second }).URL
+
+	// Hold the database write lock from outside the server, so the update blocks inside the database call
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("database connection: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("take write lock: %v", err)
+	}
+
+	// The client gives up while the server is waiting on the lock
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	data, _ := json.Marshal(map[string]interface{}{"memory_id": "cancelled", "content": "should never be written"})
+	req, _ := http.NewRequestWithContext(ctx, "POST", url+"/update-memory", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the request to time out, got %v", resp.Status)
+	}
+
+	// Once the lock is released, an update which wasn't aborted would go on to be written
+	time.Sleep(200 * time.Millisecond)
+	if _, err := conn.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+		t.Fatalf("release write lock: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	resp, err := http.Get(url + "/get-memory-by-id/cancelled")
+	if err != nil {
+		t.Fatalf("get-memory-by-id: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("update was written after the client disconnected: %v", resp.Status)
+	}
+}
+
+func TestMigrationFromV1Database(t *testing.T) {
+	// Create a database using the schema from before the metadata column existed, or migrations were tracked
+	dsn := t.TempDir() + "/old.sqlite"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE memories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		memory_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		tags TEXT,
+		archived BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	)`)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO memories (memory_id, version, content, tags, archived, created_at, updated_at) VALUES ('old', 1, 'from before', '["a"]', 0, ?, ?)`, time.Now().UTC(), time.Now().UTC())
+	}
+	if err == nil {
+		// Racing saves could write the same version twice before versions were unique
+		_, err = db.Exec(`INSERT INTO memories (memory_id, version, content, tags, archived, created_at, updated_at) VALUES ('dup', 1, 'first', '[]', 0, ?, ?), ('dup', 1, 'second', '[]', 0, ?, ?)`, time.Now().UTC(), time.Now().UTC(), time.Now().UTC(), time.Now().UTC())
+	}
+	db.Close()
+	if err != nil {
+		t.Fatalf("create old database: %v", err)
+	}
+
+	url := newTestServer(t, dsn, nil).URL
+
+	resp, err := http.Get(url + "/get-memory-by-id/old")
+	if err != nil {
+		t.Fatalf("get-memory-by-id: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var m Memory
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("get-memory-by-id unmarshal: %v\nBody: %s", err, string(body))
+	}
+	if m.Content != "from before" || string(m.Metadata) != "{}" {
+		t.Errorf("existing row not migrated: %s", string(body))
+	}
+
+	// The later duplicate is renumbered to become the next version
+	resp, err = http.Get(url + "/get-memory-by-id/dup")
+	if err != nil {
+		t.Fatalf("get-memory-by-id: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("get-memory-by-id unmarshal: %v\nBody: %s", err, string(body))
+	}
+	if m.Version != 2 || m.Content != "second" {
+		t.Errorf("expected the duplicate renumbered to version 2, got: %s", string(body))
+	}
+
+	if versions := appliedMigrations(t, dsn); len(versions) < 4 || versions[0] != 1 || versions[len(versions)-1] != len(versions) {
+		t.Errorf("expected every migration recorded in order, got %v", versions)
+	}
+
+	// The upgraded database ends up with the same tables, columns and indexes as a new one
+	fresh := t.TempDir() + "/fresh.sqlite"
+	newTestServer(t, fresh, nil)
+	if upgraded, created := schemaSummary(t, dsn), schemaSummary(t, fresh); upgraded != created {
+		t.Errorf("upgraded schema differs from a new database's:\nupgraded: %s\nnew:      %s", upgraded, created)
+	}
+}
+
+// schemaSummary lists the columns and indexes of every table in a SQLite database, ignoring column order
+func schemaSummary(t *testing.T, dsn string) string {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT m.type, m.tbl_name, m.name, COALESCE(p.name, '')
+		FROM sqlite_master m LEFT JOIN pragma_table_info(m.name) p ON m.type='table'
+		WHERE m.name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatalf("read schema: %v", err)
+	}
+	defer rows.Close()
+	var parts []string
+	for rows.Next() {
+		var typ, table, name, column string
+		if err := rows.Scan(&typ, &table, &name, &column); err != nil {
+			t.Fatalf("read schema: %v", err)
+		}
+		parts = append(parts, typ+" "+table+"."+name+" "+column)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// TestSchemaEmbedded creates a database from an empty directory, checking startup doesn't depend on the working
+// directory now every migration is built into the binary
+func TestSchemaEmbedded(t *testing.T) {
+	t.Chdir(t.TempDir())
+	url := newTestServer(t, "schemaless.sqlite", nil).URL
+	data, _ := json.Marshal(map[string]interface{}{"memory_id": "embedded-schema", "content": "saved"})
+	r, err := http.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("save-memory: %v", err)
+	}
+	r.Body.Close()
+	if r.StatusCode != 200 {
+		t.Errorf("save-memory from an empty working directory: expected 200, got %v", r.Status)
+	}
+}
+
+func TestTimestampsSerializedAsUTC(t *testing.T) {
+	dsn := t.TempDir() + "/timestamps.sqlite"
+	url := newTestServer(t, dsn, nil).URL
+
+	// A row written by something else, with its timestamps stored in another timezone
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO memories (memory_id, version, content, tags, metadata, archived, created_at, updated_at) VALUES ('offset', 1, 'stored with an offset', '[]', '{}', 0, '2024-05-01 12:00:00+02:00', '2024-05-01 12:30:00+02:00')`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("insert row: %v", err)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"memory_id": "fresh", "content": "saved through the API"})
+	r, err := http.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("save-memory: %v", err)
+	}
+	r.Body.Close()
+
+	for _, id := range []string{"offset", "fresh"} {
+		r, err := http.Get(url + "/get-memory-by-id/" + id)
+		if err != nil {
+			t.Fatalf("get-memory-by-id: %v", err)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		var raw map[string]interface{}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			t.Fatalf("get-memory-by-id unmarshal: %v\nBody: %s", err, string(body))
+		}
+		for _, field := range []string{"created_at", "updated_at"} {
+			ts, _ := raw[field].(string)
+			if !strings.HasSuffix(ts, "Z") {
+				t.Errorf("%s %s is not in UTC: %q", id, field, ts)
+			}
+			if _, err := time.Parse(time.RFC3339, ts); err != nil {
+				t.Errorf("%s %s is not RFC3339: %v", id, field, err)
+			}
+		}
+		if id == "offset" && raw["created_at"] != "2024-05-01T10:00:00Z" {
+			t.Errorf("expected the offset converted to UTC, got %v", raw["created_at"])
+		}
+	}
+}
+
+func TestAPIKeyRequiredForWrites(t *testing.T) {
+	const apiKey = "test-api-key"
+	url := newTestServer(t, t.TempDir()+"/apikey.sqlite", func(cfg *server.Config) { cfg.APIKey = apiKey }).URL
+	post := func(path, key string) *http.Response {
+		data, _ := json.Marshal(map[string]interface{}{"memory_id": "keyed", "content": "needs a key"})
+		req, _ := http.NewRequest("POST", url+path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		r.Body.Close()
+		return r
+	}
+	for _, key := range []string{"", "wrong-key"} {
+		if r := post("/save-memory", key); r.StatusCode != 401 {
+			t.Errorf("save-memory with key %q: expected 401, got %v", key, r.Status)
+		}
+	}
+	if r := post("/save-memory", apiKey); r.StatusCode != 200 {
+		t.Errorf("save-memory with the API key: expected 200, got %v", r.Status)
+	}
+
+	// Reads don't need the key
+	r, err := http.Get(url + "/get-memory-by-id/keyed")
+	if err != nil {
+		t.Fatalf("get-memory-by-id: %v", err)
+	}
+	r.Body.Close()
+	if r.StatusCode != 200 {
+		t.Errorf("get-memory-by-id without a key: expected 200, got %v", r.Status)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	const origin = "http://localhost:5173"
+	url := newTestServer(t, t.TempDir()+"/cors.sqlite", func(cfg *server.Config) {
+		cfg.CORSOrigins = []string{origin}
+	}).URL
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", url+"/save-memory", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("OPTIONS /save-memory: %v", err)
+		}
+		r.Body.Close()
+		return r
+	}
+
+	r := preflight(origin)
+	if r.StatusCode != 204 {
+		t.Errorf("preflight: expected 204, got %v", r.Status)
+	}
+	if got := r.Header.Get("Access-Control-Allow-Origin"); got != origin {
+		t.Errorf("preflight: expected Access-Control-Allow-Origin %q, got %q", origin, got)
+	}
+	if got := r.Header.Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+		t.Errorf("preflight: expected POST to be allowed, got %q", got)
+	}
+	if got := r.Header.Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Content-Type") {
+		t.Errorf("preflight: expected Content-Type to be allowed, got %q", got)
+	}
+
+	// Other origins get no CORS headers, so the browser blocks them
+	if r := preflight("http://evil.example"); r.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight from an unlisted origin: expected no Access-Control-Allow-Origin, got %q",
+			r.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	// The actual request carries the header too
+	data, _ := json.Marshal(map[string]interface{}{"memory_id": "cors", "content": "from the frontend"})
+	req, _ := http.NewRequest("POST", url+"/save-memory", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", origin)
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /save-memory: %v", err)
+	}
+	r.Body.Close()
+	if r.StatusCode != 200 || r.Header.Get("Access-Control-Allow-Origin") != origin {
+		t.Errorf("save-memory from %s: expected 200 with Access-Control-Allow-Origin, got %v %q", origin, r.Status,
+			r.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestRateLimitExceeded(t *testing.T) {
+	url := newTestServer(t, t.TempDir()+"/ratelimit.sqlite", func(cfg *server.Config) { cfg.RateLimit = 1 }).URL
+	save := func() *http.Response {
+		data, _ := json.Marshal(map[string]interface{}{"memory_id": "limited", "content": "one per second"})
+		r, err := http.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("save-memory: %v", err)
+		}
+		r.Body.Close()
+		return r
+	}
+	if r := save(); r.StatusCode != 200 {
+		t.Fatalf("first save-memory: expected 200, got %v", r.Status)
+	}
+	r := save()
+	if r.StatusCode != 429 {
+		t.Fatalf("second save-memory within a second: expected 429, got %v", r.Status)
+	}
+	if retry, err := strconv.Atoi(r.Header.Get("Retry-After")); err != nil || retry < 1 {
+		t.Errorf("expected a Retry-After of at least 1 second, got %q", r.Header.Get("Retry-After"))
+	}
+
+	// Reads aren't limited
+	for i := 0; i < 3; i++ {
+		r, err := http.Get(url + "/get-memory-by-id/limited")
+		if err != nil {
+			t.Fatalf("get-memory-by-id: %v", err)
+		}
+		r.Body.Close()
+		if r.StatusCode != 200 {
+			t.Errorf("get-memory-by-id while write limited: expected 200, got %v", r.Status)
+		}
+	}
+}
+
+func TestContentEncryptedAtRest(t *testing.T) {
+	dsn := t.TempDir() + "/encrypted.sqlite"
+	key := bytes.Repeat([]byte{0x42}, 32)
+	save := func(url, id, content string) {
+		data, _ := json.Marshal(map[string]interface{}{"memory_id": id, "content": content})
+		r, err := http.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("save-memory: %v", err)
+		}
+		r.Body.Close()
+		if r.StatusCode != 200 {
+			t.Fatalf("save-memory %s: %v", id, r.Status)
+		}
+	}
+	get := func(url, id string) (int, Memory) {
+		r, err := http.Get(url + "/get-memory-by-id/" + id)
+		if err != nil {
+			t.Fatalf("get-memory-by-id: %v", err)
+		}
+		defer r.Body.Close()
+		var m Memory
+		json.NewDecoder(r.Body).Decode(&m)
+		return r.StatusCode, m
+	}
+
+	// A row saved before the key was configured stays readable plaintext
+	plainURL := newTestServer(t, dsn, nil).URL
+	save(plainURL, "plain", "written without a key")
+	url := newTestServer(t, dsn, func(cfg *server.Config) { cfg.EncryptionKey = key }).URL
+	save(url, "secret", "top secret plans")
+	save(url, "secret", "more secret plans")
+	for id, want := range map[string]string{"plain": "written without a key", "secret": "more secret plans"} {
+		if status, m := get(url, id); status != 200 || m.Content != want {
+			t.Errorf("get-memory-by-id %s: expected %q, got %d %q", id, want, status, m.Content)
+		}
+	}
+
+	// On disk the content is ciphertext, with a different nonce for each row
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT memory_id, CAST(content AS BLOB), nonce FROM memories ORDER BY id`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	nonces := map[string]bool{}
+	for rows.Next() {
+		var id string
+		var content, nonce []byte
+		if err := rows.Scan(&id, &content, &nonce); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		switch {
+		case id == "plain" && (nonce != nil || string(content) != "written without a key"):
+			t.Errorf("expected the plaintext row untouched, got nonce %x content %q", nonce, content)
+		case id == "secret" && (len(nonce) != 12 || bytes.Contains(content, []byte("secret"))):
+			t.Errorf("expected encrypted content with a 12 byte nonce, got nonce %x content %q", nonce, content)
+		}
+		if nonce != nil {
+			nonces[string(nonce)] = true
+		}
+	}
+	rows.Close()
+	if len(nonces) != 2 {
+		t.Errorf("expected a distinct nonce for each encrypted row, got %d", len(nonces))
+	}
+
+	// Without the key the encrypted content can't be read, but the plaintext can
+	if status, _ := get(plainURL, "secret"); status != 500 {
+		t.Errorf("get-memory-by-id of encrypted content without the key: expected 500, got %d", status)
+	}
+	if status, m := get(plainURL, "plain"); status != 200 || m.Content != "written without a key" {
+		t.Errorf("get-memory-by-id of plaintext without the key: got %d %q", status, m.Content)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	const apiKey = "test-api-key"
+	url := newTestServer(t, t.TempDir()+"/maintenance.sqlite", func(cfg *server.Config) { cfg.APIKey = apiKey }).URL
+	maintain := func(url, key string) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", url+"/maintenance", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("maintenance: %v", err)
+		}
+		defer r.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		return r, body
+	}
+
+	if r, _ := maintain(url, ""); r.StatusCode != 401 {
+		t.Errorf("maintenance without the API key: expected 401, got %v", r.Status)
+	}
+	r, body := maintain(url, apiKey)
+	if r.StatusCode != 200 {
+		t.Fatalf("maintenance: expected 200, got %v", r.Status)
+	}
+	if body["status"] != "ok" {
+		t.Errorf("maintenance: expected status ok, got %v", body["status"])
+	}
+	for _, field := range []string{"size_before", "size_after"} {
+		if size, _ := body[field].(float64); size <= 0 {
+			t.Errorf("maintenance: expected a positive %s, got %v", field, body[field])
+		}
+	}
+
+	// In-memory databases have no file to shrink, so nothing is done
+	memURL := newTestServer(t, ":memory:", nil).URL
+	if r, body := maintain(memURL, ""); r.StatusCode != 200 || body["status"] != "skipped" {
+		t.Errorf("maintenance of an in-memory database: expected 200 skipped, got %v %v", r.Status, body["status"])
+	}
+}
+
+func TestMetadataSchema(t *testing.T) {
+	schema, err := server.ParseMetadataSchema([]byte(`{
+		"type": "object",
+		"required": ["source"],
+		"properties": {
+			"source": {"type": "string", "enum": ["agent", "user"]},
+			"confidence": {"type": "number", "minimum": 0, "maximum": 1}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("parse metadata schema: %v", err)
+	}
+	url := newTestServer(t, t.TempDir()+"/schema.sqlite", func(cfg *server.Config) { cfg.MetadataSchema = schema }).URL
+	save := func(path string, metadata interface{}) (int, string) {
+		body := map[string]interface{}{"memory_id": "schema-checked", "content": "has metadata"}
+		if metadata != nil {
+			body["metadata"] = metadata
+		}
+		data, _ := json.Marshal(body)
+		r, err := http.Post(url+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer r.Body.Close()
+		detail, _ := ioutil.ReadAll(r.Body)
+		return r.StatusCode, string(detail)
+	}
+
+	if status, detail := save("/save-memory", map[string]interface{}{"source": "agent", "confidence": 0.9}); status != 200 {
+		t.Fatalf("save-memory with matching metadata: expected 200, got %d %s", status, detail)
+	}
+	for _, tc := range []struct {
+		name     string
+		path     string
+		metadata interface{}
+		mention  string
+	}{
+		{"missing metadata", "/save-memory", nil, "source"},
+		{"wrong enum value", "/save-memory", map[string]interface{}{"source": "robot"}, "/source"},
+		{"out of range", "/update-memory", map[string]interface{}{"source": "user", "confidence": 2}, "/confidence"},
+	} {
+		if status, detail := save(tc.path, tc.metadata); status != 400 || !strings.Contains(detail, tc.mention) {
+			t.Errorf("%s: expected 400 mentioning %s, got %d %s", tc.name, tc.mention, status, detail)
+		}
+	}
+
+	if _, err := server.ParseMetadataSchema([]byte(`{"type": "not-a-type"}`)); err == nil {
+		t.Errorf("parse of an invalid metadata schema: expected an error")
+	}
+}
+
+func TestVersioningModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode             server.Versioning
+		version, history int
+	}{
+		{server.VersioningVersioned, 2, 2},
+		{server.VersioningMutable, 1, 1},
+	} {
+		url := newTestServer(t, t.TempDir()+"/versioning.sqlite", func(cfg *server.Config) { cfg.Versioning = tc.mode }).URL
+		post := func(path string, body map[string]interface{}) Memory {
+			data, _ := json.Marshal(body)
+			r, err := http.Post(url+path, "application/json", bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: POST %s: %v", tc.mode, path, err)
+			}
+			defer r.Body.Close()
+			var saved struct{ Memory }
+			if r.StatusCode != 200 || json.NewDecoder(r.Body).Decode(&saved) != nil {
+				t.Fatalf("%s: POST %s: expected 200, got %v", tc.mode, path, r.Status)
+			}
+			return saved.Memory
+		}
+		first := post("/save-memory", map[string]interface{}{"memory_id": "versioning", "content": "first", "tags": []string{"a"}})
+		updated := post("/update-memory", map[string]interface{}{"memory_id": "versioning", "content": "second", "tags": []string{"b"}})
+		if updated.Version != tc.version || updated.Content != "second" || len(updated.Tags) != 1 || updated.Tags[0] != "b" {
+			t.Errorf("%s: expected version %d with the new content and tags, got %+v", tc.mode, tc.version, updated)
+		}
+		if !updated.CreatedAt.Equal(first.CreatedAt) || !updated.UpdatedAt.After(first.UpdatedAt) {
+			t.Errorf("%s: expected created_at kept and updated_at bumped, got %v/%v -> %v/%v", tc.mode, first.CreatedAt, first.UpdatedAt, updated.CreatedAt, updated.UpdatedAt)
+		}
+
+		r, err := http.Get(url + "/memory-stats/versioning")
+		if err != nil {
+			t.Fatalf("%s: memory-stats: %v", tc.mode, err)
+		}
+		var stats struct {
+			Versions int `json:"versions"`
+		}
+		json.NewDecoder(r.Body).Decode(&stats)
+		r.Body.Close()
+		if stats.Versions != tc.history {
+			t.Errorf("%s: expected %d stored versions, got %d", tc.mode, tc.history, stats.Versions)
+		}
+	}
+}
+
+// TestPostgres runs the core endpoints against a Postgres database.  It needs a server built with -tags postgres
+// and MEMORY_SERVER_TEST_POSTGRES_DSN pointing at a database it may create tables in, so is skipped otherwise.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("MEMORY_SERVER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("MEMORY_SERVER_TEST_POSTGRES_DSN isn't set")
+	}
+	url := newTestServer(t, dsn, nil).URL
+	// A namespace of its own keeps each run apart from the data of earlier ones
+	namespace := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	post := func(path string, body map[string]interface{}) (int, []byte) {
+		body["namespace"] = namespace
+		data, _ := json.Marshal(body)
+		r, err := http.Post(url+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer r.Body.Close()
+		out, _ := ioutil.ReadAll(r.Body)
+		return r.StatusCode, out
+	}
+	get := func(path string) (int, []byte) {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		r, err := http.Get(url + path + sep + "namespace=" + namespace)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer r.Body.Close()
+		out, _ := ioutil.ReadAll(r.Body)
+		return r.StatusCode, out
+	}
+
+	if status, body := post("/save-memory", map[string]interface{}{"memory_id": "pg-notes", "content": "first draft", "tags": []string{"Postgres"}, "metadata": map[string]int{"n": 1}}); status != 200 {
+		t.Fatalf("save-memory: expected 200, got %d %s", status, body)
+	}
+	status, body := post("/update-memory", map[string]interface{}{"memory_id": "pg-notes", "content": "second draft", "tags": []string{"Postgres", "db"}})
+	var updated struct{ Memory }
+	if status != 200 || json.Unmarshal(body, &updated) != nil || updated.Version != 2 {
+		t.Fatalf("update-memory: expected version 2, got %d %s", status, body)
+	}
+	if status, body := post("/update-memory", map[string]interface{}{"memory_id": "pg-notes", "content": "second draft", "tags": []string{"db", "Postgres"}}); status != 200 || !bytes.Contains(body, []byte(`"unchanged"`)) {
+		t.Errorf("identical update-memory: expected unchanged, got %d %s", status, body)
+	}
+
+	var m Memory
+	if status, body := get("/get-memory-by-id/pg-notes"); status != 200 || json.Unmarshal(body, &m) != nil || m.Content != "second draft" || !m.CreatedAt.Equal(updated.CreatedAt) {
+		t.Errorf("get-memory-by-id: expected the second draft, got %d %s", status, body)
+	}
+	var list []Memory
+	if status, body := get("/list-memories"); status != 200 || json.Unmarshal(body, &list) != nil || len(list) != 1 {
+		t.Errorf("list-memories: expected just the active version, got %d %s", status, body)
+	}
+	if status, body := get("/list-memories-by-tag?tag=postgres&case_insensitive=true"); status != 200 || json.Unmarshal(body, &list) != nil || len(list) != 1 {
+		t.Errorf("list-memories-by-tag: expected 1 memory, got %d %s", status, body)
+	}
+	for _, q := range []string{"q=SECOND", "q=draft&mode=word", "q=tag:db", "q=secnod+draft&fuzzy=true"} {
+		var found struct {
+			Total int `json:"total"`
+		}
+		if status, body := get("/search-memories?" + q); status != 200 || json.Unmarshal(body, &found) != nil || found.Total != 1 {
+			t.Errorf("search-memories?%s: expected 1 match, got %d %s", q, status, body)
+		}
+	}
+
+	if status, body := post("/delete-memory", map[string]interface{}{"memory_id": "pg-notes"}); status != 200 {
+		t.Errorf("delete-memory: expected 200, got %d %s", status, body)
+	}
+	if status, _ := get("/get-memory-by-id/pg-notes"); status != 404 {
+		t.Errorf("get-memory-by-id after delete: expected 404, got %d", status)
+	}
+
+	// Endpoints still written for SQLite say so rather than failing
+	if status, _ := get("/stats"); status != 501 {
+		t.Errorf("stats: expected 501, got %d", status)
+	}
+}
+
+func TestDatabaseCheck(t *testing.T) {
+	// open returns a migrated database, with setup run on it (then closed and reopened so the change is on disk)
+	open := func(t *testing.T, setup func(dsn string, db *sql.DB)) *sql.DB {
+		t.Helper()
+		cfg := server.DefaultConfig()
+		cfg.DSN = t.TempDir() + "/check.sqlite"
+		db, err := server.OpenDB(cfg)
+		if err != nil {
+			t.Fatalf("open database: %v", err)
+		}
+		if _, err := server.Migrate(db); err != nil {
+			t.Fatalf("migrate database: %v", err)
+		}
+		setup(cfg.DSN, db)
+		if db, err = server.OpenDB(cfg); err != nil {
+			t.Fatalf("reopen database: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	t.Run("corrupt", func(t *testing.T) {
+		db := open(t, func(dsn string, db *sql.DB) {
+			for i := 0; i < 50; i++ {
+				db.Exec(`INSERT INTO memories (memory_id, version, content, tags, created_at, updated_at) VALUES (?, 1, 'c', '[]', ?, ?)`, fmt.Sprintf("m%d", i), time.Now(), time.Now())
+			}
+			// Overwriting an index's root page leaves the table readable, so only the integrity check notices
+			var rootPage, pageSize int64
+			db.QueryRow(`SELECT rootpage FROM sqlite_master WHERE name = 'idx_memories_archived'`).Scan(&rootPage)
+			db.QueryRow(`PRAGMA page_size`).Scan(&pageSize)
+			db.Close()
+			f, err := os.OpenFile(dsn, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("open database file: %v", err)
+			}
+			defer f.Close()
+			if _, err := f.WriteAt(bytes.Repeat([]byte{0xff}, int(pageSize)), (rootPage-1)*pageSize); err != nil {
+				t.Fatalf("corrupt database file: %v", err)
+			}
+		})
+		_, err := server.CheckDatabase(db)
+		if err == nil || !strings.Contains(err.Error(), "database is corrupt") {
+			t.Errorf("expected a clear corruption error, got %v", err)
+		}
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		db := open(t, func(dsn string, db *sql.DB) {
+			if _, err := db.Exec(`ALTER TABLE memories DROP COLUMN metadata`); err != nil {
+				t.Fatalf("drop column: %v", err)
+			}
+			db.Close()
+		})
+		_, err := server.CheckDatabase(db)
+		if err == nil || !strings.Contains(err.Error(), "table memories is missing columns metadata") {
+			t.Errorf("expected a missing column error, got %v", err)
+		}
+	})
+}
+
+func TestSeedFile(t *testing.T) {
+	dir := t.TempDir()
+	seed := dir + "/seed.ndjson"
+	os.WriteFile(seed, []byte(`{"memory_id": "seeded-a", "content": "first", "tags": ["seed"]}
+{"namespace": "other", "memory_id": "seeded-b", "content": "second"}
+`), 0o600)
+	list := func(url, namespace string) string {
+		resp, err := http.Get(url + "/list-memories?namespace=" + namespace)
+		if err != nil {
+			t.Fatalf("list-memories: %v", err)
+		}
+		defer resp.Body.Close()
+		var ids []string
+		var memories []Memory
+		json.NewDecoder(resp.Body).Decode(&memories)
+		for _, m := range memories {
+			ids = append(ids, m.MemoryID)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	// An empty database is seeded, into whichever namespaces the records name
+	dsn := dir + "/seeded.sqlite"
+	url := newTestServer(t, dsn, func(cfg *server.Config) { cfg.SeedFile = seed }).URL
+	if ids := list(url, "default") + list(url, "other"); ids != "[seeded-a][seeded-b]" {
+		t.Fatalf("expected both records seeded, got %s", ids)
+	}
+
+	// Restarting with memories already there doesn't import them again
+	os.WriteFile(seed, []byte(`{"memory_id": "seeded-c", "content": "third"}`+"\n"), 0o600)
+	url = newTestServer(t, dsn, func(cfg *server.Config) { cfg.SeedFile = seed }).URL
+	if ids := list(url, "default"); ids != "[seeded-a]" {
+		t.Errorf("expected a non-empty database left unseeded, got %s", ids)
+	}
+
+	// An invalid record fails the whole seed, naming the record
+	os.WriteFile(seed, []byte(`{"memory_id": "fine", "content": "ok"}`+"\n"+`{"memory_id": "", "content": "no id"}`+"\n"), 0o600)
+	cfg := server.DefaultConfig()
+	cfg.DSN = dir + "/invalid.sqlite"
+	cfg.SeedFile = seed
+	db, err := server.OpenDB(cfg)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	if _, err := server.Migrate(db); err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	srv := server.NewServer(cfg, db)
+	defer srv.Close()
+	if _, err := srv.Seed(context.Background()); err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Errorf("expected the invalid second record reported, got %v", err)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM memories").Scan(&n)
+	if n != 0 {
+		t.Errorf("expected nothing saved from an invalid seed file, got %d rows", n)
+	}
+}
+
+func TestLogBodies(t *testing.T) {
+	// Capture the server's log lines at debug level
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	url := newTestServer(t, ":memory:", func(cfg *server.Config) {
+		cfg.LogBodies = true
+		cfg.APIKey = "secret-key"
+	}).URL
+
+	save := func(content string) *http.Response {
+		data, _ := json.Marshal(map[string]interface{}{"memory_id": "logged", "content": content})
+		req, _ := http.NewRequest("POST", url+"/save-memory", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("save-memory: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// The handler still gets the whole body after it's been logged, even when it's longer than is logged
+	long := strings.Repeat("x", 10000) + "END"
+	if resp := save(long); resp.StatusCode != 200 {
+		t.Fatalf("save-memory: expected 200, got %v", resp.Status)
+	}
+	resp, err := http.Get(url + "/get-memory-by-id/logged")
+	if err != nil {
+		t.Fatalf("get-memory-by-id: %v", err)
+	}
+	var m Memory
+	json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if m.Content != long {
+		t.Errorf("expected the full content saved, got %d bytes", len(m.Content))
+	}
+
+	logged := logs.String()
+	if strings.Contains(logged, "secret-key") || !strings.Contains(logged, "[redacted]") {
+		t.Errorf("expected the Authorization header redacted, got %s", logged)
+	}
+	if !strings.Contains(logged, "Request body") || !strings.Contains(logged, "Response body") || !strings.Contains(logged, "(truncated)") {
+		t.Errorf("expected truncated request and response bodies logged, got %s", logged)
+	}
+	for _, line := range strings.Split(logged, "\n") {
+		if (strings.Contains(line, `msg="Request body"`) || strings.Contains(line, `msg="Response body"`)) && strings.Contains(line, "END") {
+			t.Errorf("expected bodies cut off at the size cap, got %s", line)
+		}
+	}
+
+	// Nothing is logged above debug level
+	logs.Reset()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	save("quiet")
+	if strings.Contains(logs.String(), "Request body") {
+		t.Errorf("expected no bodies logged at info level, got %s", logs.String())
+	}
+}
+
+func TestMaxVersions(t *testing.T) {
+	url := newTestServer(t, ":memory:", func(cfg *server.Config) { cfg.MaxVersions = 3 }).URL
+	post := func(path string, body map[string]interface{}) (pruned int64) {
+		data, _ := json.Marshal(body)
+		resp, err := http.Post(url+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var saved struct {
+			Pruned int64 `json:"pruned"`
+		}
+		if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&saved) != nil {
+			t.Fatalf("POST %s: %v", path, resp.Status)
+		}
+		return saved.Pruned
+	}
+	versions := func() (versions []int) {
+		resp, err := http.Get(url + "/export")
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		defer resp.Body.Close()
+		var doc struct {
+			Memories []Memory `json:"memories"`
+		}
+		json.NewDecoder(resp.Body).Decode(&doc)
+		for _, m := range doc.Memories {
+			if m.MemoryID == "bounded" {
+				versions = append(versions, m.Version)
+			}
+		}
+		sort.Ints(versions)
+		return versions
+	}
+
+	// Nothing is pruned until there are more than 3 versions, then the oldest go one per update
+	if pruned := post("/save-memory", map[string]interface{}{"memory_id": "bounded", "content": "v1"}); pruned != 0 {
+		t.Errorf("save: expected nothing pruned, got %d", pruned)
+	}
+	for i := 2; i <= 5; i++ {
+		want := int64(0)
+		if i > 3 {
+			want = 1
+		}
+		if pruned := post("/update-memory", map[string]interface{}{"memory_id": "bounded", "content": fmt.Sprintf("v%d", i)}); pruned != want {
+			t.Errorf("update to v%d: expected %d pruned, got %d", i, want, pruned)
+		}
+	}
+	if v := fmt.Sprint(versions()); v != "[3 4 5]" {
+		t.Errorf("expected only versions [3 4 5] kept, got %s", v)
+	}
+
+	// Tag changes write versions too, so they prune as well
+	if pruned := post("/add-tag", map[string]interface{}{"memory_id": "bounded", "tag": "capped"}); pruned != 1 {
+		t.Errorf("add-tag: expected 1 pruned, got %d", pruned)
+	}
+	if v := fmt.Sprint(versions()); v != "[4 5 6]" {
+		t.Errorf("expected only versions [4 5 6] kept, got %s", v)
+	}
+}
+
+func TestDrainingOnShutdown(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.DSN = ":memory:"
+	db, err := server.OpenDB(cfg)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	if _, err := server.Migrate(db); err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	srv := server.NewServer(cfg, db)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("healthz: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("healthz before shutdown: expected 200, got %d", resp.StatusCode)
+	}
+
+	// Once shutdown starts every new request, health checks included, is turned away with a 503
+	srv.Drain()
+	for _, path := range []string{"/healthz", "/list-memories"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		var apiErr struct {
+			Code string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		resp.Body.Close()
+		if resp.StatusCode != 503 || apiErr.Code != "unavailable" || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("%s while draining: expected 503 unavailable with Retry-After, got %d %q %q", path, resp.StatusCode, apiErr.Code, resp.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	t.Setenv("MEMORY_SERVER_DSN", ":memory:")
+	cfg, err := server.LoadConfig()
+	if err != nil || cfg.Addr() != "0.0.0.0:38080" {
+		t.Fatalf("expected the default address 0.0.0.0:38080, got %q (%v)", cfg.Addr(), err)
+	}
+
+	t.Setenv("MEMORY_SERVER_LISTEN_ADDR", "::1")
+	t.Setenv("MEMORY_SERVER_PORT", "4000")
+	if cfg, err = server.LoadConfig(); err != nil || cfg.Addr() != "[::1]:4000" {
+		t.Errorf("expected [::1]:4000, got %q (%v)", cfg.Addr(), err)
+	}
+
+	t.Setenv("MEMORY_SERVER_LISTEN_ADDR", "not-an-ip")
+	if _, err = server.LoadConfig(); err == nil {
+		t.Error("expected an invalid listen address to be rejected")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Setenv("MEMORY_SERVER_DSN", ":memory:")
+	t.Setenv("MEMORY_SERVER_TLS_CERT", "cert.pem")
+	if _, err := server.LoadConfig(); err == nil || !strings.Contains(err.Error(), "set together") {
+		t.Errorf("expected a cert without a key to be rejected, got %v", err)
+	}
+
+	dir := t.TempDir()
+	t.Setenv("MEMORY_SERVER_TLS_CERT", filepath.Join(dir, "missing-cert.pem"))
+	t.Setenv("MEMORY_SERVER_TLS_KEY", filepath.Join(dir, "missing-key.pem"))
+	if _, err := server.LoadConfig(); err == nil || !strings.Contains(err.Error(), "missing-cert.pem") {
+		t.Errorf("expected unreadable files to be rejected, got %v", err)
+	}
+
+	t.Setenv("MEMORY_SERVER_TLS_CERT", "")
+	t.Setenv("MEMORY_SERVER_TLS_KEY", "")
+	if cfg, err := server.LoadConfig(); err != nil || cfg.TLS() {
+		t.Errorf("expected plain HTTP without TLS settings, got %v (%v)", cfg.TLS(), err)
+	}
+}
+
+func TestTrackAccess(t *testing.T) {
+	url := newTestServer(t, ":memory:", func(cfg *server.Config) { cfg.TrackAccess = true }).URL
+	for _, id := range []string{"viewed-first", "viewed-second", "never-viewed"} {
+		data, _ := json.Marshal(map[string]interface{}{"memory_id": id, "content": "x"})
+		r, err := http.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+	view := func(id string) {
+		r, err := http.Get(url + "/get-memory-by-id/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+	type recentMemory struct {
+		MemoryID       string    `json:"memory_id"`
+		LastAccessedAt time.Time `json:"last_accessed_at"`
+	}
+	// Accesses are recorded in the background, so this waits for the expected order to show up
+	waitForRecent := func(want ...string) []recentMemory {
+		var recent []recentMemory
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			r, err := http.Get(url + "/recent")
+			if err != nil {
+				t.Fatal(err)
+			}
+			recent = nil
+			json.NewDecoder(r.Body).Decode(&recent)
+			r.Body.Close()
+			var ids []string
+			for _, m := range recent {
+				ids = append(ids, m.MemoryID)
+			}
+			if reflect.DeepEqual(ids, want) {
+				return recent
+			}
+		}
+		t.Fatalf("expected /recent to list %v, got %+v", want, recent)
+		return nil
+	}
+
+	view("viewed-first")
+	time.Sleep(2 * time.Millisecond)
+	view("viewed-second")
+	before := waitForRecent("viewed-second", "viewed-first")
+
+	// Viewing a memory again moves it to the top with a later timestamp
+	time.Sleep(2 * time.Millisecond)
+	view("viewed-first")
+	after := waitForRecent("viewed-first", "viewed-second")
+	if !after[0].LastAccessedAt.After(before[1].LastAccessedAt) {
+		t.Errorf("expected last_accessed_at to advance, was %v now %v", before[1].LastAccessedAt, after[0].LastAccessedAt)
+	}
+
+	// Without tracking there's nothing to list
+	r, err := http.Get(newTestServer(t, ":memory:", nil).URL + "/recent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotImplemented {
+		t.Errorf("recent without tracking: expected 501, got %d", r.StatusCode)
+	}
+}
+
+func TestNormalizeContent(t *testing.T) {
+	url := newTestServer(t, ":memory:", func(cfg *server.Config) { cfg.NormalizeContent = true }).URL
+	post := func(path string, body map[string]interface{}) (Memory, string) {
+		data, _ := json.Marshal(body)
+		r, err := http.Post(url+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer r.Body.Close()
+		var m struct {
+			Memory
+			Status string `json:"status"`
+		}
+		if r.StatusCode != 200 || json.NewDecoder(r.Body).Decode(&m) != nil {
+			t.Fatalf("POST %s: %v", path, r.Status)
+		}
+		return m.Memory, m.Status
+	}
+
+	// "café" with a precomposed é, then with e followed by a combining acute accent
+	composed, decomposed := "caf\u00e9", "cafe\u0301"
+	m, _ := post("/save-memory", map[string]interface{}{"memory_id": "accents", "content": "  " + decomposed + "\n\n  au lait \n"})
+	if want := composed + "\n\n  au lait"; m.Content != want {
+		t.Errorf("expected the content trimmed and composed as %q, got %q", want, m.Content)
+	}
+	// The composed spelling is now the same content, so updating with it changes nothing
+	if _, status := post("/update-memory", map[string]interface{}{"memory_id": "accents", "content": composed + "\n\n  au lait"}); status != "unchanged" {
+		t.Errorf("expected an update with the composed spelling to be unchanged, got %s", status)
+	}
+
+	// Content saved decomposed is found by a search typed composed
+	resp, err := http.Get(url + "/search-memories?q=caf%C3%A9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var results SearchResponse
+	json.NewDecoder(resp.Body).Decode(&results)
+	if results.Total != 1 {
+		t.Errorf("expected the composed search to find the memory, got %d results", results.Total)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	url := newTestServer(t, filepath.Join(dir, "live.sqlite"), func(cfg *server.Config) {
+		cfg.APIKey = "backup-key"
+		cfg.BackupDir = filepath.Join(dir, "backups")
+	}).URL
+	post := func(path, key string, body interface{}) (*http.Response, []byte) {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", url+path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp, respBody
+	}
+	for i := 0; i < 3; i++ {
+		post("/save-memory", "backup-key", map[string]interface{}{"memory_id": "backed-up", "content": fmt.Sprintf("v%d", i)})
+	}
+
+	resp, body := post("/backup", "backup-key", map[string]interface{}{})
+	var backup struct {
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	}
+	if resp.StatusCode != 200 || json.Unmarshal(body, &backup) != nil || filepath.Dir(backup.Path) != filepath.Join(dir, "backups") || backup.Size == 0 {
+		t.Fatalf("expected a backup in the backup directory, got %v %s", resp.Status, body)
+	}
+	copied, err := sql.Open("sqlite3", backup.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	var versions int
+	if err := copied.QueryRow("SELECT COUNT(*) FROM memories WHERE memory_id='backed-up'").Scan(&versions); err != nil || versions != 3 {
+		t.Errorf("expected the backup to hold all 3 versions, got %d (%v)", versions, err)
+	}
+
+	checks := []struct {
+		name, key, path string
+		status          int
+	}{
+		{"without the API key", "wrong-key", "other.sqlite", http.StatusUnauthorized},
+		{"existing file", "backup-key", filepath.Base(backup.Path), http.StatusConflict},
+		{"outside the backup directory", "backup-key", "../escaped.sqlite", http.StatusBadRequest},
+	}
+	for _, c := range checks {
+		if resp, body := post("/backup", c.key, map[string]interface{}{"path": c.path}); resp.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %v %s", c.name, c.status, resp.Status, body)
+		}
+	}
+
+	// Without an API key configured nobody may write backups
+	open := newTestServer(t, ":memory:", nil).URL
+	r, err := http.Post(open+"/backup", "application/json", strings.NewReader(`{"path": "`+filepath.Join(dir, "open.sqlite")+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusForbidden {
+		t.Errorf("without an API key configured: expected 403, got %d", r.StatusCode)
+	}
+}
+
+func TestShutdownTimeoutConfig(t *testing.T) {
+	t.Setenv("MEMORY_SERVER_DSN", ":memory:")
+	if cfg, err := server.LoadConfig(); err != nil || cfg.ShutdownTimeout != 5*time.Second {
+		t.Errorf("expected a default of 5s, got %v (%v)", cfg.ShutdownTimeout, err)
+	}
+	t.Setenv("MEMORY_SERVER_SHUTDOWN_TIMEOUT", "2m")
+	if cfg, err := server.LoadConfig(); err != nil || cfg.ShutdownTimeout != 2*time.Minute {
+		t.Errorf("expected 2m, got %v (%v)", cfg.ShutdownTimeout, err)
+	}
+	for _, bad := range []string{"30", "soon", "-5s", "0s"} {
+		t.Setenv("MEMORY_SERVER_SHUTDOWN_TIMEOUT", bad)
+		if _, err := server.LoadConfig(); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	dsn := t.TempDir() + "/blobs.sqlite"
+	url := newTestServer(t, dsn, func(cfg *server.Config) {
+		cfg.MaxBlobBytes = 64
+	}).URL
+	saved, err := http.Post(url+"/save-memory", "application/json", strings.NewReader(`{"memory_id": "with-blob", "content": "has a picture"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.Body.Close()
+	upload := func(memoryID, contentType string, data []byte) (*http.Response, []byte) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="pixel.png"`)
+		h.Set("Content-Type", contentType)
+		part, _ := form.CreatePart(h)
+		part.Write(data)
+		form.Close()
+		resp, err := http.Post(url+"/memory/"+memoryID+"/blob", form.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp, respBody
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\nnot really an image")
+	resp, body := upload("with-blob", "image/png", png)
+	var blob struct {
+		ID          int64  `json:"id"`
+		MemoryID    string `json:"memory_id"`
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Size        int    `json:"size"`
+	}
+	if resp.StatusCode != 200 || json.Unmarshal(body, &blob) != nil || blob.ID == 0 || blob.MemoryID != "with-blob" || blob.Filename != "pixel.png" || blob.ContentType != "image/png" || blob.Size != len(png) {
+		t.Fatalf("expected the blob's details, got %v %s", resp.Status, body)
+	}
+
+	r, err := http.Get(fmt.Sprintf("%s/blob/%d", url, blob.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if r.StatusCode != 200 || r.Header.Get("Content-Type") != "image/png" || !bytes.Equal(got, png) {
+		t.Errorf("expected the uploaded bytes as image/png, got %v %q %q", r.Status, r.Header.Get("Content-Type"), got)
+	}
+	if r.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expected nosniff, got %q", r.Header.Get("X-Content-Type-Options"))
+	}
+
+	if resp, body := upload("with-blob", "image/png", bytes.Repeat([]byte("x"), 65)); resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), "payload_too_large") {
+		t.Errorf("expected 413 for a blob over the limit, got %v %s", resp.Status, body)
+	}
+	if resp, body := upload("no-such-memory", "image/png", png); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 uploading to a missing memory, got %v %s", resp.Status, body)
+	}
+	for path, code := range map[string]int{"/blob/999": http.StatusNotFound, "/blob/abc": http.StatusBadRequest} {
+		r, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != code {
+			t.Errorf("GET %s: expected %d, got %d", path, code, r.StatusCode)
+		}
+	}
+	// Blobs belong to their memory's namespace
+	r, err = http.Get(fmt.Sprintf("%s/blob/%d?namespace=other", url, blob.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 from another namespace, got %d", r.StatusCode)
+	}
+
+	// Renaming the memory takes its blobs with it, rather than leaving them for the next memory saved as with-blob
+	renamed, err := http.Post(url+"/rename-memory", "application/json", strings.NewReader(`{"old_memory_id": "with-blob", "new_memory_id": "renamed-blob"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed.Body.Close()
+	if renamed.StatusCode != 200 {
+		t.Fatalf("rename failed: %v", renamed.Status)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	var memoryID string
+	if err := db.QueryRow("SELECT memory_id FROM blobs WHERE id=?", blob.ID).Scan(&memoryID); err != nil || memoryID != "renamed-blob" {
+		t.Errorf("expected the blob to move to renamed-blob, got %q (%v)", memoryID, err)
+	}
+
+	// Exports don't carry blobs, so replacing everything from one leaves none behind
+	replaced, err := http.Post(url+"/import?mode=replace", "application/json", strings.NewReader(`{"schema_version": 1, "memories": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced.Body.Close()
+	if replaced.StatusCode != 200 {
+		t.Fatalf("replace import failed: %v", replaced.Status)
+	}
+	if r, err = http.Get(fmt.Sprintf("%s/blob/%d", url, blob.ID)); err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a blob after a replace import, got %d", r.StatusCode)
+	}
+}
+
+func TestCloseStopsWriter(t *testing.T) {
+	// Each server's writer and access goroutines end with it, rather than leaking
+	seed := filepath.Join(t.TempDir(), "seed.ndjson")
+	os.WriteFile(seed, []byte(`{"memory_id": "late", "content": "after close"}`), 0o600)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		cfg := server.DefaultConfig()
+		cfg.DSN = ":memory:"
+		cfg.TrackAccess = true
+		cfg.SeedFile = seed
+		db, err := server.OpenDB(cfg)
+		if err != nil {
+			t.Fatalf("open database: %v", err)
+		}
+		if _, err := server.Migrate(db); err != nil {
+			t.Fatalf("migrate database: %v", err)
+		}
+		srv := server.NewServer(cfg, db)
+		srv.Close()
+		// Writes after Close fail rather than hanging or panicking
+		if _, err := srv.Seed(context.Background()); err == nil || !strings.Contains(err.Error(), "shutting down") {
+			t.Errorf("expected a write after Close to fail, got %v", err)
+		}
+		db.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+5 {
+		t.Errorf("expected closed servers' goroutines to end, went from %d to %d", before, n)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	url := newTestServer(t, t.TempDir()+"/normalize.sqlite", func(cfg *server.Config) { cfg.NormalizeTags = true }).URL
+	post := func(path string, body map[string]interface{}) Memory {
+		data, _ := json.Marshal(body)
+		r, err := http.Post(url+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		respBody, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		var m Memory
+		if r.StatusCode != 200 || json.Unmarshal(respBody, &m) != nil {
+			t.Fatalf("POST %s: %v %s", path, r.Status, string(respBody))
+		}
+		return m
+	}
+
+	// Tags differing only in case or surrounding whitespace are the same tag
+	m := post("/save-memory", map[string]interface{}{"memory_id": "normalized", "content": "c", "tags": []string{" API ", "api", "Go"}})
+	if fmt.Sprint(m.Tags) != "[api go]" {
+		t.Errorf("expected tags [api go], got %v", m.Tags)
+	}
+	m = post("/add-tag", map[string]interface{}{"memory_id": "normalized", "tag": " GO "})
+	if m.Version != 1 {
+		t.Errorf("expected adding an existing tag in another case to change nothing, got version %d", m.Version)
+	}
+	m = post("/remove-tag", map[string]interface{}{"memory_id": "normalized", "tag": "Api"})
+	if fmt.Sprint(m.Tags) != "[go]" {
+		t.Errorf("expected tags [go] after removing Api, got %v", m.Tags)
+	}
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	dsn := t.TempDir() + "/empty.sqlite"
+	cfg := server.DefaultConfig()
+	cfg.DSN = dsn
+	db, err := server.OpenDB(cfg)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+
+	applied, err := server.Migrate(db)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	versions := appliedMigrations(t, dsn)
+	if applied != len(versions) || len(versions) < 4 || versions[0] != 1 || versions[len(versions)-1] != len(versions) {
+		t.Errorf("expected every migration applied and recorded in order, applied %d, recorded %v", applied, versions)
+	}
+
+	// Already applied migrations are skipped
+	if applied, err := server.Migrate(db); err != nil || applied != 0 {
+		t.Errorf("expected no migrations applied the second time, applied %d: %v", applied, err)
+	}
+	if again := appliedMigrations(t, dsn); len(again) != len(versions) {
+		t.Errorf("expected %d migrations recorded, got %v", len(versions), again)
+	}
+}
+
+// appliedMigrations returns the migration versions recorded in a database, in order
+func appliedMigrations(t *testing.T, dsn string) []int {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		t.Fatalf("read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			t.Fatalf("scan schema_migrations: %v", err)
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func TestInMemoryDSNSharedAcrossConnections(t *testing.T) {
+	// Ask for a connection pool, which must not split :memory: into several separate databases
+	url := newTestServer(t, ":memory:", func(cfg *server.Config) { cfg.MaxOpenConns = 4 }).URL
+
+	const clients = 20
+	var wg sync.WaitGroup
+	errs := make(chan string, clients*2)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, _ := json.Marshal(map[string]interface{}{"memory_id": fmt.Sprintf("mem-%d", i), "content": "in memory"})
+			r, err := http.Post(url+"/save-memory", "application/json", bytes.NewReader(data))
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			r.Body.Close()
+			if r.StatusCode != 200 {
+				errs <- fmt.Sprintf("save-memory mem-%d: %v", i, r.Status)
+			}
+			r, err = http.Get(url + "/list-memories")
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			r.Body.Close()
+			if r.StatusCode != 200 {
+				errs <- fmt.Sprintf("list-memories: %v", r.Status)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+
+	r, err := http.Get(url + "/list-memories")
+	if err != nil {
+		t.Fatalf("list-memories: %v", err)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	var memories []Memory
+	if err := json.Unmarshal(body, &memories); err != nil {
+		t.Fatalf("list-memories unmarshal: %v\nBody: %s", err, string(body))
+	}
+	if len(memories) != clients {
+		t.Errorf("expected all %d memories in the one in-memory database, got %d", clients, len(memories))
+	}
 }